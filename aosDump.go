@@ -0,0 +1,136 @@
+// aosDump.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// AOS/VS DUMP format consists of a stream of records, independent of the tape block size, each beginning
+// with a one-word header holding the record type (6 bits) and the length of the record's data (10 bits).
+// The stream begins with a start-of-dump record, then for each file there is an FSB, a name block, optional
+// UDA and ACL records, any data blocks, and an end block.  An end-of-dump record ends the stream.
+//
+// N.B. Only enough of the format is decoded to list the names and sizes of the dumped files.
+const (
+	dumpStartType     = 0
+	dumpFSBType       = 1
+	dumpNameType      = 2
+	dumpUDAType       = 3
+	dumpACLType       = 4
+	dumpLinkType      = 5
+	dumpStartBlkType  = 6
+	dumpDataBlkType   = 7
+	dumpEndBlkType    = 8
+	dumpEndType       = 9
+	dumpStartRecBytes = 14 // revision, seconds, minutes, hours, day, month, year
+	dumpDataHdrBytes  = 10 // byte address, byte length, alignment count
+)
+
+// dumpEntryT is one file (or link) found in a dump
+type dumpEntryT struct {
+	name  string
+	bytes int64
+	link  string // the link resolution if the entry is a link
+}
+
+// dumpHeader splits a record header word into its type and length
+func dumpHeader(hdr []byte) (recType int, recLen int) {
+	return int(hdr[0]) >> 2, int(hdr[0]&3)<<8 | int(hdr[1])
+}
+
+// looksLikeDumpStart returns true if a tape record begins with a plausible DUMP start-of-dump record
+func looksLikeDumpStart(rec []byte) bool {
+	if len(rec) < 2+dumpStartRecBytes {
+		return false
+	}
+	if recType, recLen := dumpHeader(rec); recType != dumpStartType || recLen < dumpStartRecBytes {
+		return false
+	}
+	w := func(ix int) int { return int(binary.BigEndian.Uint16(rec[2+ix*2:])) }
+	return w(0) < 100 && w(1) < 60 && w(2) < 60 && w(3) < 24 && w(4) >= 1 && w(4) <= 31 && w(5) >= 1 && w(5) <= 12
+}
+
+// dumpDate returns the date and time recorded in a start-of-dump record
+func dumpDate(rec []byte) string {
+	w := func(ix int) int { return int(binary.BigEndian.Uint16(rec[2+ix*2:])) }
+	year := w(6)
+	if year < 1900 {
+		year += 1900
+	}
+	return fmt.Sprintf("%04d-%02d-%02d %02d:%02d:%02d", year, w(5), w(4), w(3), w(2), w(1))
+}
+
+// parseDump lists the files in a DUMP format stream.  The stream is always read to the end so
+// that a writer feeding it through a pipe is never blocked.
+func parseDump(r io.Reader) (entries []dumpEntryT, err error) {
+	defer io.Copy(ioutil.Discard, r)
+	var hdr [2]byte
+	var current *dumpEntryT
+	for {
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			return entries, fmt.Errorf("dump ends without an end-of-dump record")
+		}
+		recType, recLen := dumpHeader(hdr[:])
+		switch recType {
+		case dumpEndType:
+			return entries, nil
+		case dumpDataBlkType:
+			var dhb [dumpDataHdrBytes]byte
+			if _, err = io.ReadFull(r, dhb[:]); err != nil {
+				return entries, err
+			}
+			byteLen := int64(binary.BigEndian.Uint32(dhb[4:]))
+			alignment := int64(binary.BigEndian.Uint16(dhb[8:]))
+			if _, err = io.CopyN(ioutil.Discard, r, alignment+byteLen); err != nil {
+				return entries, err
+			}
+			if current != nil {
+				current.bytes += byteLen
+			}
+			continue
+		}
+		payload := make([]byte, recLen)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return entries, err
+		}
+		switch recType {
+		case dumpNameType:
+			entries = append(entries, dumpEntryT{name: strings.TrimRight(string(payload), "\000")})
+			current = &entries[len(entries)-1]
+		case dumpLinkType:
+			if current != nil {
+				current.link = strings.TrimRight(string(payload), "\000")
+			}
+		case dumpEndBlkType:
+			current = nil
+		case dumpStartType, dumpFSBType, dumpUDAType, dumpACLType, dumpStartBlkType:
+			// nothing needed for a listing
+		default:
+			return entries, fmt.Errorf("unknown DUMP record type %d", recType)
+		}
+	}
+}
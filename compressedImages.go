@@ -0,0 +1,124 @@
+// compressedImages.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed images are recognised by their file name extension.
+// Both gzip and zstd compression are supported.
+const (
+	gzipExt = ".gz"
+	zstdExt = ".zst"
+)
+
+// isCompressed returns true if an image file name indicates a compressed image
+func isCompressed(fileName string) bool {
+	switch compressionExt(fileName) {
+	case gzipExt, zstdExt:
+		return true
+	}
+	return false
+}
+
+func compressionExt(fileName string) string {
+	return strings.ToLower(filepath.Ext(fileName))
+}
+
+// compressedReadCloser closes the underlying file of a decompressing reader
+type compressedReadCloser struct {
+	io.Reader
+	file *os.File
+	zr   *zstd.Decoder // must be closed to release the decoder's goroutines
+}
+
+func (rc *compressedReadCloser) Close() error {
+	if rc.zr != nil {
+		rc.zr.Close()
+	}
+	return rc.file.Close()
+}
+
+// openImage opens an image file for reading, transparently decompressing it if necessary
+func openImage(fileName string) (io.ReadCloser, error) {
+	f, err := os.Open(fileName)
+	if err != nil || !isCompressed(fileName) {
+		return f, err
+	}
+	if compressionExt(fileName) == zstdExt {
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s is not a valid zstd file: %s", fileName, err.Error())
+		}
+		return &compressedReadCloser{Reader: zr, file: f, zr: zr}, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a valid gzip file: %s", fileName, err.Error())
+	}
+	return &compressedReadCloser{Reader: gz, file: f}, nil
+}
+
+// compressImage writes a compressed copy of workName to imageName, using the compression its extension names.
+// The new image is written alongside the old one and renamed over it, so the old image survives any failure.
+func compressImage(workName, imageName string) error {
+	src, err := os.Open(workName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile(filepath.Dir(imageName), filepath.Base(imageName)+"-")
+	if err != nil {
+		return err
+	}
+	var zw io.WriteCloser
+	if compressionExt(imageName) == zstdExt {
+		zw, err = zstd.NewWriter(dst)
+	} else {
+		zw = gzip.NewWriter(dst)
+	}
+	if err == nil {
+		_, err = io.Copy(zw, src)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return os.Rename(dst.Name(), imageName)
+}
@@ -0,0 +1,209 @@
+// coreDump.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/memory"
+)
+
+const (
+	// postMortemFile is written whenever the emulator exits
+	postMortemFile = "mvemug.dmp"
+	// maxFindResults limits the output of FIND and DUMPDIFF
+	maxFindResults = 100
+	// dumpWordsPerLine is the number of words displayed on each line by DUMP
+	dumpWordsPerLine = 8
+)
+
+var (
+	// coreMode is set when examining a post-mortem dump rather than running a machine
+	coreMode bool
+	// coreDump holds the dump being examined in coreMode
+	coreDump snapshotT
+)
+
+// postMortemDump writes the machine state to the post-mortem dump file
+func postMortemDump() {
+	snap, err := snapshotCapture(false)
+	if err == nil {
+		err = snapshotWrite(postMortemFile, &snap)
+	}
+	if err != nil {
+		log.Printf("ERROR: Could not write post-mortem dump %s: %s\n", postMortemFile, err.Error())
+	}
+}
+
+// coreLoad loads a post-mortem dump into memory and the CPU registers for offline examination
+func coreLoad(fileName string) error {
+	var err error
+	if coreDump, err = snapshotRead(fileName); err != nil {
+		return err
+	}
+	memory.MemInit(MemSizeWords, false)
+	snapshotRestore(&coreDump)
+	coreMode = true
+	return nil
+}
+
+// coreModeAllows returns false for any command which would run the machine or change its devices
+func coreModeAllows(command string) bool {
+	switch command {
+	case "ATT", "B", "CHECK", "CO", "COMMIT", "CREATE", "DET", "DISCARD", "LOADPR", "POWERFAIL", "POWERRESTORE", "RE", "SNAPSHOT", "SS", "ST":
+		return false
+	}
+	return true
+}
+
+// showCoreStatus displays the CPU and device state saved in the dump being examined
+func showCoreStatus() {
+	tto.PutNLString(fmt.Sprintf("Post-mortem dump from %s %s", appName, coreDump.AppVersion))
+	tto.PutString(coreDump.CPUStatus)
+	tto.PutNLString(coreDump.DevList)
+	for _, img := range coreDump.Images {
+		tto.PutNLString(fmt.Sprintf("%s had %s attached", img.Device, img.FileName))
+	}
+}
+
+// dumpMemory implements the DUMP command, displaying memory in the current radix with ASCII
+func dumpMemory(cmd []string) {
+	if len(cmd) < 2 {
+		cmdError(" *** DUMP command requires <from> [<to>] arguments ***")
+		return
+	}
+	from, err := strconv.ParseInt(cmd[1], inputRadix, 32)
+	if err != nil || from < 0 || from >= int64(MemSizeWords) {
+		cmdError(" *** DUMP command could not parse <from> argument ***")
+		return
+	}
+	to := from + dumpWordsPerLine - 1
+	if len(cmd) > 2 {
+		to, err = strconv.ParseInt(cmd[2], inputRadix, 32)
+		if err != nil || to < from {
+			cmdError(" *** DUMP command could not parse <to> argument ***")
+			return
+		}
+	}
+	if to >= int64(MemSizeWords) {
+		to = int64(MemSizeWords) - 1
+	}
+	for line := from; line <= to; line += dumpWordsPerLine {
+		var words, chars strings.Builder
+		for addr := line; addr < line+dumpWordsPerLine && addr <= to; addr++ {
+			w := memory.ReadWord(dg.PhysAddrT(addr))
+			fmt.Fprintf(&words, "%06o ", w)
+			chars.WriteByte(printableByte(byte(w >> 8)))
+			chars.WriteByte(printableByte(byte(w)))
+		}
+		tto.PutNLString(fmt.Sprintf("%011o: %s\"%s\"", line, words.String(), chars.String()))
+	}
+}
+
+// findMemory implements the FIND command, listing the addresses containing the given value
+func findMemory(cmd []string) {
+	if len(cmd) < 2 {
+		cmdError(" *** FIND command requires <value> [<from> <to>] arguments ***")
+		return
+	}
+	val, err := strconv.ParseUint(cmd[1], inputRadix, 16)
+	if err != nil {
+		cmdError(" *** FIND command could not parse <value> argument ***")
+		return
+	}
+	from, to := int64(0), int64(MemSizeWords-1)
+	if len(cmd) > 3 {
+		from, err = strconv.ParseInt(cmd[2], inputRadix, 32)
+		if err != nil || from < 0 || from >= int64(MemSizeWords) {
+			cmdError(" *** FIND command could not parse <from> argument ***")
+			return
+		}
+		to, err = strconv.ParseInt(cmd[3], inputRadix, 32)
+		if err != nil || to < from || to >= int64(MemSizeWords) {
+			cmdError(" *** FIND command could not parse <to> argument ***")
+			return
+		}
+	}
+	found := 0
+	for addr := from; addr <= to; addr++ {
+		if memory.ReadWord(dg.PhysAddrT(addr)) == dg.WordT(val) {
+			tto.PutNLString(fmt.Sprintf("Found at "+fmtRadixVerb(), addr))
+			found++
+			if found == maxFindResults {
+				tto.PutNLString(" *** Too many matches, stopping ***")
+				return
+			}
+		}
+	}
+	tto.PutNLString(fmt.Sprintf("%d. location(s) found", found))
+}
+
+// dumpDiff implements the DUMPDIFF command, comparing two dumps (or snapshots) word by word
+func dumpDiff(cmd []string) {
+	if len(cmd) < 3 {
+		cmdError(" *** DUMPDIFF command requires <dump1> <dump2> arguments ***")
+		return
+	}
+	d1, err := snapshotRead(cmd[1])
+	if err != nil {
+		cmdError(fmt.Sprintf(" *** Could not read %s: %s ***", cmd[1], err.Error()))
+		return
+	}
+	d2, err := snapshotRead(cmd[2])
+	if err != nil {
+		cmdError(fmt.Sprintf(" *** Could not read %s: %s ***", cmd[2], err.Error()))
+		return
+	}
+	if d1.PC != d2.PC {
+		tto.PutNLString(fmt.Sprintf("PC:  %011o  %011o", d1.PC, d2.PC))
+	}
+	for ac := 0; ac < 4; ac++ {
+		if d1.Ac[ac] != d2.Ac[ac] {
+			tto.PutNLString(fmt.Sprintf("AC%d: %011o  %011o", ac, d1.Ac[ac], d2.Ac[ac]))
+		}
+	}
+	diffs := 0
+	for addr := range d1.Memory {
+		if d1.Memory[addr] != d2.Memory[addr] {
+			diffs++
+			if diffs <= maxFindResults {
+				tto.PutNLString(fmt.Sprintf("%011o: %06o  %06o", addr, d1.Memory[addr], d2.Memory[addr]))
+			}
+		}
+	}
+	if diffs > maxFindResults {
+		tto.PutNLString(fmt.Sprintf(" *** Only the first %d. differences shown ***", maxFindResults))
+	}
+	tto.PutNLString(fmt.Sprintf("%d. memory word(s) differ", diffs))
+}
+
+// printableByte returns the byte if it is printable ASCII, otherwise a dot
+func printableByte(b byte) byte {
+	if b < ' ' || b > '~' {
+		return '.'
+	}
+	return b
+}
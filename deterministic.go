@@ -0,0 +1,193 @@
+// deterministic.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/logging"
+	"github.com/SMerrony/dgemug/memory"
+	"github.com/SMerrony/dgemug/mvcpu"
+)
+
+// In deterministic mode (the -deterministic flag) the CPU is not run by mvcpu's own loop, which gives us
+// no way in between instructions, but by runDeterministic below, which follows the same sequence as mvcpu's
+// Run.  After every instruction the loop advances the virtual clock and lets the RTC and PIT act on it before
+// any pending interrupt is taken.  Guest timing, the -maxinstr limit and the instruction at which each timer
+// interrupt arrives are then the same on every run, whatever the speed of the host.
+// N.B. mvcpu's Run has no hook to drive the virtual clock, so this mode cannot use it and is slower.
+const (
+	maxIndirect   = 16 // levels of indirection followed through the interrupt vector
+	interruptSave = 0  // where the PC is saved when an interrupt is accepted
+	interruptJump = 1  // indirect through here to the interrupt handler
+)
+
+// virtualInstrs counts the instructions executed in deterministic mode, it is the RTC and PIT's clock
+var virtualInstrs uint64
+
+// virtualNow returns the current virtual time in instructions
+func virtualNow() uint64 {
+	return atomic.LoadUint64(&virtualInstrs)
+}
+
+// instrCount returns the number of instructions the CPU has executed in whichever mode it runs
+func instrCount() uint64 {
+	if *deterministicFlag {
+		return virtualNow()
+	}
+	return cpu.GetInstrCount()
+}
+
+// runDeterministic executes instructions one at a time until the CPU stops, and returns a message saying why
+// and the instruction counts, as mvcpu's Run does.
+func runDeterministic(disassembly bool) (errDetail string, instrCounts []int) {
+	instrCounts = make([]int, maxInstrCounts)
+	var executed uint64
+	var prevPC dg.PhysAddrT
+	for {
+		// FETCH
+		pc := cpu.GetPC()
+		thisOp := memory.ReadWord(pc)
+
+		// DECODE
+		seg := int(pc>>29) & 0x07
+		iPtr, ok := mvcpu.InstructionDecode(thisOp, pc, cpu.GetLef(seg), cpu.GetIO(seg), cpu.GetAtu(), disassembly, deviceMap)
+		if !ok {
+			return " *** Error: could not decode instruction ***", instrCounts
+		}
+		if ix := instrIndex(iPtr); ix >= 0 && ix < len(instrCounts) {
+			instrCounts[ix]++
+		}
+		if disassembly {
+			logging.DebugPrint(logging.DebugLog, "%s  %s\n", cpu.CompactPrintableStatus(), iPtr.GetDisassembly())
+		}
+
+		// EXECUTE
+		if !cpu.Execute(iPtr) {
+			return " *** Error: could not execute instruction (or CPU HALT encountered) ***", instrCounts
+		}
+		executed++
+		now := atomic.AddUint64(&virtualInstrs, 1)
+		rtc.virtualCheck(now)
+		pit.virtualCheck(now)
+
+		// INTERRUPT?
+		if bus.GetIRQ() {
+			if err := acceptInterrupt(); err != nil {
+				return fmt.Sprintf(" *** Could not accept interrupt - %s ***", err), instrCounts
+			}
+		}
+
+		// BREAKPOINT?
+		if isBreakpoint(cpu.GetPC()) {
+			cpu.SetSCPIO(true)
+			msg := fmt.Sprintf(" *** BREAKpoint hit at physical address "+fmtRadixVerb()+" (previous PC "+fmtRadixVerb()+") ***",
+				cpu.GetPC(), prevPC)
+			tto.PutNLString(msg)
+			log.Println(msg)
+			return "", instrCounts
+		}
+
+		if *maxInstrFlag > 0 && executed >= *maxInstrFlag {
+			requestHalt(haltInstrLimit)
+		}
+
+		// Console interrupt?
+		if cpu.GetSCPIO() {
+			return " *** Console ESCape ***", instrCounts
+		}
+		prevPC = pc
+	}
+}
+
+// maxInstrCounts is the size of mvcpu's table of instruction counts, indexed by instruction
+const maxInstrCounts = 750
+
+// instrIxType and instrIxField locate the instruction index in mvcpu's decoded instructions, once it has been found
+var (
+	instrIxType  reflect.Type
+	instrIxField int
+)
+
+// instrIndex returns a decoded instruction's index into the table of instruction counts, or -1 if it cannot be found.
+// mvcpu does not export the index, so it is read by reflection.
+func instrIndex(iPtr interface{}) int {
+	v := reflect.ValueOf(iPtr)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return -1
+	}
+	v = v.Elem()
+	if v.Type() != instrIxType {
+		f, ok := v.Type().FieldByName("ix")
+		if !ok || f.Type.Kind() != reflect.Int {
+			return -1
+		}
+		instrIxType, instrIxField = v.Type(), f.Index[0]
+	}
+	return int(v.Field(instrIxField).Int())
+}
+
+// acceptInterrupt takes the pending interrupt if interrupts are on, as mvcpu's Run does: interrupts are turned off
+// and the IRQ reset, the PC is saved in location 0 and control passes through location 1 within the current ring.
+// N.B. As in Run, only the low 16 bits of the PC are saved.
+func acceptInterrupt() error {
+	ion, err := execSCPOp(opSkpbnCPU)
+	if err != nil || !ion {
+		return err
+	}
+	if _, err := execSCPOp(opIntds); err != nil {
+		return err
+	}
+	bus.SetIRQ(false)
+	pc := cpu.GetPC()
+	memory.WriteWord(interruptSave, dg.WordT(pc))
+	handler, err := interruptHandler(pc & 0x7000_0000)
+	if err != nil {
+		return err
+	}
+	cpu.SetPC(handler)
+	return nil
+}
+
+// interruptHandler resolves the interrupt vector in location 1, as mvcpu does for Run
+func interruptHandler(ring dg.PhysAddrT) (dg.PhysAddrT, error) {
+	vector := memory.ReadWord(interruptJump)
+	handler := dg.PhysAddrT(vector) | ring
+	if !memory.TestWbit(vector, 0) {
+		return handler, nil
+	}
+	ind, ok := memory.ReadDwordTrap(handler)
+	for i := 0; ok && memory.TestDwbit(ind, 0); i++ {
+		if i == maxIndirect {
+			return 0, fmt.Errorf("too many levels of indirection in the interrupt vector")
+		}
+		ind, ok = memory.ReadDwordTrap(dg.PhysAddrT(ind & 0x7fff_ffff))
+	}
+	if !ok {
+		return 0, fmt.Errorf("the interrupt vector is outside memory")
+	}
+	return dg.PhysAddrT(ind) | ring, nil
+}
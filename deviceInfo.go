@@ -23,6 +23,8 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/SMerrony/dgemug/devices"
 )
@@ -41,20 +43,22 @@ const (
 	devBMC   = 005
 	devTTI   = 010
 	devTTO   = 011
+	devPTR   = 012
+	devPTP   = 013
 	devRTC   = 014
 	devLPT   = 017
 	devMTB   = 022
 	devMTJ   = 023
 	devDSKP  = 024
 	devDPF   = 027
-	devISC   = 034
+	devTMX2  = 034 // MV/Em terminal multiplexor, at the ISC's code
 	devPIT   = 043
 	devSCP   = 045
-	devIAC1  = 050
+	devTMX1  = 050 // at the IAC1's code
 	devMTB1  = 062
 	devMTJ1  = 063
 	devDSKP1 = 064
-	devIAC   = 065
+	devTMX   = 065 // at the IAC's code
 	devDPF1  = 067
 	devFPU   = 076
 	devCPU   = 077
@@ -68,20 +72,22 @@ var deviceMap = devices.DeviceMapT{
 	devBMC:   {DgMnemonic: "BMC", PMB: 99, IsIO: true, IsBootable: false},
 	devTTI:   {DgMnemonic: "TTI", PMB: 14, IsIO: true, IsBootable: false},
 	devTTO:   {DgMnemonic: "TTO", PMB: 15, IsIO: true, IsBootable: false},
+	devPTR:   {DgMnemonic: "PTR", PMB: 11, IsIO: true, IsBootable: true},
+	devPTP:   {DgMnemonic: "PTP", PMB: 13, IsIO: true, IsBootable: false},
 	devRTC:   {DgMnemonic: "RTC", PMB: 13, IsIO: true, IsBootable: false},
 	devLPT:   {DgMnemonic: "LPT", PMB: 12, IsIO: true, IsBootable: false},
 	devMTB:   {DgMnemonic: "MTB", PMB: 10, IsIO: true, IsBootable: true},
 	devMTJ:   {DgMnemonic: "MTJ", PMB: 10, IsIO: true, IsBootable: true},
 	devDSKP:  {DgMnemonic: "DSKP", PMB: 7, IsIO: true, IsBootable: true},
 	devDPF:   {DgMnemonic: "DPF", PMB: 7, IsIO: true, IsBootable: true},
-	devISC:   {DgMnemonic: "ISC", PMB: 4, IsIO: true, IsBootable: false},
-	devPIT:   {DgMnemonic: "PIT", PMB: 11, IsIO: false, IsBootable: false},
+	devTMX2:  {DgMnemonic: "TMX2", PMB: 11, IsIO: true, IsBootable: false},
+	devPIT:   {DgMnemonic: "PIT", PMB: 11, IsIO: true, IsBootable: false},
 	devSCP:   {DgMnemonic: "SCP", PMB: 15, IsIO: true, IsBootable: false},
-	devIAC1:  {DgMnemonic: "IAC1", PMB: 11, IsIO: true, IsBootable: false},
+	devTMX1:  {DgMnemonic: "TMX1", PMB: 11, IsIO: true, IsBootable: false},
 	devMTB1:  {DgMnemonic: "MTB1", PMB: 10, IsIO: true, IsBootable: true},
 	devMTJ1:  {DgMnemonic: "MTJ1", PMB: 10, IsIO: true, IsBootable: true},
 	devDSKP1: {DgMnemonic: "DSKP1", PMB: 7, IsIO: true, IsBootable: true},
-	devIAC:   {DgMnemonic: "IAC", PMB: 11, IsIO: true, IsBootable: false},
+	devTMX:   {DgMnemonic: "TMX", PMB: 11, IsIO: true, IsBootable: false},
 	devDPF1:  {DgMnemonic: "DPF1", PMB: 7, IsIO: true, IsBootable: true},
 	devFPU:   {DgMnemonic: "FPU", PMB: 99, IsIO: true, IsBootable: false},
 	devCPU:   {DgMnemonic: "CPU", PMB: 0, IsIO: true, IsBootable: false},
@@ -96,3 +102,96 @@ func deviceToString(devNum int) string {
 	}
 	return fmt.Sprintf("%#o", devNum)
 }
+
+// Maximum number of units which may be attached to each type of controller
+const (
+	maxTapeUnits = 8
+	maxDiskUnits = 4
+)
+
+// devUnitT identifies a unit on a controller, as given to ATT, DET, etc.
+// eg. DPF (DPF unit 0), DPF1 (second DPF controller, unit 0), MTB:1 (MTB unit 1), MTB1:2
+type devUnitT struct {
+	devType string // the controller type, eg. MTB, DPF, DSKP
+	devNum  int    // the controller's device code
+	unit    int
+}
+
+// parseDevUnit interprets a device/unit name of the form <mnemonic>[:<unit>]
+func parseDevUnit(arg string) (du devUnitT, err error) {
+	mnem := arg
+	if colon := strings.IndexByte(arg, ':'); colon != -1 {
+		mnem = arg[:colon]
+		du.unit, err = strconv.Atoi(arg[colon+1:])
+		if err != nil || du.unit < 0 {
+			return du, fmt.Errorf("invalid unit number in <%s>", arg)
+		}
+	}
+	du.devNum = -1
+	for devNum, de := range deviceMap {
+		if de.DgMnemonic == mnem {
+			du.devNum = devNum
+		}
+	}
+	if du.devNum == -1 {
+		return du, fmt.Errorf("unknown device <%s>", mnem)
+	}
+	du.devType = strings.TrimRight(mnem, "0123456789")
+	if du.unit >= maxUnits(du.devType) {
+		return du, fmt.Errorf("unit number %d. is too high for %s", du.unit, mnem)
+	}
+	return du, nil
+}
+
+// maxUnits returns the number of units which may be attached to a type of controller
+func maxUnits(devType string) int {
+	switch devType {
+	case "MTB":
+		return maxTapeUnits
+	case "DPF", "DSKP":
+		return maxDiskUnits
+	}
+	return 1
+}
+
+// aosDevTypes maps AOS/VS device name prefixes to the controller types we emulate
+var aosDevTypes = map[string]string{"DPJ": "DSKP", "DPF": "DPF", "MTB": "MTB"}
+
+// parseBootDevice interprets the argument to B, which may be a device code in the current input radix,
+// a device/unit as for ATT, or an AOS/VS device name such as DPJ0 or DPF10 (second DPF controller, unit 0).
+// N.B. Our own mnemonics take precedence, so DPF1 is the second DPF controller and not AOS/VS's DPF unit 1.
+func parseBootDevice(arg string, radix int) (du devUnitT, err error) {
+	if du, err = parseDevUnit(arg); err == nil {
+		return du, nil
+	}
+	if code, err := strconv.ParseInt(arg, radix, 16); err == nil {
+		de, known := deviceMap[int(code)]
+		if !known {
+			return du, fmt.Errorf("unknown device code <%s>", arg)
+		}
+		return devUnitT{devType: strings.TrimRight(de.DgMnemonic, "0123456789"), devNum: int(code)}, nil
+	}
+	prefix, num := strings.TrimRight(arg, "0123456789"), strings.TrimLeft(arg, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	devType, known := aosDevTypes[prefix]
+	if !known || num == "" || prefix+num != arg {
+		return du, fmt.Errorf("unknown device <%s>", arg)
+	}
+	n, _ := strconv.Atoi(num)
+	ctrlr := devType
+	switch {
+	case n >= 20:
+		return du, fmt.Errorf("unknown device <%s>", arg)
+	case n >= 10:
+		ctrlr += "1"
+		n -= 10
+	}
+	return parseDevUnit(fmt.Sprintf("%s:%d", ctrlr, n))
+}
+
+// String returns the canonical name of the device/unit, the unit number is omitted for unit 0
+func (du devUnitT) String() string {
+	if du.unit == 0 {
+		return deviceMap[du.devNum].DgMnemonic
+	}
+	return fmt.Sprintf("%s:%d", deviceMap[du.devNum].DgMnemonic, du.unit)
+}
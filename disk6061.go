@@ -0,0 +1,754 @@
+// disk6061.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Here we are emulating the type 6061 moving-head disk controller (DPF) with up to four drives attached.
+// The controller is derived from dgemug's single-drive disk6061 emulation, each drive now has its own image,
+// cylinder, status and geometry, and the image is reached through the diskImage interface rather than a host file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/logging"
+	"github.com/SMerrony/dgemug/memory"
+)
+
+// Physical characteristics of the emulated disk, the geometry of each drive is given when its image is attached
+const (
+	disk6061WordsPerSect = 256
+	disk6061BytesPerSect = disk6061WordsPerSect * 2
+	// disk6061Drives is the number of drives a controller can address, the drive field of DOA is 2 bits
+	disk6061Drives = 4
+)
+
+const (
+	disk6061CmdRead = iota
+	disk6061CmdRecal
+	disk6061CmdSeek
+	disk6061CmdStop
+	disk6061CmdOffsetFwd
+	disk6061CmdOffsetRev
+	disk6061CmdWriteDisable
+	disk6061CmdRelease
+	disk6061CmdTrespass
+	disk6061CmdSetAltMode1
+	disk6061CmdSetAltMode2
+	disk6061CmdNoOp
+	disk6061CmdVerify
+	disk6061CmdReadBuffs
+	disk6061CmdWrite
+	disk6061CmdFormat
+)
+
+var disk6061CmdDecode = [...]string{"READ", "RECAL", "SEEK", "STOP", "OFFSET FWD", "OFFSET REV",
+	"WRITE DISABLE", "RELEASE", "TRESPASS", "SET ALT MODE 1", "SET ALT MODE 2",
+	"NO OP", "VERIFY", "READ BUFFERS", "WRITE", "FORMAT"}
+
+const (
+	disk6061InsModeNormal = iota
+	disk6061InsModeAlt1
+	disk6061InsModeAlt2
+)
+const (
+	// drive statuses
+	disk6061Drivefault = 1 << iota
+	disk6061Writefault
+	disk6061Clockfault
+	disk6061Posnfault
+	disk6061Packunsafe
+	disk6061Powerfault
+	disk6061Illegalcmd
+	disk6061Invalidaddr
+	disk6061Unused
+	disk6061Writedis
+	disk6061Offset
+	disk6061Busy
+	disk6061Ready
+	disk6061Trespassed
+	disk6061Reserved
+	disk6061Invalid
+)
+const (
+	// R/W statuses
+	disk6061Rwfault = 1 << iota
+	disk6061late
+	disk6061Rwtimeout
+	disk6061Verify
+	disk6061Surfsect
+	disk6061Cylinder
+	disk6061Badsector
+	disk6061Ecc
+	disk6061Illegalsector
+	disk6061Parity
+	disk6061Drive3Done
+	disk6061Drive2Done
+	disk6061Drive1Done
+	disk6061Drive0Done
+	disk6061Rwdone
+	disk6061Controlfull
+)
+
+// disk6061StatsPeriodMs is the number of milliseconds between sending status updates
+const disk6061StatsPeriodMs = 500
+
+// disk6061DriveT is a drive on a 6061 controller
+type disk6061DriveT struct {
+	image         diskImage // nil if no image is attached
+	readOnly      bool      // the image was attached read-only
+	geom          diskGeometryT
+	writeDisabled bool     // the guest has issued WRITE DISABLE, cleared by a reset
+	cylinder      dg.WordT // 10-bit, each drive seeks independently
+	driveStatus   dg.WordT
+}
+
+// protected returns true if writes to the drive are not allowed
+func (drv *disk6061DriveT) protected() bool {
+	return drv.readOnly || drv.writeDisabled
+}
+
+// readyStatus returns the drive status of an idle drive with an image
+func (drv *disk6061DriveT) readyStatus() dg.WordT {
+	if drv.protected() {
+		return disk6061Ready | disk6061Writedis
+	}
+	return disk6061Ready
+}
+
+// disk6061T holds the current state of a Type 6061 Moving-Head Disk controller
+type disk6061T struct {
+	// MV/Em internals...
+	disk6061Mu    sync.Mutex
+	bus           *devices.BusT
+	devNum        int
+	logID         int
+	drives        [disk6061Drives]disk6061DriveT
+	reads, writes uint64
+	sectBuff      []byte
+	debugLogging  bool
+	// DG data...
+	command         int8     // 4-bit
+	drive           uint8    // 2-bit
+	mapEnabled      bool     // is the BMC addressing physical (0) or Mapped (1)
+	memAddr         dg.WordT // self-incrementing on DG
+	ema             uint8    // 5-bit
+	surface         uint8    // 5-bit - increments post-op
+	sector          uint8    // 5-bit - increments mid-op
+	sectCnt         int8     // 5-bit - incrememts mid-op - signed
+	rwStatus        dg.WordT
+	instructionMode int
+	lastDOAwasSeek  bool
+}
+
+// disk6061StatT holds the data reported to the status collector
+type disk6061StatT struct {
+	attached      int // the number of drives with images attached
+	drive         uint8
+	cylinder      dg.WordT
+	head, sector  uint8
+	reads, writes uint64
+}
+
+// disk6061Init must be called to initialise the emulated disk6061 controller
+func (disk *disk6061T) disk6061Init(dev int, bus *devices.BusT, statsChann chan disk6061StatT, logID int, logging bool) {
+	disk.disk6061Mu.Lock()
+	defer disk.disk6061Mu.Unlock()
+	disk.devNum = dev
+	disk.bus = bus
+	disk.logID = logID
+	disk.debugLogging = logging
+
+	go disk.disk6061StatsSender(statsChann)
+
+	bus.SetResetFunc(disk.devNum, disk.disk6061Reset)
+	bus.SetDataInFunc(disk.devNum, disk.disk6061In)
+	bus.SetDataOutFunc(disk.devNum, disk.disk6061Out)
+	disk.instructionMode = disk6061InsModeNormal
+	for d := range disk.drives {
+		disk.drives[d] = disk6061DriveT{}
+	}
+	disk.mapEnabled = false
+	disk.sectBuff = make([]byte, disk6061BytesPerSect)
+}
+
+// disk6061Attach gives a drive an image, the controller closes the image when it is detached.
+// A read-only drive is write-protected, which is shown in its drive status.
+func (disk *disk6061T) disk6061Attach(drive int, image diskImage, imgName string, readOnly bool, geom diskGeometryT) error {
+	disk.disk6061Mu.Lock()
+	defer disk.disk6061Mu.Unlock()
+	if disk.drives[drive].image != nil {
+		return fmt.Errorf("drive %d. already has an image attached", drive)
+	}
+	disk.drives[drive] = disk6061DriveT{image: image, readOnly: readOnly, geom: geom}
+	disk.drives[drive].driveStatus = disk.drives[drive].readyStatus()
+	logging.DebugPrint(disk.logID, "disk6061Attach attached drive #%d to image <%s>\n", drive, imgName)
+	disk.bus.SetAttached(disk.devNum, imgName)
+	return nil
+}
+
+// disk6061Detach closes a drive's image, the caller must ensure the controller is not busy
+func (disk *disk6061T) disk6061Detach(drive int) error {
+	disk.disk6061Mu.Lock()
+	defer disk.disk6061Mu.Unlock()
+	image := disk.drives[drive].image
+	if image == nil {
+		return fmt.Errorf("no image is attached to drive %d.", drive)
+	}
+	disk.drives[drive] = disk6061DriveT{}
+	if disk.attachedDrives() == 0 {
+		disk.bus.SetDetached(disk.devNum)
+	}
+	return image.close()
+}
+
+// attachedDrives returns the number of drives with images - MUST BE LOCKED BY CALLER
+func (disk *disk6061T) attachedDrives() (n int) {
+	for d := range disk.drives {
+		if disk.drives[d].image != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// disk6061SetLogging sets the disk's internal; debug logging flag as specified
+// N.B. The disk runs slower with this set.
+func (disk *disk6061T) disk6061SetLogging(log bool) {
+	disk.disk6061Mu.Lock()
+	disk.debugLogging = log
+	disk.disk6061Mu.Unlock()
+}
+
+func (disk *disk6061T) disk6061StatsSender(sChan chan disk6061StatT) {
+	var stats disk6061StatT
+	for {
+		disk.disk6061Mu.Lock()
+		stats.attached = disk.attachedDrives()
+		stats.drive = disk.drive
+		stats.cylinder = disk.drives[disk.drive].cylinder
+		stats.head = disk.surface
+		stats.sector = disk.sector
+		stats.reads = disk.reads
+		stats.writes = disk.writes
+		disk.disk6061Mu.Unlock()
+		select {
+		case sChan <- stats:
+		default:
+		}
+		time.Sleep(time.Millisecond * disk6061StatsPeriodMs)
+	}
+}
+
+// disk6061LoadDKBT - This func mimics a system ROM routine to boot from disk.
+// Rather than copying a ROM routine (!) we simply mimic its basic actions...
+// Load 1st block from the given drive into location 0
+func (disk *disk6061T) disk6061LoadDKBT(drive int) {
+	logging.DebugPrint(disk.logID, "disk6061LoadDKBT() called for drive #%d\n", drive)
+	disk.disk6061Mu.Lock()
+	disk.drive = uint8(drive)
+	disk.command = disk6061CmdRecal
+	disk.disk6061Mu.Unlock()
+	disk.disk6061DoCommand()
+	disk.disk6061Mu.Lock()
+	disk.memAddr = 0
+	disk.sectCnt = -1
+	disk.command = disk6061CmdRead
+	disk.disk6061Mu.Unlock()
+	disk.disk6061DoCommand()
+	logging.DebugPrint(disk.logID, "disk6061LoadDKBT() completed\n")
+}
+
+// disk6061In implements the DIA/B/C I/O instructions for this device
+func (disk *disk6061T) disk6061In(abc byte, flag byte) (data dg.WordT) {
+	disk.disk6061Mu.Lock()
+	switch abc {
+	case 'A':
+		switch disk.instructionMode {
+		case disk6061InsModeNormal:
+			data = disk.rwStatus
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "DIA [Read Data Txfr Status] (Normal mode returning %s for DRV=%d\n",
+					memory.WordToBinStr(disk.rwStatus), disk.drive)
+			}
+		case disk6061InsModeAlt1:
+			data = disk.memAddr // ???
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "DIA [Read Memory Addr] (Alt Mode 1) returning %#0o for DRV=%d\n",
+					data, disk.drive)
+			}
+		case disk6061InsModeAlt2:
+			data = 0
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "DIA [Read 1st ECC Word] (Alt Mode 2) returning %#0o for DRV=%d\n",
+					data, disk.drive)
+			}
+		}
+	case 'B':
+		switch disk.instructionMode {
+		case disk6061InsModeNormal:
+			data = disk.drives[disk.drive].driveStatus & 0xfeff
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "DIB [Read Drive Status] (Normal mode) returning %s for DRV=%d\n", memory.WordToBinStr(data), disk.drive)
+			}
+		case disk6061InsModeAlt1:
+			data = dg.WordT(0x8000) | dg.WordT(disk.ema)&0x01f
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "DIB [Read EMA] (Alt Mode 1) returning: %#0o\n", data)
+			}
+		case disk6061InsModeAlt2:
+			data = 0
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "DIB [Read 2nd ECC Word] (Alt Mode 2) returning %#0o for DRV=%d\n",
+					data, disk.drive)
+			}
+		}
+	case 'C':
+		var ssc dg.WordT
+		if disk.mapEnabled {
+			ssc = 1 << 15
+		}
+		ssc |= (dg.WordT(disk.surface) & 0x1f) << 10
+		ssc |= (dg.WordT(disk.sector) & 0x1f) << 5
+		ssc |= (dg.WordT(disk.sectCnt) & 0x1f)
+		data = ssc
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "disk6061 DIC returning: %s\n", memory.WordToBinStr(ssc))
+		}
+	}
+	disk.disk6061Mu.Unlock()
+
+	disk.disk6061HandleFlag(flag)
+
+	return data
+}
+
+// disk6061Out implements the DOA/B/C instructions for this device
+// NIO is also routed here with a dummy abc flag value of N
+func (disk *disk6061T) disk6061Out(datum dg.WordT, abc byte, flag byte) {
+	disk.disk6061Mu.Lock()
+	switch abc {
+	case 'A':
+		disk.command = extractdisk6061Command(datum)
+		disk.drive = extractdisk6061DriveNo(datum)
+		disk.ema = extractdisk6061EMA(datum)
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "DOA [Specify Cmd,Drv,EMA] to DRV=%d with data %s\n",
+				disk.drive, memory.WordToBinStr(datum))
+		}
+		if memory.TestWbit(datum, 0) {
+			disk.rwStatus &^= disk6061Rwdone | disk6061Rwfault | disk6061late | disk6061Verify | disk6061Surfsect |
+				disk6061Cylinder | disk6061Badsector | disk6061Ecc | disk6061Illegalsector | disk6061Parity
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... Clear R/W Done et al.\n")
+			}
+		}
+		for d := 0; d < disk6061Drives; d++ {
+			if memory.TestWbit(datum, d+1) {
+				disk.rwStatus &^= disk6061DriveDone(d)
+			}
+		}
+		disk.instructionMode = disk6061InsModeNormal
+		if disk.command == disk6061CmdSetAltMode1 {
+			disk.instructionMode = disk6061InsModeAlt1
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... Alt Mode 1 set\n")
+			}
+		}
+		if disk.command == disk6061CmdSetAltMode2 {
+			disk.instructionMode = disk6061InsModeAlt2
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... Alt Mode 2 set\n")
+			}
+		}
+		if disk.command == disk6061CmdNoOp {
+			disk.instructionMode = disk6061InsModeNormal
+			disk.rwStatus = 0
+			disk.drives[disk.drive].driveStatus &^= disk6061Writefault | disk6061Illegalcmd
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... NO OP command done\n")
+			}
+		}
+		disk.lastDOAwasSeek = (disk.command == disk6061CmdSeek)
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... CMD: %s, DRV: %d, EMA: %#o\n",
+				disk6061CmdDecode[disk.command], disk.drive, disk.ema)
+		}
+	case 'B':
+		if memory.TestWbit(datum, 0) {
+			disk.ema |= 0x01
+		} else {
+			disk.ema &= 0xfe
+		}
+		disk.memAddr = datum & 0x7fff
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "DOB [Specify Memory Addr] with data %s\n",
+				memory.WordToBinStr(datum))
+			logging.DebugPrint(disk.logID, "... MEM Addr: %#o\n", disk.memAddr)
+			logging.DebugPrint(disk.logID, "... EMA: %#o\n", disk.ema)
+		}
+	case 'C':
+		if disk.lastDOAwasSeek {
+			disk.drives[disk.drive].cylinder = datum & 0x03ff // mask off lower 10 bits
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "DOC [Specify Cylinder] after SEEK with data %s\n",
+					memory.WordToBinStr(datum))
+				logging.DebugPrint(disk.logID, "... CYL: %d\n", disk.drives[disk.drive].cylinder)
+			}
+		} else {
+			disk.mapEnabled = memory.TestWbit(datum, 0)
+			disk.surface = extractsurface(datum)
+			disk.sector = extractSector(datum)
+			disk.sectCnt = extractSectCnt(datum)
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "DOC [Specify Surf,Sect,Cnt] (not after seek) with data %s\n",
+					memory.WordToBinStr(datum))
+				logging.DebugPrint(disk.logID, "... MAP: %d., SURF: %d., SECT: %d., SECCNT: %d.\n",
+					memory.BoolToInt(disk.mapEnabled), disk.surface, disk.sector, disk.sectCnt)
+			}
+		}
+	case 'N': // dummy value for NIO - we just handle the flag below
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "NIO%c received\n", flag)
+		}
+	}
+	disk.disk6061Mu.Unlock()
+
+	disk.disk6061HandleFlag(flag)
+}
+
+// disk6061DriveDone returns the R/W status bit showing a seek or recalibrate has completed on a drive
+func disk6061DriveDone(drive int) dg.WordT {
+	return disk6061Drive0Done >> uint(drive)
+}
+
+func (disk *disk6061T) disk6061DoCommand() {
+	disk.disk6061Mu.Lock()
+	defer disk.disk6061Mu.Unlock()
+
+	disk.instructionMode = disk6061InsModeNormal
+	drv := &disk.drives[disk.drive]
+
+	if drv.image == nil {
+		// nothing is mounted, the drive is not ready
+		drv.driveStatus = 0
+		disk.rwStatus = disk6061Rwdone | disk6061Rwfault
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... %s to DRV=%d which has no image\n", disk6061CmdDecode[disk.command], disk.drive)
+		}
+		return
+	}
+
+	switch disk.command {
+
+	// RECALibrate (goto pos. 0)
+	case disk6061CmdRecal:
+		drv.cylinder = 0
+		disk.surface = 0
+		drv.driveStatus |= disk6061Ready
+		disk.rwStatus = disk6061Rwdone | disk6061DriveDone(int(disk.drive))
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... RECAL done, %s\n", disk.disk6061PrintableAddr())
+		}
+
+	// SEEK
+	case disk6061CmdSeek:
+		drv.driveStatus |= disk6061Ready
+		disk.rwStatus = disk6061Rwdone | disk6061DriveDone(int(disk.drive))
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... SEEK done, %s\n", disk.disk6061PrintableAddr())
+		}
+
+	// ===== READ from disk6061 =====
+	case disk6061CmdRead:
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... READ command invoked %s\n", disk.disk6061PrintableAddr())
+			logging.DebugPrint(disk.logID, "... .... Start Address: %#o\n", disk.memAddr)
+		}
+		disk.rwStatus = 0
+		for disk.sectCnt != 0 {
+			sect, ok := disk.disk6061NextSector()
+			if !ok {
+				return
+			}
+			if err := drv.image.readSector(sect, disk.sectBuff); err != nil {
+				disk.disk6061IOError("read", err)
+				return
+			}
+			for wIx := 0; wIx < disk6061WordsPerSect; wIx++ {
+				wd := (dg.WordT(disk.sectBuff[(wIx*2)+1]) << 8) | dg.WordT(disk.sectBuff[wIx*2])
+				memory.WriteWordBmcChan16bit(&disk.memAddr, wd)
+			}
+			disk.sector++
+			disk.sectCnt++
+			disk.reads++
+		}
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... .... READ command finished %s\n", disk.disk6061PrintableAddr())
+			logging.DebugPrint(disk.logID, "\n... .... Last Address: %#o\n", disk.memAddr)
+		}
+		disk.rwStatus = disk6061Rwdone | disk6061DriveDone(int(disk.drive))
+
+	case disk6061CmdRelease:
+		// I think this is a NOP on a single-processor machine
+
+	// WRITE DISABLE protects the drive until the next reset
+	case disk6061CmdWriteDisable:
+		drv.writeDisabled = true
+		drv.driveStatus |= disk6061Ready | disk6061Writedis
+		disk.rwStatus = disk6061Rwdone
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... WRITE DISABLE done for DRV=%d\n", disk.drive)
+		}
+
+	case disk6061CmdWrite:
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... WRITE command invoked %s\n", disk.disk6061PrintableAddr())
+			logging.DebugPrint(disk.logID, "... .....  Start Address: %#o\n", disk.memAddr)
+		}
+		if drv.protected() {
+			// nothing is transferred
+			drv.driveStatus |= disk6061Writefault
+			disk.rwStatus = disk6061Rwdone | disk6061Rwfault
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... ..... WRITE refused, DRV=%d is write-protected\n", disk.drive)
+			}
+			return
+		}
+		disk.rwStatus = 0
+		for disk.sectCnt != 0 {
+			sect, ok := disk.disk6061NextSector()
+			if !ok {
+				return
+			}
+			for wIx := 0; wIx < disk6061WordsPerSect; wIx++ {
+				wd := memory.ReadWordBmcChan16bit(&disk.memAddr)
+				disk.sectBuff[(wIx*2)+1] = byte(wd >> 8)
+				disk.sectBuff[wIx*2] = byte(wd)
+			}
+			if err := drv.image.writeSector(sect, disk.sectBuff); err != nil {
+				disk.disk6061IOError("write", err)
+				return
+			}
+			disk.sector++
+			disk.sectCnt++
+			disk.writes++
+		}
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... ..... WRITE command finished %s\n", disk.disk6061PrintableAddr())
+			logging.DebugPrint(disk.logID, "... ..... Last Address: %#o\n", disk.memAddr)
+		}
+		drv.driveStatus |= disk6061Ready
+		disk.rwStatus = disk6061Rwdone
+
+	default:
+		// not emulated, the drive reports an illegal command rather than stopping the emulator
+		drv.driveStatus |= disk6061Illegalcmd
+		disk.rwStatus = disk6061Rwdone | disk6061Rwfault
+		logging.DebugPrint(logging.DebugLog, "WARNING: disk6061 command %s is not implemented\n", disk6061CmdDecode[disk.command])
+	}
+}
+
+// disk6061NextSector returns the image sector at the current address, advancing to the next surface at the end of
+// a track.  If the address is off the disk the R/W status is set and false returned.
+// MUST BE LOCKED BY CALLER
+func (disk *disk6061T) disk6061NextSector() (sect int64, ok bool) {
+	drv := &disk.drives[disk.drive]
+	// check CYL
+	if int(drv.cylinder) >= drv.geom.cylinders {
+		drv.driveStatus |= disk6061Ready
+		disk.rwStatus = disk6061Rwdone | disk6061Rwfault | disk6061Cylinder
+		return 0, false
+	}
+	// check SECT
+	if int(disk.sector) >= drv.geom.sectors {
+		disk.sector = 0
+		disk.surface++
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "Sector overflow, advancing to surface %d.", disk.surface)
+		}
+	}
+	// check SURF (head)
+	if int(disk.surface) >= drv.geom.heads {
+		drv.driveStatus |= disk6061Ready
+		disk.rwStatus = disk6061Rwdone | disk6061Rwfault | disk6061Illegalsector
+		return 0, false
+	}
+	sect = ((int64(drv.cylinder)*int64(drv.geom.heads))+int64(disk.surface))*int64(drv.geom.sectors) + int64(disk.sector)
+	return sect, true
+}
+
+// disk6061IOError reports a failure of the host image to the guest as a drive fault
+// MUST BE LOCKED BY CALLER
+func (disk *disk6061T) disk6061IOError(op string, err error) {
+	logging.DebugPrint(logging.DebugLog, "ERROR: disk6061 could not %s image of drive #%d: %s\n", op, disk.drive, err.Error())
+	disk.drives[disk.drive].driveStatus |= disk6061Drivefault
+	disk.rwStatus = disk6061Rwdone | disk6061Rwfault
+}
+
+func (disk *disk6061T) disk6061HandleFlag(f byte) {
+	switch f {
+	case 'S':
+		disk.bus.SetBusy(disk.devNum, true)
+		disk.bus.SetDone(disk.devNum, false)
+		disk.disk6061Mu.Lock()
+		disk.rwStatus = 0
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... S flag set\n")
+		}
+		disk.disk6061Mu.Unlock()
+		disk.disk6061DoCommand()
+		disk.bus.SetBusy(disk.devNum, false)
+		disk.bus.SetDone(disk.devNum, true)
+		disk.bus.SendInterrupt(disk.devNum)
+
+	case 'C':
+		disk.bus.SetBusy(disk.devNum, false)
+		disk.bus.SetDone(disk.devNum, false)
+		disk.disk6061Mu.Lock()
+		disk.rwStatus = 0
+		disk.disk6061Mu.Unlock()
+
+	case 'P':
+		disk.bus.SetBusy(disk.devNum, false)
+		disk.disk6061Mu.Lock()
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... P flag set\n")
+		}
+		disk.rwStatus = 0
+		disk.disk6061Mu.Unlock()
+		disk.disk6061DoCommand()
+		disk.bus.SendInterrupt(disk.devNum)
+
+	default:
+		// no/empty flag - nothing to do
+	}
+}
+
+func (disk *disk6061T) disk6061PrintableAddr() string {
+	// MUST BE LOCKED BY CALLER
+	pa := fmt.Sprintf("DRV: %d, CYL: %d, SURF: %d, SECT: %d, SECCNT: %d",
+		disk.drive, disk.drives[disk.drive].cylinder,
+		disk.surface, disk.sector, disk.sectCnt)
+	return pa
+}
+
+// reset the disk6061 controller
+func (disk *disk6061T) disk6061Reset() {
+	disk.disk6061Mu.Lock()
+	disk.instructionMode = disk6061InsModeNormal
+	disk.rwStatus = 0
+	disk.command = disk6061CmdRead
+	disk.drive = 0
+	disk.surface = 0
+	disk.sector = 0
+	disk.sectCnt = 0
+	for d := range disk.drives {
+		disk.drives[d].cylinder = 0
+		disk.drives[d].writeDisabled = false
+		disk.drives[d].driveStatus = 0
+		if disk.drives[d].image != nil {
+			disk.drives[d].driveStatus = disk.drives[d].readyStatus()
+		}
+	}
+	if disk.debugLogging {
+		logging.DebugPrint(disk.logID, "disk6061 Reset\n")
+	}
+	disk.disk6061Mu.Unlock()
+}
+
+// disk6061StateT holds the registers of the controller and its drives for a snapshot
+type disk6061StateT struct {
+	Command         int8
+	Drive           uint8
+	MapEnabled      bool
+	MemAddr         dg.WordT
+	Ema             uint8
+	Surface         uint8
+	Sector          uint8
+	SectCnt         int8
+	RwStatus        dg.WordT
+	InstructionMode int
+	LastDOAwasSeek  bool
+	WriteDisabled   [disk6061Drives]bool
+	Cylinder        [disk6061Drives]dg.WordT
+	DriveStatus     [disk6061Drives]dg.WordT
+}
+
+// disk6061State returns the controller's registers
+func (disk *disk6061T) disk6061State() (st disk6061StateT) {
+	disk.disk6061Mu.Lock()
+	defer disk.disk6061Mu.Unlock()
+	st = disk6061StateT{Command: disk.command, Drive: disk.drive, MapEnabled: disk.mapEnabled, MemAddr: disk.memAddr,
+		Ema: disk.ema, Surface: disk.surface, Sector: disk.sector, SectCnt: disk.sectCnt, RwStatus: disk.rwStatus,
+		InstructionMode: disk.instructionMode, LastDOAwasSeek: disk.lastDOAwasSeek}
+	for d := range disk.drives {
+		st.WriteDisabled[d] = disk.drives[d].writeDisabled
+		st.Cylinder[d] = disk.drives[d].cylinder
+		st.DriveStatus[d] = disk.drives[d].driveStatus
+	}
+	return st
+}
+
+// disk6061Restore sets the controller's registers, the images must already be attached
+func (disk *disk6061T) disk6061Restore(st disk6061StateT) {
+	disk.disk6061Mu.Lock()
+	defer disk.disk6061Mu.Unlock()
+	disk.command, disk.drive, disk.mapEnabled, disk.memAddr = st.Command, st.Drive, st.MapEnabled, st.MemAddr
+	disk.ema, disk.surface, disk.sector, disk.sectCnt = st.Ema, st.Surface, st.Sector, st.SectCnt
+	disk.rwStatus, disk.instructionMode, disk.lastDOAwasSeek = st.RwStatus, st.InstructionMode, st.LastDOAwasSeek
+	for d := range disk.drives {
+		disk.drives[d].writeDisabled = st.WriteDisabled[d]
+		disk.drives[d].cylinder = st.Cylinder[d]
+		disk.drives[d].driveStatus = st.DriveStatus[d]
+	}
+}
+
+func extractdisk6061Command(word dg.WordT) int8 {
+	return int8((word & 0x0780) >> 7)
+}
+
+func extractdisk6061DriveNo(word dg.WordT) uint8 {
+	return uint8((word & 0x60) >> 5)
+}
+
+func extractdisk6061EMA(word dg.WordT) uint8 {
+	return uint8(word & 0x1f)
+}
+
+func extractSector(word dg.WordT) uint8 {
+	return uint8((word & 0x03e0) >> 5)
+}
+
+func extractSectCnt(word dg.WordT) int8 {
+	tmpWd := word & 0x01f
+	if tmpWd != 0 { // sign-extend
+		tmpWd |= 0xe0
+	}
+	return int8(tmpWd)
+}
+
+func extractsurface(word dg.WordT) uint8 {
+	return uint8((word & 0x7c00) >> 10)
+}
@@ -0,0 +1,922 @@
+// disk6239.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Here we are emulating the disk6239 device, specifically model 6239/6240
+// controller/drive combination with 14-inch platters which provide 592MB of formatted capacity.
+//
+// All communication with the drive is via CPU PIO instructions and memory
+// accessed via the BMC interface running at 2.2MB/sec in mapped or physical mode.
+// There is also a small set of flags and pulses shared between the controller and the CPU.
+//
+// ASYNCHRONOUS interrupts occur on completion of a CB (list), or when an error
+// occurs during CB processing.
+//
+// SYNCHRONOUS interrupts occur after a PIO command executes.
+//
+// The controller is derived from dgemug's single-unit disk6239 emulation.  Up to four units may be attached,
+// each with its own image and Unit Information Block; a CB addresses its unit in the CB's unit number word.
+// N.B. dgemug's emulation did not say where the unit is given for the GET/SET UNIT INFO PIO commands, we take it
+// from bits 4-5 of the command word (DOC), which the command itself does not use.
+//
+// N.B. Assembler mnemonic: DSKP, AOS/VS mnemonic: DPJ
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/logging"
+	"github.com/SMerrony/dgemug/memory"
+)
+
+const (
+	// Physical disk characteristics, the geometry of each unit is given when its image is attached
+	disk6239WordsPerSector = 256
+	disk6239BytesPerSector = disk6239WordsPerSector * 2
+	disk6239UcodeRev       = 99
+
+	// disk6239Units is the number of units a controller can address
+	disk6239Units = 4
+
+	disk6239MaxQueuedCBs = 30 // See p.2-13
+
+	disk6239IntInfBlkSize   = 8
+	disk6239CtrlrInfBlkSize = 2
+	disk6239UnitInfBlkSize  = 7
+	disk6239CbMaxSize       = 21
+	disk6239CbMinSize       = 10 //12 // Was 10
+
+	disk6239AsynchStatRetryInterval = time.Millisecond
+
+	statXecStateResetting = 0x00
+	statXecStateResetDone = 0x01
+	statXecStateBegun     = 0x08
+	statXecStateMapped    = 0x0c
+	statXecStateDiagMode  = 0x04
+
+	statCcsAsync        = 0
+	statCcsPioInvCmd    = 1
+	statCcsPioCmdFailed = 2
+	statCcsPioCmdOk     = 3
+
+	statAsyncNoErrors = 5
+
+	// disk6239 PIO Command Set
+	disk6239PioProgLoad        = 000
+	disk6239PioBegin           = 002
+	disk6239PioSysgen          = 025
+	disk6239DiagMode           = 024
+	disk6239SetMapping         = 026
+	disk6239GetMapping         = 027
+	disk6239SetInterface       = 030
+	disk6239GetInterface       = 031
+	disk6239SetController      = 032
+	disk6239GetController      = 033
+	disk6239SetUnit            = 034
+	disk6239GetUnit            = 035
+	disk6239GetExtendedStatus0 = 040
+	disk6239GetExtendedStatus1 = 041
+	disk6239GetExtendedStatus2 = 042
+	disk6239GetExtendedStatus3 = 043
+	disk6239StartList          = 0100
+	disk6239StartListHp        = 0103
+	disk6239Restart            = 0116
+	disk6239CancelList         = 0123
+	disk6239UnitStatus         = 0131
+	disk6239Trespass           = 0132
+	disk6239GetListStatus      = 0133
+	disk6239PioReset           = 0777
+
+	// disk6239 CB Command Set/OpCodes
+	disk6239CbOpNoOp             = 0
+	disk6239CbOpWrite            = 0100
+	disk6239CbOpWriteVerify      = 0101
+	disk6239CbOpWrite1Word       = 0104
+	disk6239CbOpWriteVerify1Word = 0105
+	disk6239CbOpWriteModBitmap   = 0142
+	disk6239CbOpRead             = 0200
+	disk6239CbOpReadVerify       = 0201
+	disk6239CbOpReadVerify1Word  = 0205
+	disk6239CbOpReadRawData      = 0210
+	disk6239CbOpReadHeaders      = 0220
+	disk6239CbOpReadModBitmap    = 0242
+	disk6239CbOpRecalibrateDisk  = 0400
+
+	// disk6239 CB FIELDS
+	disk6239CbLinkAddrHigh       = 0
+	disk6239CbLinkAddrLow        = 1
+	disk6239CbInaFlagsOpcode     = 2
+	disk6239CbPagenoListAddrHigh = 3
+	disk6239CbPagenoListAddrLow  = 4
+	disk6239CbTxferAddrHigh      = 5
+	disk6239CbTxferAddrLow       = 6
+	disk6239CbDevAddrHigh        = 7
+	disk6239CbDevAddrLow         = 8
+	disk6239CbUnitNo             = 9
+	disk6239CbTxferCount         = 10
+	disk6239CbCbStatus           = 11
+	disk6239CbRes1               = 12
+	disk6239CbRes2               = 13
+	disk6239CbErrStatus          = 14
+	disk6239CbUnitStatus         = 15
+	disk6239CbRetriesDone        = 16
+	disk6239CbSoftRtnTxferCount  = 17
+	disk6239CbPhysCyl            = 18
+	disk6239CbPhysHeadSect       = 19
+	disk6239CbDiskErrCode        = 20
+
+	// CB status, error and unit status values
+	disk6239CbStatDone     = 1
+	disk6239CbStatError    = 1 << 1 // N.B. assumed, dgemug's emulation never reported a failed CB
+	disk6239CbErrNotReady  = 1      // the unit has no image, or the host image could not be read or written
+	disk6239CbErrBadAddr   = 2      // the transfer runs off the end of the unit
+	disk6239CbErrWriteProt = 3      // N.B. assumed, a write to a write-protected unit
+	disk6239UnitStatReady  = 1 << 13
+	// disk6239UnitStatWriteProt is N.B. assumed, as is bit 4 of the UNIT STATUS PIO response for write-protect
+	disk6239UnitStatWriteProt = 1 << 11
+
+	// Mapping bits
+	disk6239MapSlotLoadInts = 1 << 15
+	disk6239MapIntBmcPhys   = 1 << 14
+	disk6239MapUpstreamLoad = 1 << 13
+	disk6239MapUpstreamHpt  = 1 << 12
+)
+
+// disk6239UnitT is a unit on a 6239 controller
+type disk6239UnitT struct {
+	image        diskImage // nil if no image is attached
+	readOnly     bool      // the image was attached read-only, so the unit is write-protected
+	geom         diskGeometryT
+	unitInfBlock [disk6239UnitInfBlkSize]dg.WordT
+}
+
+// geometry returns the unit's geometry, a unit with no image reports the native drive's
+func (unit *disk6239UnitT) geometry() diskGeometryT {
+	if unit.image == nil {
+		return nativeDiskModel("DSKP")
+	}
+	return unit.geom
+}
+
+// logicalBlocks returns the number of sectors available to the guest, the controller keeps some as spares
+func (unit *disk6239UnitT) logicalBlocks() int64 {
+	geom := unit.geometry()
+	return int64(geom.cylinders-dskpSpareCylinders) * int64(geom.heads) * int64(geom.sectors-dskpSpareSectors)
+}
+
+// disk6239T holds the current state of a Type 6239 Disk controller
+type disk6239T struct {
+	// MV/Em internals...
+	disk6239Mu    sync.Mutex
+	bus           *devices.BusT
+	devNum        int
+	units         [disk6239Units]disk6239UnitT
+	reads, writes uint64
+	logID         int
+	debugLogging  bool
+	cbChan        chan dg.PhysAddrT
+	activeCB      [disk6239CbMaxSize]dg.WordT
+	sectBuff      []byte
+	// DG data...
+	commandRegA, commandRegB, commandRegC dg.WordT
+	statusRegA, statusRegB, statusRegC    dg.WordT
+	isMapped                              bool
+	mappingRegA, mappingRegB              dg.WordT
+	intInfBlock                           [disk6239IntInfBlkSize]dg.WordT
+	ctrlInfBlock                          [disk6239CtrlrInfBlkSize]dg.WordT
+	unitNo                                int
+	sectorNo                              dg.DwordT
+}
+
+const disk6239StatsPeriodMs = 500 // Will send status update this often
+
+// disk6239StatT holds the near real-time status for this device
+type disk6239StatT struct {
+	attached      int // the number of units with images attached
+	unitNo        int
+	sectorNo      dg.DwordT
+	reads, writes uint64
+}
+
+// disk6239Init is called once by the main routine to initialise this disk6239 emulator
+func (disk *disk6239T) disk6239Init(dev int, bus *devices.BusT, statsChann chan disk6239StatT, logID int, logging bool) {
+	disk.disk6239Mu.Lock()
+	disk.devNum = dev
+	disk.bus = bus
+	disk.sectBuff = make([]byte, disk6239BytesPerSector)
+
+	go disk.disk6239StatSender(statsChann)
+
+	bus.SetResetFunc(disk.devNum, disk.disk6239Reset)
+	bus.SetDataInFunc(disk.devNum, disk.disk6239DataIn)
+	bus.SetDataOutFunc(disk.devNum, disk.disk6239DataOut)
+
+	disk.logID = logID
+	disk.debugLogging = logging
+	for u := range disk.units {
+		disk.units[u] = disk6239UnitT{}
+	}
+	disk.cbChan = make(chan dg.PhysAddrT, disk6239MaxQueuedCBs)
+	disk.disk6239Mu.Unlock()
+
+	go disk.disk6239CBprocessor()
+
+	disk.disk6239Reset()
+}
+
+// disk6239Attach gives a unit an image, the controller closes the image when it is detached.
+// A read-only unit is write-protected, which is shown in its unit status.
+func (disk *disk6239T) disk6239Attach(unit int, image diskImage, imgName string, readOnly bool, geom diskGeometryT) error {
+	disk.disk6239Mu.Lock()
+	defer disk.disk6239Mu.Unlock()
+	if disk.units[unit].image != nil {
+		return fmt.Errorf("unit %d. already has an image attached", unit)
+	}
+	disk.units[unit].image = image
+	disk.units[unit].readOnly = readOnly
+	disk.units[unit].geom = geom
+	disk.disk6239ResetUnitInfBlock(unit)
+	logging.DebugPrint(disk.logID, "disk6239Attach attached unit #%d to image <%s>\n", unit, imgName)
+	disk.bus.SetAttached(disk.devNum, imgName)
+	return nil
+}
+
+// disk6239Detach closes a unit's image, the caller must ensure the controller is not busy
+func (disk *disk6239T) disk6239Detach(unit int) error {
+	disk.disk6239Mu.Lock()
+	defer disk.disk6239Mu.Unlock()
+	image := disk.units[unit].image
+	if image == nil {
+		return fmt.Errorf("no image is attached to unit %d.", unit)
+	}
+	disk.units[unit].image = nil
+	disk.units[unit].readOnly = false
+	disk.disk6239ResetUnitInfBlock(unit)
+	if disk.attachedUnits() == 0 {
+		disk.bus.SetDetached(disk.devNum)
+	}
+	return image.close()
+}
+
+// attachedUnits returns the number of units with images - MUST BE LOCKED BY CALLER
+func (disk *disk6239T) attachedUnits() (n int) {
+	for u := range disk.units {
+		if disk.units[u].image != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// disk6239StatSender provides a near real-time view of the disk6239 status and should be run as a Goroutine
+func (disk *disk6239T) disk6239StatSender(sChan chan disk6239StatT) {
+	var stats disk6239StatT
+	logging.DebugPrint(logging.DebugLog, "disk6239StatSender() started\n")
+	for {
+		disk.disk6239Mu.Lock()
+		stats.attached = disk.attachedUnits()
+		stats.unitNo = disk.unitNo
+		stats.sectorNo = disk.sectorNo
+		stats.reads = disk.reads
+		stats.writes = disk.writes
+		disk.disk6239Mu.Unlock()
+		// Non-blocking send of stats
+		select {
+		case sChan <- stats:
+		default:
+		}
+		time.Sleep(time.Millisecond * disk6239StatsPeriodMs)
+	}
+}
+
+// disk6239LoadDKBT fakes a system ROM routine to boot from a unit on this controller.
+func (disk *disk6239T) disk6239LoadDKBT(unit int) {
+	logging.DebugPrint(disk.logID, "disk6239LoadDKBT() called for unit #%d\n", unit)
+	disk.disk6239Reset()
+	disk.disk6239Mu.Lock()
+	disk.disk6239ProgLoad(unit)
+	disk.disk6239Mu.Unlock()
+	logging.DebugPrint(disk.logID, "disk6239LoadDKBT() completed\n")
+}
+
+// Handle the DIA/B/C PIO commands
+func (disk *disk6239T) disk6239DataIn(abc byte, flag byte) (datum dg.WordT) {
+	disk.disk6239Mu.Lock()
+	switch abc {
+	case 'A':
+		datum = disk.statusRegA
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "DIA [Read Status A] returning %s\n", memory.WordToBinStr(disk.statusRegA))
+		}
+	case 'B':
+		datum = disk.statusRegB
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "DIB [Read Status B] returning %s\n", memory.WordToBinStr(disk.statusRegB))
+		}
+	case 'C':
+		datum = disk.statusRegC
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "DIC [Read Status C] returning %s\n", memory.WordToBinStr(disk.statusRegC))
+		}
+	}
+	disk.disk6239Mu.Unlock()
+	disk.disk6239HandleFlag(flag)
+	return datum
+}
+
+// Handle the DOA/B/C PIO commands
+func (disk *disk6239T) disk6239DataOut(datum dg.WordT, abc byte, flag byte) {
+	if disk.debugLogging {
+		logging.DebugPrint(disk.logID, "DO%c\n", abc)
+	}
+	disk.disk6239Mu.Lock()
+	switch abc {
+	case 'A':
+		disk.commandRegA = datum
+	case 'B':
+		disk.commandRegB = datum
+	case 'C':
+		disk.commandRegC = datum
+	}
+	disk.disk6239Mu.Unlock()
+	disk.disk6239HandleFlag(flag)
+}
+
+// disk6239ProgLoad reads the first sector of a unit into memory at location 0 - MUST BE LOCKED BY CALLER
+func (disk *disk6239T) disk6239ProgLoad(unit int) {
+	if disk.debugLogging {
+		logging.DebugPrint(disk.logID, "PROGRAM LOAD initiated for unit #%d\n", unit)
+	}
+	image := disk.units[unit].image
+	if image == nil {
+		logging.DebugPrint(logging.DebugLog, "WARNING: disk6239 PROGRAM LOAD from unit #%d which has no image\n", unit)
+		return
+	}
+	if err := image.readSector(0, disk.sectBuff); err != nil {
+		logging.DebugPrint(logging.DebugLog, "ERROR: disk6239 could not read image of unit #%d: %s\n", unit, err.Error())
+		return
+	}
+	addr := dg.PhysAddrT(0)
+	for w := 0; w < disk6239WordsPerSector; w++ {
+		tmpWd := dg.WordT(disk.sectBuff[w*2]) | (dg.WordT(disk.sectBuff[(w*2)+1]) << 8)
+		memory.WriteWordBmcChan(&addr, tmpWd)
+	}
+	if disk.debugLogging {
+		logging.DebugPrint(disk.logID, "PROGRAM LOAD completed\n")
+	}
+}
+
+// disk6239PioUnit returns the unit a GET/SET UNIT INFO command refers to - MUST BE LOCKED BY CALLER
+func (disk *disk6239T) disk6239PioUnit() int {
+	return int(disk.commandRegC>>10) & (disk6239Units - 1)
+}
+
+func (disk *disk6239T) disk6239DoPioCommand() {
+
+	var addr, w dg.PhysAddrT
+
+	disk.disk6239Mu.Lock()
+
+	pioCmd := disk.disk6239ExtractPioCommand(disk.commandRegC)
+	switch pioCmd {
+	case disk6239PioProgLoad:
+		disk.disk6239ProgLoad(int(disk.commandRegA) & (disk6239Units - 1))
+
+	case disk6239PioBegin:
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... BEGIN command, unit # %d\n", disk.commandRegA)
+		}
+		// pretend we have succesfully booted ourself
+		disk.statusRegB = 0
+		disk.disk6239SetPioStatusRegC(statXecStateBegun, statCcsPioCmdOk, disk6239PioBegin, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239GetMapping:
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... GET MAPPING command\n")
+		}
+		disk.statusRegA = disk.mappingRegA
+		disk.statusRegB = disk.mappingRegB
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... ... Status Reg A set to %s\n", memory.WordToBinStr(disk.statusRegA))
+			logging.DebugPrint(disk.logID, "... ... Status Reg B set to %s\n", memory.WordToBinStr(disk.statusRegB))
+		}
+		disk.disk6239SetPioStatusRegC(0, statCcsPioCmdOk, disk6239GetMapping, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239SetMapping:
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... SET MAPPING command\n")
+		}
+		disk.mappingRegA = disk.commandRegA
+		disk.mappingRegB = disk.commandRegB
+		disk.isMapped = true
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... ... Mapping Reg A set to %s\n", memory.WordToBinStr(disk.commandRegA))
+			logging.DebugPrint(disk.logID, "... ... Mapping Reg B set to %s\n", memory.WordToBinStr(disk.commandRegB))
+		}
+		disk.disk6239SetPioStatusRegC(statXecStateMapped, statCcsPioCmdOk, disk6239SetMapping, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239GetInterface:
+		addr = dg.PhysAddrT(memory.DwordFromTwoWords(disk.commandRegA, disk.commandRegB))
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... GET INTERFACE INFO command\n")
+			logging.DebugPrint(disk.logID, "... ... Destination Start Address: %d\n", addr)
+		}
+		for w = 0; w < disk6239IntInfBlkSize; w++ {
+			memory.WriteWordBmcChan(&addr, disk.intInfBlock[w])
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... ... Word %d: %s\n", w, memory.WordToBinStr(disk.intInfBlock[w]))
+			}
+		}
+		disk.disk6239SetPioStatusRegC(0, statCcsPioCmdOk, disk6239GetInterface, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239SetInterface:
+		addr = dg.PhysAddrT(memory.DwordFromTwoWords(disk.commandRegA, disk.commandRegB))
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... SET INTERFACE INFO command\n")
+			logging.DebugPrint(disk.logID, "... ... Origin Start Address: %d\n", addr)
+		}
+		// only a few fields can be changed...
+		addr += 5
+		disk.intInfBlock[5] = memory.ReadWordBmcChan(&addr) & 0xff00 // word 5
+		disk.intInfBlock[6] = memory.ReadWordBmcChan(&addr)          // word 6
+		disk.intInfBlock[7] = memory.ReadWordBmcChan(&addr)          // word 7
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... ... Word 5: %s\n", memory.WordToBinStr(disk.intInfBlock[5]))
+			logging.DebugPrint(disk.logID, "... ... Word 6: %s\n", memory.WordToBinStr(disk.intInfBlock[6]))
+			logging.DebugPrint(disk.logID, "... ... Word 7: %s\n", memory.WordToBinStr(disk.intInfBlock[7]))
+		}
+		disk.disk6239SetPioStatusRegC(0, statCcsPioCmdOk, disk6239SetInterface, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239GetUnit:
+		addr = dg.PhysAddrT(memory.DwordFromTwoWords(disk.commandRegA, disk.commandRegB))
+		unit := disk.disk6239PioUnit()
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... GET UNIT INFO command for unit #%d\n", unit)
+			logging.DebugPrint(disk.logID, "... ... Destination Start Address: %d\n", addr)
+		}
+		for w = 0; w < disk6239UnitInfBlkSize; w++ {
+			memory.WriteWordBmcChan(&addr, disk.units[unit].unitInfBlock[w])
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... ... Word %d: %s\n", w, memory.WordToBinStr(disk.units[unit].unitInfBlock[w]))
+			}
+		}
+		disk.disk6239SetPioStatusRegC(0, statCcsPioCmdOk, disk6239GetUnit, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239SetUnit:
+		addr = dg.PhysAddrT(memory.DwordFromTwoWords(disk.commandRegA, disk.commandRegB))
+		unit := disk.disk6239PioUnit()
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... SET UNIT INFO command for unit #%d\n", unit)
+			logging.DebugPrint(disk.logID, "... ... Origin Start Address: %d\n", addr)
+		}
+		// only the first word is writable according to p.2-16
+		// TODO check no active CBs first
+		disk.units[unit].unitInfBlock[0] = memory.ReadWord(addr)
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... ... Overwrote word 0 of UIB with: %s\n", memory.WordToBinStr(disk.units[unit].unitInfBlock[0]))
+		}
+		disk.disk6239SetPioStatusRegC(0, statCcsPioCmdOk, disk6239SetUnit, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239PioReset:
+		// disk6239Reset() has to do its own locking...
+		disk.disk6239Mu.Unlock()
+		disk.disk6239Reset()
+		disk.disk6239Mu.Lock()
+
+	case disk6239SetController:
+		addr = dg.PhysAddrT(memory.DwordFromTwoWords(disk.commandRegA, disk.commandRegB))
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... SET CONTROLLER INFO command\n")
+			logging.DebugPrint(disk.logID, "... ... Origin Start Address: %d\n", addr)
+		}
+		disk.ctrlInfBlock[0] = memory.ReadWord(addr)
+		disk.ctrlInfBlock[1] = memory.ReadWord(addr + 1)
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... ... Word 0: %s\n", memory.WordToBinStr(disk.ctrlInfBlock[0]))
+			logging.DebugPrint(disk.logID, "... ... Word 1: %s\n", memory.WordToBinStr(disk.ctrlInfBlock[1]))
+		}
+		disk.disk6239SetPioStatusRegC(0, statCcsPioCmdOk, disk6239SetController, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239StartList:
+		addr = dg.PhysAddrT(memory.DwordFromTwoWords(disk.commandRegA, disk.commandRegB))
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... START LIST command\n")
+			logging.DebugPrint(disk.logID, "... ..... First CB Address: %d\n", addr)
+			logging.DebugPrint(disk.logID, "... ..... CB Channel Q length: %d\n", len(disk.cbChan))
+		}
+		// TODO should check addr validity before starting processing
+		disk.cbChan <- addr
+		disk.statusRegA = memory.DwordGetUpperWord(dg.DwordT(addr)) // return address of 1st CB processed
+		disk.statusRegB = memory.DwordGetLowerWord(dg.DwordT(addr))
+		disk.disk6239SetPioStatusRegC(0, statCcsPioCmdOk, disk6239StartList, memory.TestWbit(disk.commandRegC, 15))
+
+	case disk6239UnitStatus:
+		unit := int(disk.commandRegA) & (disk6239Units - 1)
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... GET UNIT STATUS command\n")
+			logging.DebugPrint(disk.logID, "... ... Unit: %d\n", unit)
+		}
+		disk.statusRegB = 0
+		if disk.units[unit].image != nil {
+			memory.SetWbit(&disk.statusRegB, 2) // Ready
+			if disk.units[unit].readOnly {
+				memory.SetWbit(&disk.statusRegB, 4) // Write-protected
+			}
+		}
+		// TODO may need to handle bit 3 'Busy' in the future
+		disk.disk6239SetPioStatusRegC(0, statCcsPioCmdOk, disk6239UnitStatus, memory.TestWbit(disk.commandRegC, 15))
+
+	default:
+		// not emulated, the guest is told the command is invalid rather than the emulator stopping
+		logging.DebugPrint(logging.DebugLog, "WARNING: disk6239 PIO command %#o is not implemented\n", pioCmd)
+		disk.disk6239SetPioStatusRegC(0, statCcsPioInvCmd, dg.WordT(pioCmd), memory.TestWbit(disk.commandRegC, 15))
+	}
+	disk.disk6239Mu.Unlock()
+}
+
+func (disk *disk6239T) disk6239ExtractPioCommand(word dg.WordT) uint {
+	res := uint((word & 01776) >> 1) // mask penultimate 9 bits
+	return res
+}
+
+func (disk *disk6239T) disk6239GetCBextendedStatusSize() int {
+	word := disk.intInfBlock[5]
+	word >>= 8
+	word &= 0x0f
+	return int(word)
+}
+
+// Handle flag/pulse to disk6239
+func (disk *disk6239T) disk6239HandleFlag(f byte) {
+	switch f {
+	case 'S':
+		disk.bus.SetBusy(disk.devNum, true)
+		disk.bus.SetDone(disk.devNum, false)
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... S flag set\n")
+		}
+		disk.disk6239DoPioCommand()
+
+		disk.bus.SetBusy(disk.devNum, false)
+		// set the DONE flag if the return bit was set
+		disk.disk6239Mu.Lock()
+		if memory.TestWbit(disk.commandRegC, 15) {
+			disk.bus.SetDone(disk.devNum, true)
+		}
+		disk.disk6239Mu.Unlock()
+
+	case 'C':
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... C flag set, clearing DONE flag\n")
+		}
+		disk.bus.SetDone(disk.devNum, false)
+		// TODO clear pending interrupt
+		disk.disk6239Mu.Lock()
+		disk.disk6239SetPioStatusRegC(statXecStateMapped,
+			statCcsPioCmdOk,
+			dg.WordT(disk.disk6239ExtractPioCommand(disk.commandRegC)),
+			memory.TestWbit(disk.commandRegC, 15))
+		disk.disk6239Mu.Unlock()
+
+	case 'P':
+		// reserved on this controller
+		logging.DebugPrint(logging.DebugLog, "WARNING: disk6239 received 'P' flag, which is not implemented\n")
+
+	default:
+		// no/empty flag - nothing to do
+	}
+}
+
+// CB processing in a goroutine
+func (disk *disk6239T) disk6239CBprocessor() {
+	var (
+		w, cbLength int
+		nextCB      dg.PhysAddrT
+	)
+	for {
+		cbAddr := <-disk.cbChan
+		disk.disk6239Mu.Lock()
+		cbLength = disk6239CbMinSize + disk.disk6239GetCBextendedStatusSize()
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... Processing CB, extended status size is: %d\n", disk.disk6239GetCBextendedStatusSize())
+		}
+		// copy CB contents from host memory
+		addr := cbAddr
+		for w = 0; w < cbLength; w++ {
+			disk.activeCB[w] = memory.ReadWordBmcChan(&addr)
+		}
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... CB: ")
+			for cbwd := 0; cbwd < cbLength; cbwd++ {
+				logging.DebugPrint(disk.logID, "%d: %d, ", cbwd, disk.activeCB[cbwd])
+			}
+		}
+
+		opCode := disk.activeCB[disk6239CbInaFlagsOpcode] & 0x03ff
+		nextCB = dg.PhysAddrT(memory.DwordFromTwoWords(disk.activeCB[disk6239CbLinkAddrHigh], disk.activeCB[disk6239CbLinkAddrLow]))
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... CB OpCode: %d\n", opCode)
+			logging.DebugPrint(disk.logID, "... .. Next CB Addr: %d\n", nextCB)
+		}
+		errStatus := disk.disk6239DoCB(opCode)
+		if cbLength > disk6239CbErrStatus {
+			disk.activeCB[disk6239CbErrStatus] = errStatus
+		}
+		if cbLength > disk6239CbUnitStatus {
+			disk.activeCB[disk6239CbUnitStatus] = 0
+			if errStatus != disk6239CbErrNotReady {
+				disk.activeCB[disk6239CbUnitStatus] = disk6239UnitStatReady
+			}
+			if disk.unitNo < disk6239Units && disk.units[disk.unitNo].readOnly {
+				disk.activeCB[disk6239CbUnitStatus] |= disk6239UnitStatWriteProt
+			}
+		}
+		if cbLength > disk6239CbCbStatus {
+			disk.activeCB[disk6239CbCbStatus] = disk6239CbStatDone // finally, set Done bit
+			if errStatus != 0 {
+				disk.activeCB[disk6239CbCbStatus] |= disk6239CbStatError
+			}
+		}
+
+		// write back CB
+		addr = cbAddr
+		for w = 0; w < cbLength; w++ {
+			memory.WriteWordBmcChan(&addr, disk.activeCB[w])
+		}
+		disk.disk6239Mu.Unlock()
+
+		if nextCB == 0 {
+			// send ASYNCH status. See p.4-15
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "...ready to set ASYNC status\n")
+			}
+			for disk.bus.GetBusy(disk.devNum) || disk.bus.GetDone(disk.devNum) {
+				time.Sleep(disk6239AsynchStatRetryInterval)
+			}
+			disk.disk6239Mu.Lock()
+			disk.statusRegC = dg.WordT(statXecStateMapped) << 12
+			disk.statusRegC |= (statAsyncNoErrors & 0x03ff)
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "disk6239 ASYNCHRONOUS status C set to: %s\n",
+					memory.WordToBinStr(disk.statusRegC))
+			}
+			disk.disk6239Mu.Unlock()
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "...set ASYNC status\n")
+			}
+			disk.bus.SetDone(disk.devNum, true)
+		} else {
+			// chain to next CB
+			disk.cbChan <- nextCB
+		}
+	}
+}
+
+// disk6239DoCB carries out the operation in the active CB, returning the CB error status - MUST BE LOCKED BY CALLER
+func (disk *disk6239T) disk6239DoCB(opCode dg.WordT) (errStatus dg.WordT) {
+	disk.unitNo = int(disk.activeCB[disk6239CbUnitNo])
+	if opCode == disk6239CbOpNoOp {
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... .. NO OP\n")
+		}
+		return 0
+	}
+	if disk.unitNo >= disk6239Units || disk.units[disk.unitNo].image == nil {
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... .. CB for unit #%d which has no image\n", disk.unitNo)
+		}
+		return disk6239CbErrNotReady
+	}
+	unit := &disk.units[disk.unitNo]
+
+	switch opCode {
+	case disk6239CbOpRecalibrateDisk:
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... .. RECALIBRATE\n")
+		}
+		disk.sectorNo = 0
+
+	case disk6239CbOpRead, disk6239CbOpWrite:
+		if opCode == disk6239CbOpWrite && unit.readOnly {
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... .. WRITE refused, unit #%d is write-protected\n", disk.unitNo)
+			}
+			return disk6239CbErrWriteProt
+		}
+		startSect := memory.DwordFromTwoWords(disk.activeCB[disk6239CbDevAddrHigh], disk.activeCB[disk6239CbDevAddrLow])
+		if memory.TestWbit(disk.activeCB[disk6239CbPagenoListAddrHigh], 0) {
+			// logical premapped host address
+			logging.DebugPrint(logging.DebugLog, "WARNING: disk6239 CB transfer to/from premapped logical addresses is not implemented\n")
+			return disk6239CbErrBadAddr
+		}
+		physAddr := dg.PhysAddrT(memory.DwordFromTwoWords(disk.activeCB[disk6239CbTxferAddrHigh], disk.activeCB[disk6239CbTxferAddrLow]))
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... .. CB %s command, SECCNT: %d\n", disk6239OpName(opCode), disk.activeCB[disk6239CbTxferCount])
+			logging.DebugPrint(disk.logID, "... .. .. .... sector:          %d\n", startSect)
+			logging.DebugPrint(disk.logID, "... .. .. .... phys addr:       %d\n", physAddr)
+		}
+		if int64(startSect)+int64(disk.activeCB[disk6239CbTxferCount]) > unit.logicalBlocks() {
+			if disk.debugLogging {
+				logging.DebugPrint(disk.logID, "... .. transfer runs off the end of unit #%d\n", disk.unitNo)
+			}
+			return disk6239CbErrBadAddr
+		}
+		for sect := dg.DwordT(0); sect < dg.DwordT(disk.activeCB[disk6239CbTxferCount]); sect++ {
+			disk.sectorNo = startSect + sect
+			memAddr := physAddr + (dg.PhysAddrT(sect) * disk6239WordsPerSector)
+			if opCode == disk6239CbOpRead {
+				if err := unit.image.readSector(int64(disk.sectorNo), disk.sectBuff); err != nil {
+					return disk.disk6239IOError("read", err)
+				}
+				for w := 0; w < disk6239WordsPerSector; w++ {
+					tmpWd := dg.WordT(disk.sectBuff[w*2]) | (dg.WordT(disk.sectBuff[(w*2)+1]) << 8)
+					memory.WriteWordBmcChan(&memAddr, tmpWd)
+				}
+				disk.reads++
+			} else {
+				for w := 0; w < disk6239WordsPerSector; w++ {
+					tmpWd := memory.ReadWordBmcChan(&memAddr)
+					disk.sectBuff[(w*2)+1] = byte(tmpWd >> 8)
+					disk.sectBuff[w*2] = byte(tmpWd & 0x00ff)
+				}
+				if err := unit.image.writeSector(int64(disk.sectorNo), disk.sectBuff); err != nil {
+					return disk.disk6239IOError("write", err)
+				}
+				disk.writes++
+			}
+		}
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "... .. .... %s command finished\n", disk6239OpName(opCode))
+		}
+
+	default:
+		logging.DebugPrint(logging.DebugLog, "WARNING: disk6239 CB command %#o is not implemented\n", opCode)
+		return disk6239CbErrBadAddr
+	}
+	return 0
+}
+
+func disk6239OpName(opCode dg.WordT) string {
+	if opCode == disk6239CbOpRead {
+		return "READ"
+	}
+	return "WRITE"
+}
+
+// disk6239IOError logs a failure of the host image, which is reported to the guest as the unit not being ready
+// MUST BE LOCKED BY CALLER
+func (disk *disk6239T) disk6239IOError(op string, err error) dg.WordT {
+	logging.DebugPrint(logging.DebugLog, "ERROR: disk6239 could not %s image of unit #%d: %s\n", op, disk.unitNo, err.Error())
+	return disk6239CbErrNotReady
+}
+
+func (disk *disk6239T) disk6239Reset() {
+	disk.disk6239Mu.Lock()
+	disk.disk6239ResetMapping()
+	disk.disk6239ResetIntInfBlk()
+	disk.disk6239ResetCtrlrInfBlock()
+	for u := range disk.units {
+		disk.disk6239ResetUnitInfBlock(u)
+	}
+	disk.statusRegB = 0
+	disk.statusRegC = 0
+	disk.disk6239SetPioStatusRegC(statXecStateResetDone, 0, disk6239PioReset, memory.TestWbit(disk.commandRegC, 15))
+	disk.disk6239Mu.Unlock()
+	if disk.debugLogging {
+		logging.DebugPrint(disk.logID, "disk6239 ***Reset*** via call to disk6239Reset()\n")
+	}
+}
+
+// disk6239StateT holds the registers of the controller and its units for a snapshot
+type disk6239StateT struct {
+	CommandRegA, CommandRegB, CommandRegC dg.WordT
+	StatusRegA, StatusRegB, StatusRegC    dg.WordT
+	IsMapped                              bool
+	MappingRegA, MappingRegB              dg.WordT
+	IntInfBlock                           [disk6239IntInfBlkSize]dg.WordT
+	CtrlInfBlock                          [disk6239CtrlrInfBlkSize]dg.WordT
+	UnitNo                                int
+	SectorNo                              dg.DwordT
+	UnitInfBlocks                         [disk6239Units][disk6239UnitInfBlkSize]dg.WordT
+}
+
+// disk6239State returns the controller's registers, it fails if any control blocks are waiting to be processed
+func (disk *disk6239T) disk6239State() (st disk6239StateT, err error) {
+	disk.disk6239Mu.Lock()
+	defer disk.disk6239Mu.Unlock()
+	if len(disk.cbChan) > 0 {
+		return st, fmt.Errorf("control blocks are queued")
+	}
+	st = disk6239StateT{CommandRegA: disk.commandRegA, CommandRegB: disk.commandRegB, CommandRegC: disk.commandRegC,
+		StatusRegA: disk.statusRegA, StatusRegB: disk.statusRegB, StatusRegC: disk.statusRegC, IsMapped: disk.isMapped,
+		MappingRegA: disk.mappingRegA, MappingRegB: disk.mappingRegB, IntInfBlock: disk.intInfBlock,
+		CtrlInfBlock: disk.ctrlInfBlock, UnitNo: disk.unitNo, SectorNo: disk.sectorNo}
+	for u := range disk.units {
+		st.UnitInfBlocks[u] = disk.units[u].unitInfBlock
+	}
+	return st, nil
+}
+
+// disk6239Restore sets the controller's registers, the images must already be attached
+func (disk *disk6239T) disk6239Restore(st disk6239StateT) {
+	disk.disk6239Mu.Lock()
+	defer disk.disk6239Mu.Unlock()
+	disk.commandRegA, disk.commandRegB, disk.commandRegC = st.CommandRegA, st.CommandRegB, st.CommandRegC
+	disk.statusRegA, disk.statusRegB, disk.statusRegC = st.StatusRegA, st.StatusRegB, st.StatusRegC
+	disk.isMapped, disk.mappingRegA, disk.mappingRegB = st.IsMapped, st.MappingRegA, st.MappingRegB
+	disk.intInfBlock, disk.ctrlInfBlock = st.IntInfBlock, st.CtrlInfBlock
+	disk.unitNo, disk.sectorNo = st.UnitNo, st.SectorNo
+	for u := range disk.units {
+		disk.units[u].unitInfBlock = st.UnitInfBlocks[u]
+	}
+}
+
+// N.B. We assume disk6239Mu is LOCKED before calling ANY of the following functions
+
+// setup the controller information block to power-up defaults p.2-15
+func (disk *disk6239T) disk6239ResetCtrlrInfBlock() {
+	disk.ctrlInfBlock[0] = 0
+	disk.ctrlInfBlock[1] = 0
+}
+
+// setup the interface information block to power-up defaults
+func (disk *disk6239T) disk6239ResetIntInfBlk() {
+	disk.intInfBlock[0] = 0101
+	disk.intInfBlock[1] = disk6239UcodeRev
+	disk.intInfBlock[2] = 3
+	disk.intInfBlock[3] = 8<<11 | disk6239MaxQueuedCBs
+	disk.intInfBlock[4] = 0
+	disk.intInfBlock[5] = 11 << 8
+	disk.intInfBlock[6] = 0
+	disk.intInfBlock[7] = 0
+}
+
+// set mapping options after IORST, power-up or Reset
+func (disk *disk6239T) disk6239ResetMapping() {
+	disk.mappingRegA = 0x4000 // DMA over the BMC
+	disk.mappingRegB = disk6239MapIntBmcPhys | disk6239MapUpstreamLoad | disk6239MapUpstreamHpt
+	disk.isMapped = false
+}
+
+// setup the unit information block to power-up defaults pp.2-16
+func (disk *disk6239T) disk6239ResetUnitInfBlock(unit int) {
+	uib := &disk.units[unit].unitInfBlock
+	geom := disk.units[unit].geometry()
+	blocks := disk.units[unit].logicalBlocks() // 1157952. for a 6239
+	uib[0] = 0
+	uib[1] = 9<<12 | disk6239UcodeRev
+	uib[2] = dg.WordT(blocks >> 16)
+	uib[3] = dg.WordT(blocks & 0x0ffff)
+	uib[4] = disk6239BytesPerSector
+	uib[5] = dg.WordT(geom.cylinders - dskpSpareCylinders)
+	uib[6] = dg.WordT(geom.heads<<8) | dg.WordT(0x00ff&geom.sectors)
+}
+
+// this is used to set the SYNCHRONOUS standard return as per p.3-22
+func (disk *disk6239T) disk6239SetPioStatusRegC(stat byte, ccs byte, cmdEcho dg.WordT, rr bool) {
+	if stat == 0 && disk.isMapped {
+		stat = statXecStateMapped
+	}
+	if rr || cmdEcho == disk6239PioReset {
+		disk.statusRegC = dg.WordT(stat) << 12
+		disk.statusRegC |= (dg.WordT(ccs) & 3) << 10
+		disk.statusRegC |= (cmdEcho & 0x01ff) << 1
+		if rr {
+			disk.statusRegC |= 1
+		}
+		if disk.debugLogging {
+			logging.DebugPrint(disk.logID, "disk6239 PIO (SYNCH) status C set to: %s\n",
+				memory.WordToBinStr(disk.statusRegC))
+		}
+	}
+}
+
+// disk6239SetLogging sets the internal debugging/logging flag according to the passed value
+// N.B. The disk will run slower when this is set.
+func (disk *disk6239T) disk6239SetLogging(debug bool) {
+	disk.disk6239Mu.Lock()
+	disk.debugLogging = debug
+	disk.disk6239Mu.Unlock()
+}
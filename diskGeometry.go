@@ -0,0 +1,246 @@
+// diskGeometry.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// diskGeometryT describes a DG disk drive model
+type diskGeometryT struct {
+	model     string
+	devType   string // the controller type the drive is attached to
+	cylinders int
+	heads     int
+	sectors   int  // per track
+	native    bool // the drive the controller was designed for
+}
+
+// diskModels is the table of known drive types.
+// N.B. The DSKP controller keeps the last 3 cylinders and 1 sector of each track as spares, so the guest sees a little less
+// than the drive's capacity.
+var diskModels = []diskGeometryT{
+	{model: "6060", devType: "DPF", cylinders: 815, heads: 5, sectors: 24},
+	{model: "6061", devType: "DPF", cylinders: 815, heads: 19, sectors: 24, native: true},
+	{model: "6067", devType: "DPF", cylinders: 815, heads: 10, sectors: 24},
+	{model: "6122", devType: "DPF", cylinders: 1024, heads: 8, sectors: 32},
+	{model: "6236", devType: "DSKP", cylinders: 1224, heads: 15, sectors: 35},
+	{model: "6237", devType: "DSKP", cylinders: 1632, heads: 15, sectors: 53},
+	{model: "6239", devType: "DSKP", cylinders: 981, heads: 16, sectors: 75, native: true},
+}
+
+// Limits of the geometries the controllers can address
+const (
+	dpfMaxCylinders  = 1024 // 10-bit cylinder address
+	dpfMaxHeads      = 32   // 5-bit surface address
+	dpfMaxSectors    = 32   // 5-bit sector address
+	dskpMaxCylinders = 0xffff + dskpSpareCylinders
+	dskpMaxHeads     = 0xff
+	dskpMaxSectors   = 0xff
+
+	// dskpSpareCylinders and dskpSpareSectors are not made available to the guest by the DSKP controller
+	dskpSpareCylinders = 3
+	dskpSpareSectors   = 1
+)
+
+// lookupDiskModel finds a drive model which may be attached to the given type of controller
+func lookupDiskModel(devType, model string) (geom diskGeometryT, err error) {
+	for _, geom = range diskModels {
+		if geom.model == model {
+			if geom.devType != devType {
+				return geom, fmt.Errorf("a %s drive cannot be attached to a %s controller", model, devType)
+			}
+			return geom, nil
+		}
+	}
+	return geom, fmt.Errorf("unknown disk type <%s>", model)
+}
+
+// nativeDiskModel returns the drive the controller was designed for
+func nativeDiskModel(devType string) diskGeometryT {
+	for _, geom := range diskModels {
+		if geom.devType == devType && geom.native {
+			return geom
+		}
+	}
+	return diskGeometryT{}
+}
+
+// sizeBytes returns the formatted capacity of the drive
+func (geom diskGeometryT) sizeBytes() int64 {
+	return int64(geom.cylinders) * int64(geom.heads) * int64(geom.sectors) * diskSectorBytes
+}
+
+// String describes the geometry, eg. for SHOW DEV
+func (geom diskGeometryT) String() string {
+	name := geom.model
+	if name == "" {
+		name = "custom"
+	}
+	return fmt.Sprintf("%s, %d./%d./%d.", name, geom.cylinders, geom.heads, geom.sectors)
+}
+
+// checkDiskGeometry returns an error if the controller cannot address the geometry
+func checkDiskGeometry(devType string, geom diskGeometryT) error {
+	maxC, maxH, maxS, minC, minS := dpfMaxCylinders, dpfMaxHeads, dpfMaxSectors, 1, 1
+	if devType == "DSKP" {
+		maxC, maxH, maxS, minC, minS = dskpMaxCylinders, dskpMaxHeads, dskpMaxSectors, dskpSpareCylinders+1, dskpSpareSectors+1
+	}
+	if geom.cylinders < minC || geom.cylinders > maxC || geom.heads < 1 || geom.heads > maxH || geom.sectors < minS || geom.sectors > maxS {
+		return fmt.Errorf("a %s controller can address %d.-%d. cylinders, 1-%d. heads and %d.-%d. sectors per track",
+			devType, minC, maxC, maxH, minS, maxS)
+	}
+	return nil
+}
+
+// printableDiskModels lists the known drive types for SHOW DISKTYPES
+func printableDiskModels() string {
+	res := "Type  Ctrlr  Cyls  Heads  Sects   Capacity\012"
+	for _, geom := range diskModels {
+		res += fmt.Sprintf("%-5s %-5s  %4d.   %3d.   %3d.  %5dMB", geom.model, geom.devType,
+			geom.cylinders, geom.heads, geom.sectors, geom.sizeBytes()/(1024*1024))
+		if geom.native {
+			res += "  (native)"
+		}
+		res += "\012"
+	}
+	return res
+}
+
+// parseDiskGeometry interprets the geometry options of ATT and CREATE:
+//
+//	TYPE <model> | GEOMETRY <cyls> <heads> <sectors>
+//
+// and returns the number of options used, which is 0 if there is no geometry option
+func parseDiskGeometry(devType string, opts []string) (geom diskGeometryT, used int, err error) {
+	if len(opts) == 0 {
+		return geom, 0, nil
+	}
+	switch opts[0] {
+	case "TYPE":
+		if len(opts) < 2 {
+			return geom, 0, fmt.Errorf("TYPE requires a drive model")
+		}
+		geom, err = lookupDiskModel(devType, opts[1])
+		return geom, 2, err
+	case "GEOMETRY":
+		if len(opts) < 4 {
+			return geom, 0, fmt.Errorf("GEOMETRY requires <cylinders> <heads> <sectors>")
+		}
+		var chs [3]int
+		for ix := range chs {
+			chs[ix], err = strconv.Atoi(strings.TrimSuffix(opts[ix+1], "."))
+			if err != nil || chs[ix] <= 0 {
+				return geom, 0, fmt.Errorf("invalid GEOMETRY value <%s>", opts[ix+1])
+			}
+		}
+		geom = diskGeometryT{devType: devType, cylinders: chs[0], heads: chs[1], sectors: chs[2]}
+		return geom, 4, checkDiskGeometry(devType, geom)
+	}
+	return geom, 0, nil
+}
+
+// parseDiskSize interprets the options following CREATE <dev> <file>:
+//
+//	TYPE <model> | GEOMETRY <cyls> <heads> <sectors> | SIZE <n>MB
+//
+// by default the image is for the controller's native drive.  SIZE uses the native drive's heads and sectors per track
+// with enough cylinders to give at least the requested capacity.
+func parseDiskSize(devType string, opts []string) (geom diskGeometryT, err error) {
+	if len(opts) == 0 {
+		return nativeDiskModel(devType), nil
+	}
+	if opts[0] == "SIZE" {
+		if len(opts) != 2 || !strings.HasSuffix(opts[1], "MB") {
+			return geom, fmt.Errorf("SIZE requires a capacity in megabytes, eg. SIZE 300MB")
+		}
+		mb, err := strconv.Atoi(strings.TrimSuffix(opts[1], "MB"))
+		if err != nil || mb <= 0 {
+			return geom, fmt.Errorf("invalid SIZE <%s>", opts[1])
+		}
+		geom = geometryForSize(devType, int64(mb)*1024*1024)
+		return geom, checkDiskGeometry(devType, geom)
+	}
+	geom, used, err := parseDiskGeometry(devType, opts)
+	if err == nil && (used == 0 || used != len(opts)) {
+		err = fmt.Errorf("expecting TYPE, GEOMETRY or SIZE, not <%s>", strings.Join(opts, " "))
+	}
+	return geom, err
+}
+
+// geometryForSize returns the native drive's heads and sectors with enough cylinders to hold the given size
+func geometryForSize(devType string, size int64) diskGeometryT {
+	geom := nativeDiskModel(devType)
+	cylBytes := int64(geom.heads) * int64(geom.sectors) * diskSectorBytes
+	return diskGeometryT{devType: devType, cylinders: int((size + cylBytes - 1) / cylBytes), heads: geom.heads, sectors: geom.sectors}
+}
+
+// imageGeometry chooses the geometry of an image being attached when no TYPE or GEOMETRY is given: the drive model
+// whose capacity the image matches, else the native drive or, for a larger image, the native drive's heads and sectors
+// with enough cylinders to hold it
+func imageGeometry(devType string, size int64) (diskGeometryT, error) {
+	for _, geom := range diskModels {
+		if geom.devType == devType && geom.sizeBytes() == size {
+			return geom, nil
+		}
+	}
+	native := nativeDiskModel(devType)
+	if size <= native.sizeBytes() {
+		return native, nil
+	}
+	geom := geometryForSize(devType, size)
+	return geom, checkDiskGeometry(devType, geom)
+}
+
+// createDiskImage creates a new empty image of the given size, an existing file is never overwritten.
+// A blank image is all zeroes, so the file is simply extended to the size; it is sparse on hosts which support that,
+// appearing at once and taking no space until it is written to.
+func createDiskImage(fileName string, size int64) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fileName)
+	}
+	return err
+}
+
+// diskTypeBySize returns the drive models which an image of the given size matches
+func diskTypeBySize(size int64) string {
+	for _, geom := range diskModels {
+		if geom.sizeBytes() == size {
+			return fmt.Sprintf("%s disk image (model %s)", geom.devType, geom.model)
+		}
+	}
+	if size%diskSectorBytes == 0 {
+		return "disk image of unknown model (custom size)"
+	}
+	return "unknown - not a whole number of sectors"
+}
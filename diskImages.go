@@ -0,0 +1,372 @@
+// diskImages.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// diskSectorBytes is the sector size of all the emulated disk types
+	diskSectorBytes = 512
+	// overlayMagic identifies a copy-on-write overlay file
+	overlayMagic = "MVEMOVL1"
+	// sparseBlockBytes is the granularity at which holes are left in copies of images
+	sparseBlockBytes = 64 * 1024
+)
+
+// diskMountT records how a disk image is attached to a unit.
+//
+// A plain image is attached directly and the guest's writes go straight to it, unless it is ATTached RO when the
+// image is opened read-only and the unit is write-protected.
+//
+// A disk with copy-on-write overlays reads each sector from the highest overlay holding it, or else from the base
+// image, and the guest's writes go straight to the top overlay one sector at a time; so the base image and lower
+// overlays are never changed by the guest, and nothing is lost if the emulator dies.
+//
+// A compressed image is always decompressed into a working copy.  If it was ATTached with WRITEBACK, the working copy
+// is compressed back over the image on DETach, but only if the guest has written to it; otherwise any changes are lost.
+type diskMountT struct {
+	du         devUnitT
+	baseFile   string         // the image named in the ATT command
+	workFile   string         // the file the unit reads, a decompressed copy if the image is compressed
+	overlays   []string       // overlay files, lowest first, the last receives any changes
+	compressed bool           // the base image is compressed
+	writeBack  bool           // changes to a compressed image are written back to it on DETach
+	readOnly   bool           // the unit is write-protected
+	plain      *fileImageT    // the unit's image if it has no overlays
+	overlaid   *overlayImageT // the unit's image if it has overlays
+	geom       diskGeometryT  // the geometry presented to the guest
+}
+
+// diskMounts holds the currently attached disk images, keyed by device/unit name
+var diskMounts = map[string]*diskMountT{}
+
+// attachDisk attaches a disk image to a DPF or DSKP unit.
+// If any overlays are given, changes are kept in the last of them; a read-only unit is write-protected.
+// Changes to a compressed image are only kept if writeBack is set.
+// If no geometry is given, it is chosen to suit the size of the image.
+func attachDisk(du devUnitT, imageName string, overlays []string, readOnly, writeBack bool, geom diskGeometryT) bool {
+	if _, attached := diskMounts[du.String()]; attached {
+		cmdError(" *** Unit already has an image ATTached, DETach it first ***")
+		return false
+	}
+	compressed := isCompressed(imageName)
+	if writeBack && !compressed {
+		cmdError(" *** WRITEBACK is only for compressed images ***")
+		return false
+	}
+	var err error
+	mount := diskMountT{du: du, baseFile: imageName, workFile: imageName, overlays: overlays,
+		compressed: compressed, writeBack: writeBack, readOnly: readOnly}
+	if compressed {
+		if mount.workFile, err = copyToWorkFile(imageName); err != nil {
+			log.Printf("ERROR: Could not make working copy of %s: %s\n", imageName, err.Error())
+			return false
+		}
+	}
+	fi, err := os.Stat(mount.workFile)
+	if err == nil {
+		if geom.cylinders == 0 {
+			geom, err = imageGeometry(du.devType, fi.Size())
+		} else if fi.Size() > geom.sizeBytes() {
+			tto.PutNLString(fmt.Sprintf(" *** Warning: image is %d. bytes, only the first %d. are used ***", fi.Size(), geom.sizeBytes()))
+		}
+	}
+	if err != nil {
+		cmdError(" *** Could not ATTach " + imageName + " - " + err.Error() + " ***")
+		mount.discardWorkFile()
+		return false
+	}
+	mount.geom = geom
+	var image diskImage
+	if len(overlays) > 0 {
+		if mount.overlaid, err = openOverlayImage(mount.workFile, overlays); err == nil {
+			image = mount.overlaid
+		}
+	} else {
+		if mount.plain, err = openFileImage(mount.workFile, readOnly); err == nil {
+			image = mount.plain
+		}
+	}
+	if err != nil {
+		cmdError(" *** Could not open " + imageName + " - " + err.Error() + " ***")
+		mount.discardWorkFile()
+		return false
+	}
+	if !controllerAttach(du, image, imageName, readOnly, geom) {
+		image.close()
+		mount.discardWorkFile()
+		return false
+	}
+	diskMounts[du.String()] = &mount
+	return true
+}
+
+// diskImage is the storage behind an emulated disk unit, the controllers transfer whole sectors through it
+type diskImage interface {
+	readSector(sect int64, buf []byte) error
+	writeSector(sect int64, buf []byte) error
+	close() error
+}
+
+// fileImageT is a disk image held in a single host file
+type fileImageT struct {
+	f       *os.File
+	changed bool // the guest has written to the image
+}
+
+// openFileImage opens an image file, a read-only image is opened read-only on the host too
+func openFileImage(fileName string, readOnly bool) (*fileImageT, error) {
+	mode := os.O_RDWR
+	if readOnly {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(fileName, mode, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &fileImageT{f: f}, nil
+}
+
+// readSector reads a sector, a sector beyond the end of the file reads as zeroes
+func (img *fileImageT) readSector(sect int64, buf []byte) error {
+	n, err := img.f.ReadAt(buf, sect*diskSectorBytes)
+	if err == io.EOF {
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		err = nil
+	}
+	return err
+}
+
+func (img *fileImageT) writeSector(sect int64, buf []byte) error {
+	img.changed = true
+	_, err := img.f.WriteAt(buf, sect*diskSectorBytes)
+	return err
+}
+
+func (img *fileImageT) close() error {
+	return img.f.Close()
+}
+
+func controllerAttach(du devUnitT, image diskImage, imageName string, readOnly bool, geom diskGeometryT) bool {
+	var err error
+	switch du.devType {
+	case "DPF":
+		err = dpfControllers[du.devNum].disk6061Attach(du.unit, image, imageName, readOnly, geom)
+	case "DSKP":
+		err = dskpControllers[du.devNum].disk6239Attach(du.unit, image, imageName, readOnly, geom)
+	}
+	if err != nil {
+		cmdError(" *** " + err.Error() + " ***")
+		return false
+	}
+	return true
+}
+
+func controllerDetach(du devUnitT) bool {
+	var err error
+	switch du.devType {
+	case "DPF":
+		err = dpfControllers[du.devNum].disk6061Detach(du.unit)
+	case "DSKP":
+		err = dskpControllers[du.devNum].disk6239Detach(du.unit)
+	}
+	if err != nil {
+		log.Printf("ERROR: Could not close image of %s: %s\n", du.String(), err.Error())
+		return false
+	}
+	return true
+}
+
+// detachDisk flushes and closes a disk image, refusing if the controller is busy
+func detachDisk(du devUnitT) bool {
+	mount, attached := diskMounts[du.String()]
+	if !attached {
+		cmdError(" *** No image is ATTached to that unit ***")
+		return false
+	}
+	if bus.GetBusy(du.devNum) {
+		cmdError(" *** Controller is busy - transfer in progress, try again ***")
+		return false
+	}
+	if !controllerDetach(du) {
+		return false
+	}
+	delete(diskMounts, du.String())
+	return mount.release()
+}
+
+// release writes back the working copy of a changed compressed image if required, and removes it
+func (mount *diskMountT) release() bool {
+	if mount.compressed && mount.plain != nil && mount.plain.changed {
+		if !mount.writeBack {
+			tto.PutNLString(" *** Changes to " + mount.baseFile + " discarded, ATTach it with WRITEBACK to keep them ***")
+		} else {
+			tto.PutNLString("Compressing " + mount.baseFile + ", please wait...")
+			if err := compressImage(mount.workFile, mount.baseFile); err != nil {
+				log.Printf("ERROR: Could not write back %s, changes kept in %s: %s\n", mount.baseFile, mount.workFile, err.Error())
+				return false
+			}
+		}
+	}
+	mount.discardWorkFile()
+	return true
+}
+
+// detachAllDisks is called when the emulator exits so that working copies are not left behind
+func detachAllDisks() {
+	for _, mount := range diskMounts {
+		detachDisk(mount.du)
+	}
+}
+
+// releaseAllDisks writes back and removes all working copies, without waiting for the controllers.
+// It is used when the emulator must stop abruptly.
+func releaseAllDisks() {
+	for name, mount := range diskMounts {
+		mount.release()
+		delete(diskMounts, name)
+	}
+}
+
+// discardWorkFile removes the private working copy of a compressed image
+func (mount *diskMountT) discardWorkFile() {
+	if mount.workFile != mount.baseFile {
+		os.Remove(mount.workFile)
+	}
+}
+
+// diskMountStatus lists the attached disk images and their geometries for SHOW DEV
+func diskMountStatus() (res string) {
+	names := make([]string, 0, len(diskMounts))
+	for name := range diskMounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		res += fmt.Sprintf("%-7s %s (%s)\012", name, diskMounts[name].baseFile, diskMounts[name].geom.String())
+	}
+	return res
+}
+
+// commitOverlay merges the changes held in a unit's top overlay into the layer beneath it, ie. the next
+// lower overlay or, if there is none, the base image itself
+func commitOverlay(du devUnitT) error {
+	mount, err := overlayMount(du)
+	if err != nil {
+		return err
+	}
+	if len(mount.overlays) == 1 && mount.compressed {
+		return fmt.Errorf("cannot COMMIT into compressed image %s", mount.baseFile)
+	}
+	return mount.overlaid.commit(mount.baseFile)
+}
+
+// discardOverlay throws away the changes held in a unit's top overlay
+func discardOverlay(du devUnitT) error {
+	mount, err := overlayMount(du)
+	if err != nil {
+		return err
+	}
+	return mount.overlaid.discard()
+}
+
+// overlayMount returns the mount for a unit if it is safe to change its overlays
+func overlayMount(du devUnitT) (*diskMountT, error) {
+	mount, attached := diskMounts[du.String()]
+	if !attached || len(mount.overlays) == 0 {
+		return nil, fmt.Errorf("no OVERLAY is ATTached to %s", du.String())
+	}
+	if bus.GetBusy(du.devNum) {
+		return nil, fmt.Errorf("controller is busy - transfer in progress")
+	}
+	return mount, nil
+}
+
+// copyToWorkFile copies an image to a new temporary file, decompressing it if necessary, and returns its name
+func copyToWorkFile(imageName string) (workName string, err error) {
+	src, err := openImage(imageName)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile("", "mvemg-"+filepath.Base(imageName)+"-")
+	if err != nil {
+		return "", err
+	}
+	if _, err = copySparse(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// copySparse copies src to dst leaving holes in place of all-zero blocks, so that copies of mostly-empty
+// images take little space or time
+func copySparse(dst *os.File, src io.Reader) (written int64, err error) {
+	buf := make([]byte, sparseBlockBytes)
+	for {
+		n, rerr := io.ReadFull(src, buf)
+		if n > 0 {
+			if isZeroes(buf[:n]) {
+				_, err = dst.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = dst.Write(buf[:n])
+			}
+			if err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			// a trailing hole must be made part of the file
+			return written, dst.Truncate(written)
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// isZeroes returns true if the buffer contains only zero bytes
+func isZeroes(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
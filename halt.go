@@ -0,0 +1,203 @@
+// halt.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/memory"
+)
+
+// haltReasonT classifies why the CPU stopped running
+type haltReasonT int32
+
+const (
+	haltNone haltReasonT = iota // the CPU has not been run
+	haltBreakpoint
+	haltInstruction // a HALT instruction was executed
+	haltUnimplemented
+	haltConsoleEscape
+	haltInstrLimit
+	haltWatchdog
+)
+
+var haltReasonNames = map[haltReasonT]string{
+	haltNone:          "NONE",
+	haltBreakpoint:    "BREAKPOINT",
+	haltInstruction:   "HALT",
+	haltUnimplemented: "UNIMPLEMENTED",
+	haltConsoleEscape: "ESCAPE",
+	haltInstrLimit:    "LIMIT",
+	haltWatchdog:      "WATCHDOG",
+}
+
+func (r haltReasonT) String() string {
+	return haltReasonNames[r]
+}
+
+// Exit codes in -batch mode
+const (
+	exitOK            = 0 // the script completed and the CPU was never run
+	exitFatal         = 1 // the emulator could not start
+	exitCommandFailed = 2 // a command failed with ON ERROR ABORT, or the -boot failed
+	// otherwise 3 + the reason the CPU last halted
+	exitHaltBase = 3
+)
+
+// haltOpcode is HALT, ie. DOC 0,CPU
+const haltOpcode = 063077
+
+var (
+	// lastHalt is the classified reason the CPU last stopped running
+	lastHalt haltReasonT
+	// requestedHalt is set when we stop the CPU ourselves, ie. on a console ESCape or by the haltMonitor
+	requestedHalt int32
+	// batchFailed is set if a command failed in -batch mode
+	batchFailed bool
+	// batchOutput is the console connection in -batch mode, batchCopied is closed once all its output is on stdout
+	batchOutput net.Conn
+	batchCopied chan struct{}
+)
+
+// requestHalt stops the running CPU, recording why.  The first reason given during a run is kept.
+func requestHalt(reason haltReasonT) {
+	atomic.CompareAndSwapInt32(&requestedHalt, int32(haltNone), int32(reason))
+	cpu.SetSCPIO(true)
+}
+
+// runCPU runs the CPU until it stops, returning why it stopped along with the CPU's own message and
+// instruction counts.
+//
+// The CPU only reports a message, so the reason is established from our own state: a halt we requested,
+// a PC at one of our breakpoints, or a HALT at the PC (an instruction which cannot be executed does not
+// advance the PC), otherwise the CPU met an instruction it could not execute.
+// mvcpu's Run gives a fixed-size array of counts indexed by mnemonic, it is returned as a slice.
+func runCPU(disassembly bool) (reason haltReasonT, errDetail string, instrCounts []int) {
+	atomic.StoreInt32(&requestedHalt, int32(haltNone))
+	if *deterministicFlag {
+		errDetail, instrCounts = runDeterministic(disassembly)
+	} else {
+		var counts [750]int
+		errDetail, counts = cpu.Run(disassembly, deviceMap, breakpoints, inputRadix, &tto)
+		instrCounts = counts[:]
+	}
+	pc := cpu.GetPC()
+	reason = classifyHalt(haltReasonT(atomic.LoadInt32(&requestedHalt)), isBreakpoint(pc), memory.ReadWord(pc) == haltOpcode)
+	return reason, errDetail, instrCounts
+}
+
+// classifyHalt decides why the CPU stopped, a halt we requested takes precedence
+func classifyHalt(requested haltReasonT, atBreakpoint, atHaltInstr bool) haltReasonT {
+	switch {
+	case requested != haltNone:
+		return requested
+	case atBreakpoint:
+		return haltBreakpoint
+	case atHaltInstr:
+		return haltInstruction
+	}
+	return haltUnimplemented
+}
+
+// isBreakpoint returns true if a breakpoint is set at the address
+func isBreakpoint(addr dg.PhysAddrT) bool {
+	for _, bp := range breakpoints {
+		if bp == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// haltMonitor stops the CPU if it exceeds the -maxinstr or -watchdog limits, until stop is closed.
+// The instruction count is checked every millisecond, so a few more instructions than the limit may be executed;
+// in deterministic mode runDeterministic applies the instruction limit exactly instead.
+func haltMonitor(stop <-chan struct{}, startInstrs uint64) {
+	checkInstrs := *maxInstrFlag > 0 && !*deterministicFlag
+	if !checkInstrs && *watchdogFlag == 0 {
+		return
+	}
+	startTime := time.Now()
+	poll := time.NewTicker(time.Millisecond)
+	defer poll.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-poll.C:
+			reason := haltNone
+			switch {
+			case checkInstrs && cpu.GetInstrCount()-startInstrs >= *maxInstrFlag:
+				reason = haltInstrLimit
+			case *watchdogFlag > 0 && time.Since(startTime) >= *watchdogFlag:
+				reason = haltWatchdog
+			}
+			if reason != haltNone {
+				requestHalt(reason)
+				return
+			}
+		}
+	}
+}
+
+// recordHalt records why the CPU stopped, for scripts (IF HALT and $HALT) and the log
+func recordHalt(reason haltReasonT, errDetail string) {
+	lastHaltReason = errDetail
+	lastHalt = reason
+	scriptVars["HALT"] = lastHalt.String()
+}
+
+// batchConsole returns a console connection whose output is copied to stdout, there is no input
+func batchConsole() net.Conn {
+	emu, host := net.Pipe()
+	batchOutput = emu
+	batchCopied = make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, host)
+		close(batchCopied)
+	}()
+	return emu
+}
+
+// flushBatchConsole closes the -batch console and waits until everything written to it has reached stdout
+func flushBatchConsole() {
+	if batchOutput != nil {
+		batchOutput.Close()
+		<-batchCopied
+	}
+}
+
+// batchExitCode returns the exit status of a -batch run
+func batchExitCode() int {
+	switch {
+	case batchFailed:
+		return exitCommandFailed
+	case lastHalt == haltNone:
+		return exitOK
+	}
+	return exitHaltBase + int(lastHalt) - 1
+}
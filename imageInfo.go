@@ -0,0 +1,143 @@
+// imageInfo.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// dibSector is where DFMTR writes the Disk Information Block (DIB), whose presence shows a disk has been formatted;
+	// the sectors before it are reserved for the bootstrap
+	dibSector = 3
+	// headSectors is the number of sectors at the start of an image examined to decide what it is
+	headSectors = 16
+)
+
+// imageCommand implements the IMAGE command
+func imageCommand(cmd []string) {
+	if len(cmd) != 3 || cmd[1] != "INFO" {
+		cmdError(" *** Expecting IMAGE INFO <file> ***")
+		return
+	}
+	info, err := imageInfo(cmd[2])
+	if err != nil {
+		cmdError(" *** Could not examine image - " + err.Error() + " ***")
+		return
+	}
+	tto.PutString(info)
+}
+
+// imageInfo describes an image file: its apparent type, size, space allocated on the host and, for disks,
+// whether it appears to have been formatted
+func imageInfo(fileName string) (string, error) {
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return "", err
+	}
+	size := fi.Size()
+	res := fmt.Sprintf("File:      %s\012", fileName)
+	compressed := isCompressed(fileName)
+	if compressed {
+		method := "gzip"
+		if compressionExt(fileName) == zstdExt {
+			method = "zstd"
+		}
+		res += fmt.Sprintf("Compressed: %s, %d. bytes\012", method, size)
+		if size, err = uncompressedSize(fileName); err != nil {
+			return "", err
+		}
+	}
+	res += fmt.Sprintf("Size:      %d. bytes (%d. sectors)\012", size, size/diskSectorBytes)
+	if alloc, ok := allocatedBytes(fi); ok && !compressed {
+		res += fmt.Sprintf("Allocated: %d. bytes", alloc)
+		if alloc < size {
+			res += " (sparse)"
+		}
+		res += "\012"
+	}
+	f, err := openImage(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, headSectors*diskSectorBytes)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte(overlayMagic)):
+		res += "Type:      MV/Em disk overlay\012"
+	case looksLikeSimhTape(head):
+		res += "Type:      SimH tape image\012"
+	default:
+		res += "Type:      " + diskTypeBySize(size) + "\012"
+		if hasDIB(head) {
+			res += fmt.Sprintf("Formatted: yes - there is a Disk Information Block in sector %d.\012", dibSector)
+		} else {
+			res += fmt.Sprintf("Formatted: no - there is no Disk Information Block in sector %d.\012", dibSector)
+		}
+	}
+	return res, nil
+}
+
+// hasDIB returns true if the start of a disk image holds a Disk Information Block, ie. the disk has been through DFMTR
+func hasDIB(head []byte) bool {
+	if len(head) < (dibSector+1)*diskSectorBytes {
+		return false
+	}
+	return !isZeroes(head[dibSector*diskSectorBytes : (dibSector+1)*diskSectorBytes])
+}
+
+// looksLikeSimhTape returns true if the data begins with a plausible SimH tape record or tape mark,
+// i.e. a little-endian record length repeated after the (even-padded) record
+func looksLikeSimhTape(head []byte) bool {
+	if len(head) < 4 {
+		return false
+	}
+	recLen := binary.LittleEndian.Uint32(head)
+	if recLen == 0 {
+		return !isZeroes(head) // a tape mark followed by something
+	}
+	padded := int(recLen + recLen&1)
+	if recLen > 65536 || 4+padded+4 > len(head) {
+		return false
+	}
+	return binary.LittleEndian.Uint32(head[4+padded:]) == recLen
+}
+
+// uncompressedSize returns the size of a compressed image once decompressed
+func uncompressedSize(fileName string) (int64, error) {
+	f, err := openImage(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(ioutil.Discard, f)
+}
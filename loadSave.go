@@ -0,0 +1,378 @@
+// loadSave.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/memory"
+)
+
+// Memory image formats understood by LOAD and SAVE
+const (
+	// fmtASCII is one 'address,contents' pair of octal numbers per line
+	fmtASCII = "ASCII"
+	// fmtRAW is a simple image of consecutive big-endian words
+	fmtRAW = "RAW"
+	// fmtABS is DG absolute binary, as punched on paper tape by the Nova/Eclipse tools
+	fmtABS = "ABS"
+
+	// absMaxDataWords is the largest number of data words we put in one absolute binary block
+	absMaxDataWords = 16
+	// absNoStart is set in a start block address if the loader should not auto-start
+	absNoStart = 0100000
+)
+
+// absBlockT is one decoded data block of a DG absolute binary tape
+type absBlockT struct {
+	origin dg.PhysAddrT
+	data   []dg.WordT
+}
+
+// loadMemory implements the LOAD command
+func loadMemory(cmd []string) {
+	if len(cmd) < 2 {
+		cmdError(" *** LOAD command requires <file> argument ***")
+		return
+	}
+	format := fmtASCII
+	var offset dg.PhysAddrT
+	for _, arg := range cmd[2:] {
+		switch arg {
+		case fmtASCII, fmtRAW, fmtABS:
+			format = arg
+		default:
+			addr, err := strconv.ParseInt(arg, inputRadix, 32)
+			if err != nil || addr < 0 || addr >= int64(MemSizeWords) {
+				cmdError(" *** LOAD command could not parse <addr> argument ***")
+				return
+			}
+			offset = dg.PhysAddrT(addr)
+		}
+	}
+	count, start, autoStart, err := loadImage(cmd[1], format, offset)
+	if err == nil && autoStart {
+		cpu.SetPC(start)
+		tto.PutNLString(fmt.Sprintf("Start address "+fmtRadixVerb()+" loaded into PC", start))
+	}
+	if err != nil {
+		cmdError(fmt.Sprintf(" *** LOAD failed: %s ***", err.Error()))
+		return
+	}
+	tto.PutNLString(fmt.Sprintf("%d. words loaded from %s", count, cmd[1]))
+}
+
+// loadImage loads a memory image file of the given format, only ABS images may carry a start address
+func loadImage(fileName, format string, offset dg.PhysAddrT) (count int, start dg.PhysAddrT, autoStart bool, err error) {
+	switch format {
+	case fmtASCII:
+		count, err = loadASCII(fileName, offset)
+	case fmtRAW:
+		count, err = loadRaw(fileName, offset)
+	case fmtABS:
+		count, start, autoStart, err = loadAbsBinary(fileName, offset)
+	}
+	return count, start, autoStart, err
+}
+
+// saveMemory implements the SAVE command
+func saveMemory(cmd []string) {
+	if len(cmd) < 4 || len(cmd) > 5 {
+		cmdError(" *** SAVE command requires <from> <to> <file> [ASCII|RAW|ABS] arguments ***")
+		return
+	}
+	from, err := strconv.ParseInt(cmd[1], inputRadix, 32)
+	if err != nil || from < 0 || from >= int64(MemSizeWords) {
+		cmdError(" *** SAVE command could not parse <from> argument ***")
+		return
+	}
+	to, err := strconv.ParseInt(cmd[2], inputRadix, 32)
+	if err != nil || to < from || to >= int64(MemSizeWords) {
+		cmdError(" *** SAVE command could not parse <to> argument ***")
+		return
+	}
+	format := fmtASCII
+	if len(cmd) > 4 {
+		format = cmd[4]
+	}
+	words := make([]dg.WordT, 0, to-from+1)
+	for addr := dg.PhysAddrT(from); addr <= dg.PhysAddrT(to); addr++ {
+		words = append(words, memory.ReadWord(addr))
+	}
+	var data []byte
+	switch format {
+	case fmtASCII:
+		data = asciiEncode(dg.PhysAddrT(from), words)
+	case fmtRAW:
+		data = rawEncode(words)
+	case fmtABS:
+		if to > 077777 {
+			cmdError(" *** ABS format can only SAVE addresses below 100000 (octal) ***")
+			return
+		}
+		data = absEncode(dg.PhysAddrT(from), words, absNoStart)
+	default:
+		cmdError(" *** Expecting ASCII, RAW or ABS format for SAVE command ***")
+		return
+	}
+	if err = ioutil.WriteFile(cmd[3], data, 0644); err != nil {
+		cmdError(fmt.Sprintf(" *** SAVE failed: %s ***", err.Error()))
+		return
+	}
+	tto.PutNLString(fmt.Sprintf("%d. words saved to %s", len(words), cmd[3]))
+}
+
+// loadASCII loads a file of 'address,contents' octal pairs into memory, relocated by offset.
+// This is the format of the CSV diagnostics such as NOVA800LT.CSV which were loaded by earlier versions.
+func loadASCII(fileName string, offset dg.PhysAddrT) (count int, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	words, err := parseASCII(f, offset)
+	for _, w := range words {
+		memory.WriteWord(w.addr, w.val)
+	}
+	return len(words), err
+}
+
+// asciiWordT is one relocated 'address,contents' pair
+type asciiWordT struct {
+	addr dg.PhysAddrT
+	val  dg.WordT
+}
+
+// parseASCII decodes 'address,contents' pairs, returning those read before any error
+func parseASCII(r io.Reader, offset dg.PhysAddrT) (words []asciiWordT, err error) {
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+		if len(fields) != 2 {
+			return words, fmt.Errorf("line %d: expected <address>,<contents>", lineNo)
+		}
+		addr, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			return words, fmt.Errorf("line %d: invalid address <%s>", lineNo, fields[0])
+		}
+		val, err := strconv.ParseUint(fields[1], 8, 16)
+		if err != nil {
+			return words, fmt.Errorf("line %d: invalid contents <%s>", lineNo, fields[1])
+		}
+		pAddr := dg.PhysAddrT(addr) + offset
+		if int(pAddr) >= MemSizeWords {
+			return words, fmt.Errorf("line %d: address %#o is beyond end of memory", lineNo, pAddr)
+		}
+		words = append(words, asciiWordT{addr: pAddr, val: dg.WordT(val)})
+	}
+	return words, scanner.Err()
+}
+
+// loadRaw loads a file of big-endian words into consecutive memory locations from addr
+func loadRaw(fileName string, addr dg.PhysAddrT) (count int, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	if len(data)%2 != 0 {
+		return 0, fmt.Errorf("file length %d. is not a whole number of words", len(data))
+	}
+	if int(addr)+len(data)/2 > MemSizeWords {
+		return 0, fmt.Errorf("image would extend beyond end of memory")
+	}
+	for b := 0; b < len(data); b += 2 {
+		memory.WriteWord(addr, dg.WordT(binary.BigEndian.Uint16(data[b:])))
+		addr++
+		count++
+	}
+	return count, nil
+}
+
+// loadAbsBinary loads a DG absolute binary file into memory, relocated by offset.
+// The start address is returned along with an indication of whether the tape requests auto-start.
+func loadAbsBinary(fileName string, offset dg.PhysAddrT) (count int, start dg.PhysAddrT, autoStart bool, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return loadAbsData(data, offset)
+}
+
+// loadAbsData loads an absolute binary image already read from a file or paper tape
+func loadAbsData(data []byte, offset dg.PhysAddrT) (count int, start dg.PhysAddrT, autoStart bool, err error) {
+	blocks, startWord, err := absDecode(data)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	for _, blk := range blocks {
+		addr := blk.origin + offset
+		if int(addr)+len(blk.data) > MemSizeWords {
+			return count, 0, false, fmt.Errorf("block at %#o would extend beyond end of memory", blk.origin)
+		}
+		for _, w := range blk.data {
+			memory.WriteWord(addr, w)
+			addr++
+			count++
+		}
+	}
+	autoStart = startWord&absNoStart == 0
+	return count, dg.PhysAddrT(startWord&077777) + offset, autoStart, nil
+}
+
+// asciiEncode produces the 'address,contents' format read by loadASCII
+func asciiEncode(from dg.PhysAddrT, words []dg.WordT) []byte {
+	var sb strings.Builder
+	for ix, w := range words {
+		fmt.Fprintf(&sb, "%o,%06o\n", from+dg.PhysAddrT(ix), w)
+	}
+	return []byte(sb.String())
+}
+
+// rawEncode produces a simple big-endian image of the words
+func rawEncode(words []dg.WordT) []byte {
+	data := make([]byte, len(words)*2)
+	for ix, w := range words {
+		binary.BigEndian.PutUint16(data[ix*2:], uint16(w))
+	}
+	return data
+}
+
+// absPutWord appends a word in paper-tape frame order, ie. low byte first
+func absPutWord(data []byte, w dg.WordT) []byte {
+	return append(data, byte(w), byte(w>>8))
+}
+
+// absEncode produces a DG absolute binary image of the words, followed by a start block.
+//
+// Each data block is: -wordcount, origin, checksum, data...  where the checksum is chosen so that
+// all the words of the block sum to zero.  The start block has a wordcount of 1.
+func absEncode(from dg.PhysAddrT, words []dg.WordT, start dg.WordT) []byte {
+	var data []byte
+	for ix := 0; ix < len(words); ix += absMaxDataWords {
+		end := ix + absMaxDataWords
+		if end > len(words) {
+			end = len(words)
+		}
+		blk := words[ix:end]
+		wc := dg.WordT(-len(blk))
+		origin := dg.WordT(from) + dg.WordT(ix)
+		sum := wc + origin
+		for _, w := range blk {
+			sum += w
+		}
+		data = absPutWord(data, wc)
+		data = absPutWord(data, origin)
+		data = absPutWord(data, -sum)
+		for _, w := range blk {
+			data = absPutWord(data, w)
+		}
+	}
+	data = absPutWord(data, 1)
+	data = absPutWord(data, start)
+	data = absPutWord(data, -(1 + start))
+	return data
+}
+
+// absDecode parses a DG absolute binary image, checking each block's checksum.
+// Leader null frames before the first block are skipped, and anything after the start block is ignored.
+// Word counts of 0 to -16 are normal data blocks, below -16 the single data word is repeated,
+// a count of 1 is the start block, and any other positive count is an error block.
+func absDecode(data []byte) (blocks []absBlockT, start dg.WordT, err error) {
+	start = absNoStart
+	pos := 0
+	blockNo := 0
+	getWord := func() (dg.WordT, bool) {
+		if pos+2 > len(data) {
+			return 0, false
+		}
+		w := dg.WordT(data[pos]) | dg.WordT(data[pos+1])<<8
+		pos += 2
+		return w, true
+	}
+	for {
+		if blockNo == 0 {
+			// leader, there are no null frames between blocks
+			for pos < len(data) && data[pos] == 0 {
+				pos++
+			}
+		}
+		if pos >= len(data) {
+			return blocks, start, fmt.Errorf("no start block found after %d. blocks", blockNo)
+		}
+		blockNo++
+		blockPos := pos
+		wc, ok1 := getWord()
+		origin, ok2 := getWord()
+		cksum, ok3 := getWord()
+		if !ok1 || !ok2 || !ok3 {
+			return blocks, start, fmt.Errorf("block %d. at byte %d. is truncated", blockNo, blockPos)
+		}
+		sum := wc + origin + cksum
+		switch {
+		case wc == 1:
+			if sum != 0 {
+				return blocks, start, fmt.Errorf("start block %d. at byte %d. has bad checksum", blockNo, blockPos)
+			}
+			return blocks, origin, nil
+		case wc > 1 && wc < 0100000:
+			return blocks, start, fmt.Errorf("error block %d. found at byte %d.", blockNo, blockPos)
+		}
+		n := int(-int16(wc))
+		repeat := n > absMaxDataWords
+		nData := n
+		if repeat {
+			nData = 1
+		}
+		blk := absBlockT{origin: dg.PhysAddrT(origin)}
+		for i := 0; i < nData; i++ {
+			w, ok := getWord()
+			if !ok {
+				return blocks, start, fmt.Errorf("block %d. at byte %d. is truncated", blockNo, blockPos)
+			}
+			sum += w
+			blk.data = append(blk.data, w)
+		}
+		if sum != 0 {
+			return blocks, start, fmt.Errorf("block %d. at byte %d. (origin %#o) has bad checksum", blockNo, blockPos, origin)
+		}
+		if repeat {
+			for i := 1; i < n; i++ {
+				blk.data = append(blk.data, blk.data[0])
+			}
+		}
+		blocks = append(blocks, blk)
+	}
+}
@@ -0,0 +1,270 @@
+// lpt.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/logging"
+)
+
+// The line printer takes one character at a time; DOA loads the character buffer and setting Busy (ie. DOAS
+// or NIOS) prints it, completing immediately.  DOAC loads the buffer without printing anything.
+// Its output is written to a host file which is ATTached with ATT LPT <file> [PAGES] [JOBS [<secs>]]
+//
+//	PAGES - each page (ending with a form feed) is written to a separate file, <file>-pNNNN.<ext>
+//	JOBS  - output following a pause of <secs> (default lptJobIdle) or longer starts a new file, <file>-jNNNN.<ext>
+//
+// If both are given the files are named <file>-jNNNN-pNNNN.<ext>
+// Output is buffered, and written out at each form feed and when the file is closed.
+const (
+	// lptStatusNotReady is returned by DIA when there is no file attached
+	lptStatusNotReady = 1
+	// lptJobIdle is the default pause in output taken to mean that a print job has ended
+	lptJobIdle = 5 * time.Second
+)
+
+// lptT is an emulated line printer controller
+type lptT struct {
+	sync.Mutex
+	devNum     int
+	bus        *devices.BusT
+	fileName   string // the name given to ATT
+	out        *os.File
+	writer     *bufio.Writer
+	pages      bool
+	jobs       bool
+	jobIdle    time.Duration
+	jobNo      int
+	pageNo     int
+	lastOutput time.Time
+	chars      uint64 // printed since attached
+	buffer     byte   // the character loaded by the last DOA
+}
+
+var lpt lptT
+
+// lptInit puts the line printer on the bus
+func (p *lptT) lptInit(devNum int, bus *devices.BusT) {
+	p.devNum = devNum
+	p.bus = bus
+	bus.SetResetFunc(devNum, p.lptReset)
+	bus.SetDataInFunc(devNum, p.lptDataIn)
+	bus.SetDataOutFunc(devNum, p.lptDataOut)
+}
+
+func (p *lptT) lptReset() {
+	p.bus.SetBusy(p.devNum, false)
+	p.bus.SetDone(p.devNum, false)
+}
+
+// lptAttach directs printer output to a host file (or series of files)
+func (p *lptT) lptAttach(fileName string, opts []string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName != "" {
+		return fmt.Errorf("LPT already has %s ATTached, DETach it first", p.fileName)
+	}
+	p.pages, p.jobs, p.jobIdle = false, false, lptJobIdle
+	for o := 0; o < len(opts); o++ {
+		switch opts[o] {
+		case "PAGES":
+			p.pages = true
+		case "JOBS":
+			p.jobs = true
+			if o+1 < len(opts) && opts[o+1] != "PAGES" {
+				secs, err := strconv.Atoi(opts[o+1])
+				if err != nil || secs < 1 {
+					return fmt.Errorf("expecting a number of seconds after JOBS, not <%s>", opts[o+1])
+				}
+				p.jobIdle = time.Duration(secs) * time.Second
+				o++
+			}
+		default:
+			return fmt.Errorf("expecting PAGES or JOBS, not <%s>", opts[o])
+		}
+	}
+	p.fileName = fileName
+	p.jobNo, p.pageNo, p.chars = 1, 1, 0
+	if err := p.openOutput(); err != nil {
+		p.fileName = ""
+		return err
+	}
+	p.bus.SetAttached(p.devNum, fileName)
+	return nil
+}
+
+// lptDetach closes the printer's output file
+func (p *lptT) lptDetach() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName == "" {
+		return fmt.Errorf("no file is ATTached to LPT")
+	}
+	err := p.closeOutput()
+	p.fileName = ""
+	p.bus.SetDetached(p.devNum)
+	return err
+}
+
+// outputName returns the name of the current output file
+func (p *lptT) outputName() string {
+	if !p.pages && !p.jobs {
+		return p.fileName
+	}
+	ext := filepath.Ext(p.fileName)
+	name := strings.TrimSuffix(p.fileName, ext)
+	if p.jobs {
+		name += fmt.Sprintf("-j%04d", p.jobNo)
+	}
+	if p.pages {
+		name += fmt.Sprintf("-p%04d", p.pageNo)
+	}
+	return name + ext
+}
+
+// openOutput opens the current output file, the whole file is appended to unless it is per-page or per-job
+func (p *lptT) openOutput() (err error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if p.pages || p.jobs {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	p.out, err = os.OpenFile(p.outputName(), flags, 0644)
+	if err == nil {
+		p.writer = bufio.NewWriter(p.out)
+	}
+	return err
+}
+
+func (p *lptT) closeOutput() (err error) {
+	if p.out != nil {
+		err = p.writer.Flush()
+		if cerr := p.out.Close(); err == nil {
+			err = cerr
+		}
+		p.out, p.writer = nil, nil
+	}
+	return err
+}
+
+// print writes a character to the current output file, starting new files as required
+func (p *lptT) print(ch byte) {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName == "" {
+		return // not ready - output is lost
+	}
+	now := time.Now()
+	if p.jobs && p.chars > 0 && now.Sub(p.lastOutput) >= p.jobIdle {
+		p.jobNo++
+		p.pageNo = 1
+		p.closeOutput()
+	}
+	p.lastOutput = now
+	if p.out == nil {
+		if err := p.openOutput(); err != nil {
+			logging.DebugPrint(logging.DebugLog, "ERROR: LPT could not open %s: %s\n", p.outputName(), err.Error())
+			return
+		}
+	}
+	switch {
+	case ch == 0:
+		// NULs are used for timing by some software, they are not printed
+		return
+	case ch == dg.ASCIIFF && p.pages:
+		p.pageNo++
+		p.closeOutput() // the next page is opened when there is something to print on it
+	case ch == dg.ASCIIFF:
+		p.writer.WriteByte(ch)
+		p.writer.Flush()
+	default:
+		p.writer.WriteByte(ch)
+	}
+	p.chars++
+}
+
+func (p *lptT) lptDataOut(datum dg.WordT, abc byte, flag byte) {
+	switch abc {
+	case 'A':
+		p.Lock()
+		p.buffer = byte(datum & 0177)
+		p.Unlock()
+		p.lptHandleFlag(flag)
+	case 'N':
+		p.lptHandleFlag(flag)
+	default:
+		if debugLogging {
+			logging.DebugPrint(logging.DebugLog, "WARNING: Unimplemented DO%c to LPT\n", abc)
+		}
+	}
+}
+
+func (p *lptT) lptDataIn(abc byte, flag byte) (datum dg.WordT) {
+	p.lptHandleFlag(flag)
+	if abc == 'A' {
+		p.Lock()
+		if p.fileName == "" {
+			datum = lptStatusNotReady
+		}
+		p.Unlock()
+	}
+	return datum
+}
+
+func (p *lptT) lptHandleFlag(flag byte) {
+	switch flag {
+	case 'S':
+		p.bus.SetBusy(p.devNum, true)
+		p.bus.SetDone(p.devNum, false)
+		p.Lock()
+		ch := p.buffer
+		p.Unlock()
+		p.print(ch)
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, true)
+		if !p.bus.IsDevMasked(p.devNum) {
+			p.bus.SendInterrupt(p.devNum)
+		}
+	case 'C':
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, false)
+	}
+}
+
+// lptStatus describes the printer for SHOW LPT
+func (p *lptT) lptStatus() string {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName == "" {
+		return "LPT: no file ATTached"
+	}
+	return fmt.Sprintf("LPT: printing to %s, %d. characters printed", p.outputName(), p.chars)
+}
@@ -0,0 +1,354 @@
+// machineConfig.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/logging"
+)
+
+// machineConfigT describes a machine profile, it is read from the JSON file given by the -config flag.
+//
+// Device codes are given as strings so that they may be written in octal.
+// The CPU identity is that reported by the CPU emulation (LCPID/NCLID) and so cannot be configured,
+// N.B. LCPID and NCLID also always report 16MB of memory, whatever MemSizeWords is given.
+// eg.
+//
+//	{
+//	  "MemSizeWords": 4194304,
+//	  "LineFrequency": 50,
+//	  "ConsoleAddr": "localhost:10000",
+//	  "StatusAddr": "localhost:9999",
+//	  "Boot": "DPF",
+//	  "Devices": [
+//	    { "Type": "MTB", "Attach": [ { "File": "tapes/STARTER.9trk", "RO": true }, { "Unit": 1, "File": "tapes/SCRATCH.9trk" } ] },
+//	    { "Type": "DPF", "Code": "027", "Attach": [ { "File": "disks/DISK1.DPF", "RW": true } ] },
+//	    { "Type": "DPF", "Code": "047" },
+//	    { "Type": "DSKP" }
+//	  ]
+//	}
+type machineConfigT struct {
+	MemSizeWords  int // in 16-bit words, a multiple of 16384
+	LineFrequency int // Hz, for the RTC
+	ConsoleAddr   string
+	StatusAddr    string
+	Boot          string // booted and run at start-up, as for the -boot flag
+	Devices       []configDeviceT
+}
+
+// configDeviceT is a peripheral controller present in the machine.
+// The CPU, console (TTI/TTO), SCP and BMC are always present and need not be listed.
+type configDeviceT struct {
+	Type   string // MTB, DPF, DSKP, LPT, RTC, PIT, PTR, PTP or TMX
+	Code   string // device code, defaults to the standard code of the controller, eg. 067 for the second DPF
+	Attach []configAttachT
+	Lines  []string // TMX only, a host address or "pty" for each terminal line
+
+	ctrlr int // the standard code of the controller this device is, eg. devDPF1, set by resolveDevices
+	code  int // the device code it is configured at, set by resolveDevices
+}
+
+// configAttachT is an image file to be attached at start-up
+type configAttachT struct {
+	Unit int
+	File string
+	RW   bool // disks and tapes only
+	RO   bool // disks and tapes only
+}
+
+// configurableDevTypes maps the device types which may appear in a config to the standard codes of their
+// controllers, in order, eg. the second DPF configured is the DPF1 controller
+var configurableDevTypes = map[string][]int{
+	"MTB":  {devMTB, devMTB1},
+	"DPF":  {devDPF, devDPF1},
+	"DSKP": {devDSKP, devDSKP1},
+	"LPT":  {devLPT},
+	"RTC":  {devRTC},
+	"PIT":  {devPIT},
+	"PTR":  {devPTR},
+	"PTP":  {devPTP},
+	"TMX":  {devTMX, devTMX1, devTMX2},
+}
+
+// fixedDevCodes are the codes of the devices which are always present, they may not be configured
+var fixedDevCodes = map[int]bool{devPWRFL: true, devBMC: true, devTTI: true, devTTO: true, devSCP: true, devCPU: true}
+
+// machineConfig is the profile of the running machine
+var machineConfig = defaultMachineConfig()
+
+// defaultMachineConfig returns a minimally configured MV/10000 with two of each type of controller, a line printer,
+// a real-time clock, a programmable interval timer and a paper tape reader and punch
+func defaultMachineConfig() machineConfigT {
+	cfg := machineConfigT{
+		MemSizeWords:  defaultMemSizeWords,
+		LineFrequency: 60,
+		ConsoleAddr:   "localhost:10000",
+		StatusAddr:    "localhost:9999",
+		Devices: []configDeviceT{
+			{Type: "MTB"},
+			{Type: "MTB", Code: "062"},
+			{Type: "DPF"},
+			{Type: "DPF", Code: "067"},
+			{Type: "DSKP"},
+			{Type: "DSKP", Code: "064"},
+			{Type: "LPT"},
+			{Type: "RTC"},
+			{Type: "PIT"},
+			{Type: "PTR"},
+			{Type: "PTP"},
+		},
+	}
+	cfg.resolveDevices() // cannot fail for the defaults
+	return cfg
+}
+
+// loadMachineConfig reads and validates a machine profile, unspecified values take their defaults
+func loadMachineConfig(fileName string) (cfg machineConfigT, err error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return cfg, err
+	}
+	cfg = defaultMachineConfig()
+	cfg.Devices = nil
+	// refuse anything we do not understand rather than silently ignore it
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+func (cfg *machineConfigT) validate() error {
+	if cfg.MemSizeWords <= 0 || cfg.MemSizeWords%(16*1024) != 0 || cfg.MemSizeWords > defaultMemSizeWords {
+		return fmt.Errorf("MemSizeWords must be a multiple of 16384 and no more than %d", defaultMemSizeWords)
+	}
+	if cfg.LineFrequency != 50 && cfg.LineFrequency != 60 {
+		return fmt.Errorf("LineFrequency must be 50 or 60")
+	}
+	if err := cfg.resolveDevices(); err != nil {
+		return err
+	}
+	used := map[int]bool{}
+	for _, dev := range cfg.Devices {
+		if used[dev.code] {
+			return fmt.Errorf("device code %#o is configured more than once", dev.code)
+		}
+		used[dev.code] = true
+		if dev.Type == "TMX" {
+			if len(dev.Lines) == 0 || len(dev.Lines) > tmxMaxLines {
+				return fmt.Errorf("%s must have between 1 and %d Lines", dev.Type, tmxMaxLines)
+			}
+		} else if len(dev.Lines) > 0 {
+			return fmt.Errorf("Lines may not be given for %s", dev.Type)
+		}
+		for _, att := range dev.Attach {
+			if att.File == "" {
+				return fmt.Errorf("no File given for %s attachment", dev.Type)
+			}
+			if (att.RW || att.RO) && dev.Type != "MTB" && dev.Type != "DPF" && dev.Type != "DSKP" {
+				return fmt.Errorf("RW and RO may only be given for disk and tape attachments, not %s", dev.Type)
+			}
+			if att.RW && att.RO {
+				return fmt.Errorf("RW and RO cannot both be given for %s attachment %s", dev.Type, att.File)
+			}
+			if att.Unit < 0 || att.Unit >= maxUnits(dev.Type) {
+				return fmt.Errorf("unit number %d. is too high for %s", att.Unit, dev.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// resolveDevices decides which controller each configured device is and its device code.
+// A device given the standard code of one of its type's controllers is that controller, the others are
+// the remaining controllers of the type in order, at their standard codes unless another Code is given.
+func (cfg *machineConfigT) resolveDevices() error {
+	taken := map[int]bool{}
+	for ix := range cfg.Devices {
+		dev := &cfg.Devices[ix]
+		ctrlrs, known := configurableDevTypes[dev.Type]
+		if !known {
+			return fmt.Errorf("unknown or unsupported device type <%s>", dev.Type)
+		}
+		dev.ctrlr, dev.code = -1, -1
+		if dev.Code == "" {
+			continue
+		}
+		code, err := strconv.ParseInt(dev.Code, 8, 16)
+		if err != nil || code <= 0 || code >= devCPU || fixedDevCodes[int(code)] {
+			return fmt.Errorf("invalid device code <%s> for %s", dev.Code, dev.Type)
+		}
+		dev.code = int(code)
+		for _, ctrlr := range ctrlrs {
+			if ctrlr == dev.code && !taken[ctrlr] {
+				dev.ctrlr = ctrlr
+				taken[ctrlr] = true
+			}
+		}
+	}
+	for ix := range cfg.Devices {
+		dev := &cfg.Devices[ix]
+		ctrlrs := configurableDevTypes[dev.Type]
+		for _, ctrlr := range ctrlrs {
+			if dev.ctrlr == -1 && !taken[ctrlr] {
+				dev.ctrlr = ctrlr
+				taken[ctrlr] = true
+			}
+		}
+		if dev.ctrlr == -1 {
+			return fmt.Errorf("no more than %d %s may be configured", len(ctrlrs), dev.Type)
+		}
+		if dev.code == -1 {
+			dev.code = dev.ctrlr
+		}
+	}
+	return nil
+}
+
+// relocateDevices moves the device map entries of any controllers configured at other than their
+// standard codes, so that their mnemonics refer to the configured codes
+func relocateDevices(devs []configDeviceT) {
+	moved := devices.DeviceMapT{}
+	for _, dev := range devs {
+		if dev.code != dev.ctrlr {
+			moved[dev.code] = deviceMap[dev.ctrlr]
+			delete(deviceMap, dev.ctrlr)
+		}
+	}
+	for code, de := range moved {
+		deviceMap[code] = de
+	}
+}
+
+// isConfigured returns true if the controller with the given mnemonic is present in this machine
+func isConfigured(mnem string) bool {
+	du, err := parseDevUnit(mnem)
+	return err == nil && configuredDevs[du.devNum]
+}
+
+// applyMachineConfig sets up the machine profile, values given explicitly on the command line take precedence
+func applyMachineConfig(cfg machineConfigT) {
+	machineConfig = cfg
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if !explicit["consoleaddr"] && cfg.ConsoleAddr != "" {
+		*consoleAddrFlag = cfg.ConsoleAddr
+	}
+	if !explicit["statusaddr"] && cfg.StatusAddr != "" {
+		*statusAddrFlag = cfg.StatusAddr
+	}
+	if !explicit["boot"] && cfg.Boot != "" {
+		*bootFlag = cfg.Boot
+	}
+	MemSizeWords = cfg.MemSizeWords
+}
+
+// addConfiguredDevices puts the configured peripheral controllers onto the bus
+func addConfiguredDevices() {
+	relocateDevices(machineConfig.Devices)
+	for _, dev := range machineConfig.Devices {
+		code := dev.code
+		bus.AddDevice(deviceMap, code, false)
+		switch dev.ctrlr {
+		case devMTB:
+			mtb.tape6026Init(code, &bus, mtbStatsChan, logging.MtLog, debugLogging)
+			mtbControllers[code] = &mtb
+		case devMTB1:
+			mtb1.tape6026Init(code, &bus, mtb1StatsChan, logging.MtLog, debugLogging)
+			mtbControllers[code] = &mtb1
+		case devDPF:
+			dpf.disk6061Init(code, &bus, dpfStatsChan, logging.DpfLog, debugLogging)
+			dpfControllers[code] = &dpf
+		case devDPF1:
+			dpf1.disk6061Init(code, &bus, dpf1StatsChan, logging.DpfLog, debugLogging)
+			dpfControllers[code] = &dpf1
+		case devDSKP:
+			dskp.disk6239Init(code, &bus, dskpStatsChan, logging.DskpLog, debugLogging)
+			dskpControllers[code] = &dskp
+		case devDSKP1:
+			dskp1.disk6239Init(code, &bus, dskp1StatsChan, logging.DskpLog, debugLogging)
+			dskpControllers[code] = &dskp1
+		case devLPT:
+			lpt.lptInit(code, &bus)
+		case devRTC:
+			rtc.rtcInit(code, &bus, machineConfig.LineFrequency, *deterministicFlag)
+		case devPIT:
+			pit.pitInit(code, &bus, *deterministicFlag)
+		case devPTR:
+			ptr.ptrInit(code, &bus)
+		case devPTP:
+			ptp.ptpInit(code, &bus)
+		case devTMX, devTMX1, devTMX2:
+			tmxInit(code, &bus, dev.Lines)
+		}
+		configuredDevs[code] = true
+	}
+}
+
+// attachConfiguredImages attaches any images given in the machine configuration,
+// we give up if any cannot be attached rather than run a machine other than the one configured
+func attachConfiguredImages() {
+	for _, dev := range machineConfig.Devices {
+		for _, att := range dev.Attach {
+			du := devUnitT{devType: dev.Type, devNum: dev.code, unit: att.Unit}
+			cmd := []string{"ATT", du.String(), att.File}
+			switch {
+			case att.RW:
+				cmd = append(cmd, "RW")
+			case att.RO:
+				cmd = append(cmd, "RO")
+			}
+			if !attach(cmd) {
+				log.Printf("ERROR: Could not attach configured image <%s> to %s\n", att.File, du.String())
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// printableMachineConfig describes the machine profile for SHOW CONFIG
+func printableMachineConfig() string {
+	res := fmt.Sprintf("Memory: %d. words (%dKB)  CPU Model No: %#x  Microcode Rev: %#x  Line: %d.Hz\012",
+		MemSizeWords, MemSizeWords*2/1024, cpuModelNo, ucodeRev, machineConfig.LineFrequency)
+	res += fmt.Sprintf("Console: %s  Status: %s\012", *consoleAddrFlag, *statusAddrFlag)
+	if *bootFlag != "" {
+		res += fmt.Sprintf("Boot: %s\012", *bootFlag)
+	}
+	for _, dev := range machineConfig.Devices {
+		res += fmt.Sprintf("%-5s at device code %#o", deviceMap[dev.code].DgMnemonic, dev.code)
+		if len(dev.Lines) > 0 {
+			res += fmt.Sprintf(" with %d. lines", len(dev.Lines))
+		}
+		res += "\012"
+	}
+	return res
+}
@@ -22,17 +22,18 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/SMerrony/dgemug/devices"
@@ -57,12 +58,8 @@ const (
 	cpuModelNo = 0x224C // => MV/10000 according to p.2-19 of AOS/VS Internals
 	ucodeRev   = 0x04
 
-	// MemSizeWords defines the size of MV/Em's emulated RAM in 16-bit words
-	MemSizeWords = 8388608 // = 040 000 000 (8) = 0x80 0000
-	// MemSizeLCPID is the code returned by the LCPID to indicate the size of RAM in half megabytes
-	MemSizeLCPID = ((MemSizeWords * 2) / (256 * 1024)) - 1 // 0x3F
-	// MemSizeNCLID is the code returned by NCLID to indicate size of RAM in 32Kb increments
-	MemSizeNCLID = ((MemSizeWords * 2) / (32 * 1024)) - 1
+	// defaultMemSizeWords defines the default, and largest, size of MV/Em's emulated RAM in 16-bit words
+	defaultMemSizeWords = 8388608 // = 040 000 000 (8) = 0x80 0000
 
 	cmdUnknown = " *** UNKNOWN SCP-CLI COMMAND ***"
 	cmdNYI     = "Command Not Yet Implemented"
@@ -73,36 +70,72 @@ const (
 var (
 	// debugLogging - CPU runs about 3x faster without debugLogging
 	// (and another 3x faster without disassembly, linked to this)
-	debugLogging  = true
-	breakpoints   []dg.PhysAddrT
-	cpuStatsChan  chan mvcpu.CPUStatT
-	dpfStatsChan  chan devices.Disk6061StatT
-	dskpStatsChan chan devices.Disk6239StatT
-	mtbStatsChan  chan devices.MtStatT
-	ttiSCPchan    chan byte
-
-	cpu  mvcpu.CPUT
-	tti  devices.TtiT
-	tto  devices.TtoT
-	bus  devices.BusT
-	dpf  devices.Disk6061T
-	dskp devices.Disk6239DataT
-	mtb  devices.MagTape6026T
+	debugLogging   = true
+	breakpoints    []dg.PhysAddrT
+	cpuStatsChan   chan mvcpu.CPUStatT
+	dpfStatsChan   chan disk6061StatT
+	dpf1StatsChan  chan disk6061StatT
+	dskpStatsChan  chan disk6239StatT
+	dskp1StatsChan chan disk6239StatT
+	mtbStatsChan   chan tape6026StatT
+	mtb1StatsChan  chan tape6026StatT
+	ttiSCPchan     chan byte
+
+	cpu   mvcpu.CPUT
+	tti   devices.TtiT
+	tto   devices.TtoT
+	bus   devices.BusT
+	dpf   disk6061T
+	dpf1  disk6061T
+	dskp  disk6239T
+	dskp1 disk6239T
+	mtb   tape6026T
+	mtb1  tape6026T
+
+	// MemSizeWords is the size of MV/Em's emulated RAM in 16-bit words, it may be set by the machine configuration
+	MemSizeWords = defaultMemSizeWords
+
+	// the configured controllers, by device code
+	dpfControllers  = map[int]*disk6061T{}
+	dskpControllers = map[int]*disk6239T{}
+	mtbControllers  = map[int]*tape6026T{}
+	// configuredDevs records which controllers are present in this machine
+	configuredDevs = map[int]bool{}
 
 	inputRadix = defaultRadix
+
+	// attachedImages records the image file currently attached to each device
+	attachedImages = map[string]string{}
 )
 
 // flags
 var (
-	consoleAddrFlag = flag.String("consoleaddr", "localhost:10000", "network interface/port for console")
-	doFlag          = flag.String("do", "", "run script `file` at startup")
-	statusAddrFlag  = flag.String("statusaddr", "localhost:9999", "network interface/port for status monitoring")
-	cpuprofile      = flag.String("cpuprofile", "", "write cpu profile `file`")
-	memprofile      = flag.String("memprofile", "", "write memory profile to `file`")
+	batchFlag         = flag.Bool("batch", false, "run the -do script (and -boot) without a console, then exit with a status showing how the CPU halted")
+	bootFlag          = flag.String("boot", "", "boot and run `device` (or \"PROGRAM <file> [fmt] [start]\") after any -do script")
+	configFlag        = flag.String("config", "", "read machine configuration from JSON `file`")
+	consoleAddrFlag   = flag.String("consoleaddr", "localhost:10000", "network interface/port for console")
+	coreFlag          = flag.String("core", "", "examine post-mortem dump `file` instead of running a machine")
+	deterministicFlag = flag.Bool("deterministic", false, "drive the RTC and PIT by instruction count rather than host time")
+	doFlag            = flag.String("do", "", "run script `file` at startup")
+	maxInstrFlag      = flag.Uint64("maxinstr", 0, "stop the CPU after `n` instructions in any one run")
+	watchdogFlag      = flag.Duration("watchdog", 0, "stop the CPU after it has run for `duration`, eg. 10m")
+	statusAddrFlag    = flag.String("statusaddr", "localhost:9999", "network interface/port for status monitoring")
+	cpuprofile        = flag.String("cpuprofile", "", "write cpu profile `file`")
+	memprofile        = flag.String("memprofile", "", "write memory profile to `file`")
 )
 
 func main() {
 	flag.Parse()
+	if flag.Arg(0) == "tape" {
+		os.Exit(tapeSubcommand(flag.Args()[1:]))
+	}
+	if *configFlag != "" {
+		cfg, err := loadMachineConfig(*configFlag)
+		if err != nil {
+			log.Fatalf("ERROR: Could not load machine configuration <%s>: %s", *configFlag, err.Error())
+		}
+		applyMachineConfig(cfg)
+	}
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -113,30 +146,48 @@ func main() {
 		}
 	}
 
-	log.Printf("INFO: %s will not start until console connected to  %s.\n", appName, *consoleAddrFlag)
+	var l net.Listener
+	if *batchFlag {
+		if *doFlag == "" && *bootFlag == "" {
+			log.Println("ERROR: -batch requires -do and/or -boot")
+			os.Exit(exitFatal)
+		}
+	} else {
+		log.Printf("INFO: %s will not start until console connected to  %s.\n", appName, *consoleAddrFlag)
 
-	l, err := net.Listen("tcp", *consoleAddrFlag)
-	if err != nil {
-		log.Println("ERROR: Could not listen on console port: ", err.Error())
-		os.Exit(1)
-	}
+		var err error
+		l, err = net.Listen("tcp", *consoleAddrFlag)
+		if err != nil {
+			log.Println("ERROR: Could not listen on console port: ", err.Error())
+			os.Exit(1)
+		}
 
-	// close the port once we are done
-	defer l.Close()
+		// close the port once we are done
+		defer l.Close()
+	}
 
 	for {
-		conn, err := l.Accept()
-		if err != nil {
-			log.Println("ERROR: Could not accept on console port: ", err.Error())
-			os.Exit(1)
+		var conn net.Conn
+		if *batchFlag {
+			conn = batchConsole()
+		} else {
+			var err error
+			conn, err = l.Accept()
+			if err != nil {
+				log.Println("ERROR: Could not accept on console port: ", err.Error())
+				os.Exit(1)
+			}
 		}
 
 		// create the channels used for near-real-time status monitoring
 		// See statusCollector.go for details
 		cpuStatsChan = make(chan mvcpu.CPUStatT, 3)
-		dpfStatsChan = make(chan devices.Disk6061StatT, 3)
-		dskpStatsChan = make(chan devices.Disk6239StatT, 3)
-		mtbStatsChan = make(chan devices.MtStatT, 3)
+		dpfStatsChan = make(chan disk6061StatT, 3)
+		dpf1StatsChan = make(chan disk6061StatT, 3)
+		dskpStatsChan = make(chan disk6239StatT, 3)
+		dskp1StatsChan = make(chan disk6239StatT, 3)
+		mtbStatsChan = make(chan tape6026StatT, 3)
+		mtb1StatsChan = make(chan tape6026StatT, 3)
 
 		ttiSCPchan = make(chan byte, ScpBuffSize)
 
@@ -144,14 +195,17 @@ func main() {
 		 *  The console is connected, now we can set up our emulated machine
 		 *
 		 * Here we are defining the hardware in our virtual machine
-		 * Initially based on a minimally configured MV/10000 Model I.
+		 * By default based on a minimally configured MV/10000 Model I.
 		 *
 		 *   One CPU
 		 *   Console (TTI/TTO)
 		 *   One Tape Drive
 		 *   One HDD
 		 *   A generous(!) 16MB RAM
-		 *   NO IACs, LPT or ISC
+		 *   A line printer (LPT), real-time clock (RTC) and programmable interval timer (PIT)
+		 *   NO terminal multiplexors (TMX) unless configured
+		 *
+		 * The peripherals and memory size may be changed via a -config file
 		 ***/
 
 		memory.MemInit(MemSizeWords, debugLogging)
@@ -159,6 +213,9 @@ func main() {
 		bus.AddDevice(deviceMap, devBMC, true)
 		bus.SetResetFunc(devBMC, memory.BmcdchReset) // created by memory, needs bus!
 
+		bus.AddDevice(deviceMap, devPWRFL, true)
+		powerFail.pwrflInit(devPWRFL, &bus)
+
 		bus.AddDevice(deviceMap, devSCP, true)
 		bus.AddDevice(deviceMap, devCPU, true)
 		mvcpu.InstructionsInit()
@@ -171,28 +228,50 @@ func main() {
 		//ttiInit(conn, cpuPtr, ttiSCPchan)
 		tti.Init(devTTI, &bus)
 		go consoleListener(conn, &cpu, ttiSCPchan, &tti)
-
-		bus.AddDevice(deviceMap, devMTB, false)
-		mtb.MtInit(devMTB, &bus, mtbStatsChan, logging.MtLog, debugLogging)
-
-		bus.AddDevice(deviceMap, devDPF, false)
-		dpf.Disk6061Init(devDPF, &bus, dpfStatsChan, logging.DpfLog, debugLogging)
-
-		bus.AddDevice(deviceMap, devDSKP, false)
-		dskp.Disk6239Init(devDSKP, &bus, dskpStatsChan, logging.DskpLog, debugLogging)
+		go exitOnSignal()
 
 		// say hello...
 		tto.PutChar(dg.ASCIIFF)
 		tto.PutStringNL(" *** Welcome to the MV/Emulator - Type HE for help ***")
 
-		// kick off the status monitor routine
-		go statusCollector(*statusAddrFlag, cpuStatsChan, dpfStatsChan, dskpStatsChan, mtbStatsChan)
+		if *coreFlag != "" {
+			// examining a dump - no devices are needed
+			if err := coreLoad(*coreFlag); err != nil {
+				log.Printf("ERROR: Could not load post-mortem dump <%s>: %s\n", *coreFlag, err.Error())
+				os.Exit(1)
+			}
+			showCoreStatus()
+		} else {
+			// the peripherals are defined by the machine configuration
+			addConfiguredDevices()
+
+			// kick off the status monitor routine
+			go statusCollector(*statusAddrFlag, cpuStatsChan, dpfStatsChan, dpf1StatsChan,
+				dskpStatsChan, dskp1StatsChan, mtbStatsChan, mtb1StatsChan)
+
+			attachConfiguredImages()
+		}
 
 		// run any command specified on the command line
 		if *doFlag != "" {
 			command := fmt.Sprintf("DO %s", *doFlag)
 			log.Printf("INFO: got startup command <%s>\n", command)
 			doCommand(command) // N.B. will not pass here until start-up script is complete...
+			batchFailed = cmdFailed
+		}
+
+		// boot and run if requested
+		if *bootFlag != "" && !coreMode && !batchFailed {
+			log.Printf("INFO: booting <%s>\n", *bootFlag)
+			if boot(append([]string{"B"}, strings.Fields(*bootFlag)...)) {
+				run()
+			} else {
+				batchFailed = true
+			}
+		}
+
+		if *batchFlag {
+			cleanExit()
 		}
 
 		// the main SCP/console interaction loop
@@ -226,16 +305,19 @@ func consoleListener(con net.Conn, cpuPtr *mvcpu.CPUT, scpChan chan<- byte, tti
 	b := make([]byte, 80)
 	for {
 		n, err := con.Read(b)
+		if err != nil && *batchFlag {
+			return // the batch console has no input, it is only closed as we exit
+		}
 		if err != nil || n == 0 {
 			log.Println("ERROR: could not read from console port: ", err.Error())
-			os.Exit(1)
+			emergencyExit(1)
 		}
 		//log.Printf("DEBUG: ttiListener() got <%c>\n", b[0])
 		for c := 0; c < n; c++ {
 			// console ESCape?
 			//if b[c] == dg.ASCIIESC || b[c] == 0 {
 			if b[c] == dg.ASCIIESC {
-				cpuPtr.SetSCPIO(true)
+				requestHalt(haltConsoleEscape)
 				break // don't want to send the ESC itself to the SCP
 			}
 			scp := cpuPtr.GetSCPIO()
@@ -287,31 +369,73 @@ func cleanExit() {
 		pprof.StopCPUProfile()
 	}
 	if *memprofile != "" {
-		f, err := os.Create(*memprofile)
-		if err != nil {
-			log.Fatal("could not create memory profile: ", err)
-		}
-		runtime.GC() // get up-to-date statistics
-		if err := pprof.WriteHeapProfile(f); err != nil {
-			log.Fatal("could not write memory profile: ", err)
+		// any failure here must not stop the images being saved below
+		if f, err := os.Create(*memprofile); err != nil {
+			log.Println("ERROR: could not create memory profile: ", err)
+		} else {
+			runtime.GC() // get up-to-date statistics
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				log.Println("ERROR: could not write memory profile: ", err)
+			}
+			f.Close()
 		}
-		f.Close()
 	}
 	logging.DebugLogsDump("logs/")
-	memory.DumpToFile("mvemug.dmp")
+	if !coreMode {
+		postMortemDump()
+		detachAllDisks()
+		detachAllTapes()
+		lpt.lptDetach()
+		ptp.ptpDetach()
+	}
+	if *batchFlag {
+		log.Printf("INFO: batch run complete, exit status %d\n", batchExitCode())
+		flushBatchConsole()
+		os.Exit(batchExitCode())
+	}
 	os.Exit(0)
 }
 
+// emergencyExit stops the emulator when it cannot carry on, eg. the console has gone away, saving the changes held in
+// the working copies of any images first
+func emergencyExit(status int) {
+	cpu.SetSCPIO(true)
+	if !coreMode {
+		releaseAllDisks()
+		detachAllTapes()
+		lpt.lptDetach()
+		ptp.ptpDetach()
+	}
+	os.Exit(status)
+}
+
+// exitOnSignal calls emergencyExit if the emulator is interrupted or terminated by the host
+func exitOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigs
+	log.Printf("ERROR: stopping on signal %v\n", sig)
+	emergencyExit(1)
+}
+
 func doCommand(cmd string) {
 	words := strings.Split(strings.TrimSpace(cmd), " ")
 	if debugLogging {
 		logging.DebugPrint(logging.DebugLog, "INFO: doCommand parsed command as <%s>\n", words[0])
 	}
+	if coreMode && !coreModeAllows(words[0]) {
+		cmdError(" *** Command not available when examining a dump ***")
+		return
+	}
 
 	switch words[0] {
 	// SCP-like commands
 	case ".":
-		tto.PutString(cpu.PrintableStatus())
+		if coreMode {
+			showCoreStatus()
+		} else {
+			tto.PutString(cpu.PrintableStatus())
+		}
 	case "B":
 		boot(words)
 	case "CO":
@@ -319,9 +443,9 @@ func doCommand(cmd string) {
 	case "E":
 		examine(words)
 	case "HE":
-		showHelp()
+		showHelp(words)
 	case "RE":
-		reset()
+		resetCommand(words)
 	case "SS":
 		singleStep()
 	case "ST":
@@ -333,7 +457,9 @@ func doCommand(cmd string) {
 	case "BREAK":
 		breakSet(words)
 	case "CHECK":
-		tto.PutStringNL(mtb.MtScanImage(0))
+		check(words)
+	case "COMMIT", "DISCARD":
+		overlayCommand(words)
 	case "CREATE":
 		createBlank(words)
 	case "DET":
@@ -342,105 +468,287 @@ func doCommand(cmd string) {
 		disassemble(words)
 	case "DO":
 		doScript(words)
+	case "DUMP":
+		dumpMemory(words)
+	case "DUMPDIFF":
+		dumpDiff(words)
 	case "exit", "EXIT", "QUIT":
 		cleanExit()
+	case "FIND":
+		findMemory(words)
+	case "IMAGE":
+		imageCommand(words)
 	case "LOAD":
-		tto.PutNLString(memory.LoadFromASCIIFile(words[1]))
+		loadMemory(words)
+	case "LOADPR":
+		loadProgramFile(words)
+	case "MKTAPE":
+		makeTape(words)
 	case "NOBREAK":
 		breakClear(words)
+	case "POWERFAIL":
+		powerFailCommand()
+	case "POWERRESTORE":
+		powerRestoreCommand()
+	case "SAVE":
+		saveMemory(words)
 	case "SET":
 		set(words)
 	case "SH", "SHO", "SHOW":
 		show(words)
+	case "SNAPSHOT":
+		snapshot(words)
+	case "TAPE":
+		tapeCommand(words)
 	default:
-		tto.PutNLString(cmdUnknown)
+		cmdError(cmdUnknown)
 	}
 }
 
 /* Commands are below here... */
 
-// Attach an image file to an emulated device
-func attach(cmd []string) {
+// attach attaches an image file to an emulated device, it returns true if the image was attached
+func attach(cmd []string) bool {
 	if len(cmd) < 3 {
-		tto.PutNLString(" *** ATT command requires arguments: <dev> and <image> ***")
-		return
+		cmdError(" *** ATT command requires arguments: <dev> and <image> ***")
+		return false
 	}
 	if debugLogging {
 		logging.DebugPrint(logging.DebugLog, "INFO: Attach called  with parms <%s> <%s>\n", cmd[1], cmd[2])
 	}
-	switch cmd[1] {
+	du, err := parseDevUnit(cmd[1])
+	if err != nil || !configuredDevs[du.devNum] {
+		cmdError(" *** Unknown or unimplemented Device for ATT command ***")
+		return false
+	}
+	switch du.devType {
 	case "MTB":
-		if mtb.MtAttach(0, cmd[2]) {
-			tto.PutNLString(" *** Tape Image Attached ***")
-		} else {
-			tto.PutNLString(" *** Could not ATTach Tape Image ***")
+		manifest := ""
+		readOnly := false
+		capacity := int64(tape6026DefaultCapacity)
+		for a := 3; a < len(cmd); a++ {
+			switch {
+			case cmd[a] == "RW":
+				// the default, accepted for compatibility
+			case cmd[a] == "RO":
+				readOnly = true
+			case cmd[a] == "CAPACITY" && a+1 < len(cmd):
+				a++
+				mb, err := strconv.Atoi(strings.TrimSuffix(cmd[a], "MB"))
+				if err != nil || mb <= 0 || !strings.HasSuffix(cmd[a], "MB") {
+					cmdError(" *** CAPACITY requires a size in megabytes, eg. CAPACITY 150MB ***")
+					return false
+				}
+				capacity = int64(mb) * 1024 * 1024
+			case a == 3 && strings.HasPrefix(cmd[2], dirTapePrefix):
+				manifest = cmd[a]
+			default:
+				cmdError(" *** Expecting RW, RO or CAPACITY <n>MB after tape image name ***")
+				return false
+			}
 		}
-
-	case "DPF":
-		if dpf.Disk6061Attach(0, cmd[2]) {
-			tto.PutNLString(" *** DPF Disk Image Attached ***")
-		} else {
-			tto.PutNLString(" *** Could not ATTach DPF Disk Image ***")
+		if attachTape(du, cmd[2], manifest, readOnly, capacity) {
+			attachedImages[du.String()] = cmd[2]
+			if tapeMounts[du.String()].readOnly {
+				tto.PutNLString(" *** Tape Image Attached (RO) ***")
+			} else {
+				tto.PutNLString(" *** Tape Image Attached (RW) ***")
+			}
+			return true
+		}
+		cmdError(" *** Could not ATTach Tape Image ***")
+		return false
+
+	case "DPF", "DSKP":
+		readWrite, readOnly, writeBack := false, false, false
+		var overlays []string
+		var geom diskGeometryT
+		for a := 3; a < len(cmd); a++ {
+			switch {
+			case cmd[a] == "TYPE" || cmd[a] == "GEOMETRY":
+				g, used, err := parseDiskGeometry(du.devType, cmd[a:])
+				if err != nil {
+					cmdError(" *** " + err.Error() + " ***")
+					return false
+				}
+				geom = g
+				a += used - 1
+			case cmd[a] == "RW":
+				readWrite = true // the default, accepted for compatibility
+			case cmd[a] == "RO":
+				readOnly = true
+			case cmd[a] == "WRITEBACK":
+				writeBack = true
+			case cmd[a] == "OVERLAY" && a+1 < len(cmd):
+				a++
+				overlays = append(overlays, cmd[a])
+			default:
+				cmdError(" *** Expecting RW, RO, WRITEBACK, OVERLAY <file>, TYPE <model> or GEOMETRY <c> <h> <s> after disk image name ***")
+				return false
+			}
+		}
+		if readWrite && readOnly {
+			cmdError(" *** RW and RO cannot both be given ***")
+			return false
+		}
+		if (readWrite || readOnly || writeBack) && len(overlays) > 0 {
+			cmdError(" *** RW, RO and WRITEBACK cannot be used with OVERLAY ***")
+			return false
+		}
+		if readOnly && writeBack {
+			cmdError(" *** WRITEBACK cannot be used with RO ***")
+			return false
 		}
+		if attachDisk(du, cmd[2], overlays, readOnly, writeBack, geom) {
+			attachedImages[du.String()] = cmd[2]
+			switch {
+			case len(overlays) > 0:
+				tto.PutNLString(" *** " + du.devType + " Disk Image Attached with OVERLAY " + overlays[len(overlays)-1] + " ***")
+			case readOnly:
+				tto.PutNLString(" *** " + du.devType + " Disk Image Attached (RO) ***")
+			default:
+				tto.PutNLString(" *** " + du.devType + " Disk Image Attached (RW) ***")
+			}
+			return true
+		}
+		cmdError(" *** Could not ATTach " + du.devType + " Disk Image ***")
+		return false
 
-	case "DSKP":
-		if dskp.Disk6239Attach(0, cmd[2]) {
-			tto.PutNLString(" *** DSKP Disk Image Attached ***")
-		} else {
-			tto.PutNLString(" *** Could not ATTach DSKP Disk Image ***")
+	case "LPT":
+		if err := lpt.lptAttach(cmd[2], cmd[3:]); err != nil {
+			cmdError(" *** Could not ATTach LPT - " + err.Error() + " ***")
+			return false
 		}
+		tto.PutNLString(" *** LPT output ATTached ***")
+		return true
 
-	default:
-		tto.PutNLString(" *** Unknown or unimplemented Device for ATT command ***")
+	case "PTR":
+		if err := ptr.ptrAttach(cmd[2]); err != nil {
+			cmdError(" *** Could not ATTach PTR - " + err.Error() + " ***")
+			return false
+		}
+		attachedImages[du.String()] = cmd[2]
+		tto.PutNLString(" *** Paper Tape ATTached to reader ***")
+		return true
+
+	case "PTP":
+		if err := ptp.ptpAttach(cmd[2]); err != nil {
+			cmdError(" *** Could not ATTach PTP - " + err.Error() + " ***")
+			return false
+		}
+		tto.PutNLString(" *** PTP output ATTached ***")
+		return true
 	}
+	cmdError(" *** Unknown or unimplemented Device for ATT command ***")
+	return false
 }
 
-func boot(cmd []string) {
+// boot implements B <device> and B PROGRAM ..., it returns true if the machine is ready to run
+func boot(cmd []string) bool {
+	if len(cmd) > 1 && cmd[1] == "PROGRAM" {
+		return bootProgram(cmd[2:])
+	}
 	if len(cmd) != 2 {
-		tto.PutNLString(" *** B command requires <devicenumber> ***")
-		return
+		cmdError(" *** B command requires <device> or PROGRAM <file> ***")
+		return false
 	}
 	if debugLogging {
 		logging.DebugPrint(logging.DebugLog, "INFO: Boot called  with parm <%s>\n", cmd[1])
 	}
-	dev, err := strconv.ParseInt(cmd[1], inputRadix, 16)
-	devNum := int(dev)
+	du, err := parseBootDevice(cmd[1], inputRadix)
 	if err != nil {
-		tto.PutNLString(" *** Expecting <devicenumber> after B ***")
-		return
+		cmdError(" *** Expecting <device> after B - " + err.Error() + " ***")
+		return false
 	}
-	if !bus.IsAttached(devNum) {
-		tto.PutNLString(" *** Device is not ATTached ***")
-		return
+	devNum := du.devNum
+	if _, attached := attachedImages[du.String()]; !attached {
+		cmdError(" *** Device is not ATTached ***")
+		return false
 	}
 	if !bus.IsBootable(devNum) {
-		tto.PutNLString(" *** Device is not bootable ***")
-		return
+		cmdError(" *** Device is not bootable ***")
+		return false
 	}
 	memory.MemInit(MemSizeWords, debugLogging)
-	switch devNum {
-	case devMTB:
-		mtb.MtLoadTBoot()
-		cpu.Boot(devMTB, 012)
-	case devDPF:
-		dpf.Disk6061LoadDKBT()
-		cpu.Boot(devDPF, 012)
-	case devDSKP:
-		dskp.Disk6239LoadDKBT()
-		cpu.Boot(devDSKP, 012)
+	switch du.devType {
+	case "MTB":
+		mtbControllers[devNum].tape6026LoadTBoot(du.unit)
+		cpu.Boot(devNum, 012)
+	case "DPF":
+		dpfControllers[devNum].disk6061LoadDKBT(du.unit)
+		cpu.Boot(devNum, 012)
+	case "DSKP":
+		dskpControllers[devNum].disk6239LoadDKBT(du.unit)
+		cpu.Boot(devNum, 012)
+	case "PTR":
+		// load the absolute binary tape directly, as the binary loader would
+		count, start, autoStart, err := loadAbsData(ptr.ptrRemaining(), 0)
+		if err != nil {
+			cmdError(" *** Could not load paper tape: " + err.Error() + " ***")
+			return false
+		}
+		tto.PutNLString(fmt.Sprintf("%d. words loaded from paper tape", count))
+		if !autoStart {
+			cmdError(" *** Tape has no start address - use ST <addr> ***")
+			return false
+		}
+		cpu.Boot(devNum, start)
 	default:
-		tto.PutNLString(" *** Booting from that device not yet implemented ***")
+		cmdError(" *** Booting from that device not yet implemented ***")
+		return false
 	}
+	return true
+}
+
+// bootProgram implements B PROGRAM <file> [ASCII|RAW|ABS] [<start>], the 'program load' style used for
+// the Nova diagnostics: memory is cleared, the file LOADed and the PC set to the start address, which may
+// be omitted for an ABS file that carries one.
+func bootProgram(args []string) bool {
+	if len(args) == 0 {
+		cmdError(" *** B PROGRAM requires <file> argument ***")
+		return false
+	}
+	format := fmtASCII
+	start := int64(-1)
+	for _, arg := range args[1:] {
+		switch arg {
+		case fmtASCII, fmtRAW, fmtABS:
+			format = arg
+		default:
+			addr, err := strconv.ParseInt(arg, inputRadix, 32)
+			if err != nil || addr < 0 || addr >= int64(MemSizeWords) {
+				cmdError(" *** B PROGRAM could not parse <start> argument ***")
+				return false
+			}
+			start = addr
+		}
+	}
+	memory.MemInit(MemSizeWords, debugLogging)
+	count, absStart, autoStart, err := loadImage(args[0], format, 0)
+	if err != nil {
+		cmdError(fmt.Sprintf(" *** B PROGRAM failed: %s ***", err.Error()))
+		return false
+	}
+	if start < 0 {
+		if !autoStart {
+			cmdError(" *** B PROGRAM requires a <start> address for this file ***")
+			return false
+		}
+		start = int64(absStart)
+	}
+	cpu.SetPC(dg.PhysAddrT(start))
+	tto.PutNLString(fmt.Sprintf("%d. words loaded from %s, start address "+fmtRadixVerb(), count, args[0], start))
+	return true
 }
 
 func breakSet(cmd []string) {
 	if len(cmd) != 2 {
-		tto.PutNLString(" *** BREAK command requires a single physical <address> argument ***")
+		cmdError(" *** BREAK command requires a single physical <address> argument ***")
 		return
 	}
 	pAddr, err := strconv.ParseInt(cmd[1], inputRadix, 32)
 	if err != nil {
-		tto.PutNLString(" *** BREAK command could not parse <address> argument ***")
+		cmdError(" *** BREAK command could not parse <address> argument ***")
 		return
 	}
 	breakpoints = append(breakpoints, dg.PhysAddrT(pAddr))
@@ -450,12 +758,12 @@ func breakSet(cmd []string) {
 
 func breakClear(cmd []string) {
 	if len(cmd) != 2 {
-		tto.PutNLString(" *** NOBREAK command requires a single physical <address> argument ***")
+		cmdError(" *** NOBREAK command requires a single physical <address> argument ***")
 		return
 	}
 	pAddr, err := strconv.ParseInt(cmd[1], inputRadix, 16)
 	if err != nil {
-		tto.PutNLString(" *** NOBREAK command could not parse <address> argument ***")
+		cmdError(" *** NOBREAK command could not parse <address> argument ***")
 		return
 	}
 	cAddr := dg.PhysAddrT(pAddr)
@@ -469,50 +777,125 @@ func breakClear(cmd []string) {
 }
 
 func createBlank(cmd []string) {
-	if len(cmd) < 3 {
-		tto.PutNLString(" *** Expecting DPF|DSKP <filename> args for CREATE command ***")
+	if len(cmd) == 3 && cmd[1] == "MTB" {
+		if err := createTapeImage(cmd[2]); err != nil {
+			cmdError(" *** Error: could not create blank tape image - " + err.Error() + " ***")
+			return
+		}
+		tto.PutNLString("Blank MV/Em SimH tape image created")
 		return
 	}
-	switch cmd[1] {
-	case "DPF":
-		tto.PutNLString("Attempting to CREATE new empty DPF-type disk image, please wait...")
-		if dpf.Disk6061CreateBlank(cmd[2]) {
-			tto.PutNLString("Empty MV/Em DPF-type disk image created")
-		} else {
-			tto.PutNLString(" *** Error: could not create empty disk image ***")
-		}
-	case "DSKP":
-		tto.PutNLString("Attempting to CREATE new empty DSKP-type disk image, please wait...")
-		if dskp.Disk6239CreateBlank(cmd[2]) {
-			tto.PutNLString("Empty MV/Em DSKP-type disk image created")
-		} else {
-			tto.PutNLString(" *** Error: could not create empty disk image ***")
-		}
-	default:
-		tto.PutNLString(" *** CREATE not yet supported for that device type ***")
+	if len(cmd) < 3 || (cmd[1] != "DPF" && cmd[1] != "DSKP") {
+		cmdError(" *** Expecting DPF|DSKP <filename> [TYPE <model>|GEOMETRY <c> <h> <s>|SIZE <n>MB] or MTB <filename> args for CREATE command ***")
+		return
 	}
+	geom, err := parseDiskSize(cmd[1], cmd[3:])
+	if err != nil {
+		cmdError(" *** " + err.Error() + " ***")
+		return
+	}
+	if err = createDiskImage(cmd[2], geom.sizeBytes()); err != nil {
+		cmdError(" *** Error: could not create empty disk image - " + err.Error() + " ***")
+		return
+	}
+	tto.PutNLString(fmt.Sprintf("Empty MV/Em %s-type disk image created (%s, %d. bytes)", cmd[1], geom.String(), geom.sizeBytes()))
 }
 
 func detach(cmd []string) {
 	if len(cmd) < 2 {
-		tto.PutNLString(" *** DET command requires argument: <dev> ***")
+		cmdError(" *** DET command requires argument: <dev> ***")
 		return
 	}
 	if debugLogging {
 		logging.DebugPrint(logging.DebugLog, "INFO: Detach called  with parm <%s> \n", cmd[1])
 	}
-	switch cmd[1] {
+	du, err := parseDevUnit(cmd[1])
+	if err != nil || !configuredDevs[du.devNum] {
+		cmdError(" *** Unknown or unimplemented Device for DET command ***")
+		return
+	}
+	switch du.devType {
 	case "MTB":
-		if mtb.MtDetach(0) {
+		if detachTape(du) {
+			delete(attachedImages, du.String())
 			tto.PutNLString(" *** Tape Image Detached ***")
 		} else {
-			tto.PutNLString(" *** Could not DETach Tape Image ***")
+			cmdError(" *** Could not DETach Tape Image ***")
+		}
+	case "DPF", "DSKP":
+		if detachDisk(du) {
+			delete(attachedImages, du.String())
+			tto.PutNLString(" *** " + du.devType + " Disk Image Detached ***")
+		} else {
+			cmdError(" *** Could not DETach " + du.devType + " Disk Image ***")
+		}
+	case "LPT":
+		if err := lpt.lptDetach(); err != nil {
+			cmdError(" *** Could not DETach LPT - " + err.Error() + " ***")
+		} else {
+			tto.PutNLString(" *** LPT output Detached ***")
+		}
+	case "PTR":
+		if err := ptr.ptrDetach(); err != nil {
+			cmdError(" *** Could not DETach PTR - " + err.Error() + " ***")
+		} else {
+			delete(attachedImages, du.String())
+			tto.PutNLString(" *** Paper Tape Detached from reader ***")
+		}
+	case "PTP":
+		if err := ptp.ptpDetach(); err != nil {
+			cmdError(" *** Could not DETach PTP - " + err.Error() + " ***")
+		} else {
+			tto.PutNLString(" *** PTP output Detached ***")
 		}
 	default:
-		tto.PutNLString(" *** Unknown or unimplemented Device for DET command ***")
+		cmdError(" *** Unknown or unimplemented Device for DET command ***")
 	}
 }
 
+// check scans the image attached to a tape unit, MTB unit 0 by default
+func check(cmd []string) {
+	unit := "MTB"
+	if len(cmd) > 1 {
+		unit = cmd[1]
+	}
+	du, err := parseDevUnit(unit)
+	if err != nil || du.devType != "MTB" {
+		cmdError(" *** CHECK requires a tape unit, eg. MTB or MTB1:1 ***")
+		return
+	}
+	if !configuredDevs[du.devNum] {
+		cmdError(" *** " + deviceToString(du.devNum) + " is not configured on this machine ***")
+		return
+	}
+	tto.PutStringNL(mtbControllers[du.devNum].tape6026ScanImage(du.unit))
+}
+
+// overlayCommand implements COMMIT and DISCARD for disks attached with an OVERLAY
+func overlayCommand(cmd []string) {
+	if len(cmd) < 2 {
+		cmdError(" *** " + cmd[0] + " command requires argument: <dev> ***")
+		return
+	}
+	du, err := parseDevUnit(cmd[1])
+	if err != nil || (du.devType != "DPF" && du.devType != "DSKP") {
+		cmdError(" *** " + cmd[0] + " requires a disk unit, eg. DSKP or DPF1 ***")
+		return
+	}
+	msg := " *** Overlay changes committed ***"
+	if cmd[0] == "COMMIT" {
+		err = commitOverlay(du)
+	} else {
+		err = discardOverlay(du)
+		msg = " *** Overlay changes discarded ***"
+	}
+	if err != nil {
+		cmdError(fmt.Sprintf(" *** Could not %s overlay: %s ***", cmd[0], err.Error()))
+		return
+	}
+	tto.PutNLString(msg)
+}
+
 func disassemble(cmd []string) {
 	var (
 		lowAddr, highAddr dg.PhysAddrT
@@ -522,13 +905,13 @@ func disassemble(cmd []string) {
 	// 	skipDecode        int
 	)
 	if len(cmd) == 1 {
-		tto.PutNLString(" *** DIS command requires an address ***")
+		cmdError(" *** DIS command requires an address ***")
 		return
 	}
 	cmd1 := cmd[1]
 	intVal1, err := strconv.ParseInt(cmd[1], inputRadix, 32)
 	if err != nil {
-		tto.PutNLString(" *** Invalid address ***")
+		cmdError(" *** Invalid address ***")
 		return
 	}
 	if cmd1[0] == '+' {
@@ -541,7 +924,7 @@ func disassemble(cmd []string) {
 		} else {
 			intVal2, err := strconv.ParseInt(cmd[2], inputRadix, 32)
 			if err != nil {
-				tto.PutNLString(" *** Invalid address ***")
+				cmdError(" *** Invalid address ***")
 				return
 			}
 			highAddr = dg.PhysAddrT(intVal2)
@@ -550,47 +933,26 @@ func disassemble(cmd []string) {
 	tto.PutString(cpu.DisassembleRange(lowAddr, highAddr))
 }
 
-func doScript(cmd []string) {
-	if len(cmd) < 2 {
-		tto.PutNLString(" *** DO command required <scriptfile> ***")
-		return
-	}
-	scriptFile, err := os.Open(cmd[1])
-	if err != nil {
-		tto.PutNLString(" *** Could not open MV/Em command script ***")
-		if debugLogging {
-			logging.DebugPrint(logging.DebugLog, "WARN: Could not open MV/Em command script <%s>\n", cmd[1])
-		}
-		return
-	}
-	defer scriptFile.Close()
-
-	scanner := bufio.NewScanner(scriptFile)
-	for scanner.Scan() {
-		doCmd := scanner.Text()
-		if doCmd[0] != '#' {
-			tto.PutNLString(doCmd)
-			doCommand(doCmd)
-		}
-	}
-
-}
-
 // examine mimics the E command from later SCP-CLIs
 func examine(cmd []string) {
+	if *batchFlag {
+		// there is no console to enter a new value on
+		cmdError(" *** E(xamine) cannot be used in -batch mode ***")
+		return
+	}
 	if len(cmd) < 2 {
-		tto.PutNLString(" *** Examine - missing parameter ***")
+		cmdError(" *** Examine - missing parameter ***")
 		return
 	}
 	switch cmd[1] {
 	case "A":
 		if len(cmd) < 3 {
-			tto.PutNLString(" *** Examine Accumulator - invalid AC number ***")
+			cmdError(" *** Examine Accumulator - invalid AC number ***")
 			return
 		}
 		exAc, err := strconv.ParseInt(cmd[2], inputRadix, 16)
 		if err != nil || exAc < 0 || exAc > 3 {
-			tto.PutNLString(" *** Examine Accumulator - invalid AC number ***")
+			cmdError(" *** Examine Accumulator - invalid AC number ***")
 			return
 		}
 		exAcI := int(exAc)
@@ -600,7 +962,7 @@ func examine(cmd []string) {
 		if len(resp) > 0 {
 			newVal, err := strconv.ParseInt(resp, inputRadix, 16)
 			if err != nil {
-				tto.PutNLString(" *** Could not parse new AC value ***")
+				cmdError(" *** Could not parse new AC value ***")
 				return
 			}
 			cpu.SetAc(exAcI, dg.DwordT(newVal))
@@ -609,12 +971,12 @@ func examine(cmd []string) {
 		}
 	case "M":
 		if len(cmd) < 3 {
-			tto.PutNLString(" *** Examine Memory - invalid address ***")
+			cmdError(" *** Examine Memory - invalid address ***")
 			return
 		}
 		exMem, err := strconv.ParseInt(cmd[2], inputRadix, 16)
-		if err != nil || exMem < 0 || exMem > MemSizeWords {
-			tto.PutNLString(" *** Examine Memory - invalid address ***")
+		if err != nil || exMem < 0 || exMem >= int64(MemSizeWords) {
+			cmdError(" *** Examine Memory - invalid address ***")
 			return
 		}
 		prompt := fmt.Sprintf("Location "+fmtRadixVerb()+" contains "+fmtRadixVerb()+" - Enter new val or just ENTER> ", exMem, memory.ReadWord(dg.PhysAddrT(exMem)))
@@ -623,7 +985,7 @@ func examine(cmd []string) {
 		if len(resp) > 0 {
 			newVal, err := strconv.ParseInt(resp, inputRadix, 16)
 			if err != nil {
-				tto.PutNLString(" *** Could not parse new value ***")
+				cmdError(" *** Could not parse new value ***")
 				return
 			}
 			memory.WriteWord(dg.PhysAddrT(exMem), dg.WordT(newVal))
@@ -637,7 +999,7 @@ func examine(cmd []string) {
 		if len(resp) > 0 {
 			newVal, err := strconv.ParseInt(resp, inputRadix, 16)
 			if err != nil {
-				tto.PutNLString(" *** Could not parse new PC value ***")
+				cmdError(" *** Could not parse new PC value ***")
 				return
 			}
 			cpu.SetPC(dg.PhysAddrT(newVal))
@@ -645,7 +1007,7 @@ func examine(cmd []string) {
 			tto.PutNLString(prompt)
 		}
 	default:
-		tto.PutNLString(" *** Expecting A, M, or P for E(xamine) command ***")
+		cmdError(" *** Expecting A, M, or P for E(xamine) command ***")
 		return
 	}
 }
@@ -663,6 +1025,7 @@ func printableBreakpointList() string {
 
 // reset should bring the emulator back to its initial state
 func reset() {
+	powerFail.failed = false
 	memory.MemInit(MemSizeWords, debugLogging)
 	bus.ResetAllIODevices()
 	cpu.Reset()
@@ -673,72 +1036,158 @@ func reset() {
 
 func set(cmd []string) {
 	if len(cmd) < 3 {
-		tto.PutNLString(" *** Expecting SET subcommand ***")
+		cmdError(" *** Expecting SET subcommand ***")
 		return
 	}
 	switch cmd[1] {
+	case "VAR":
+		scriptVars[cmd[2]] = strings.Join(cmd[3:], " ")
 	case "LOGGING":
 		switch cmd[2] {
 		case "ON":
 			debugLogging = true
 			cpu.SetDebugLogging(true)
-			dpf.Disk6061SetLogging(true)
-			dskp.Disk6239SetLogging(true)
+			for _, ctrl := range dpfControllers {
+				ctrl.disk6061SetLogging(true)
+			}
+			for _, ctrl := range dskpControllers {
+				ctrl.disk6239SetLogging(true)
+			}
+			for _, ctrl := range mtbControllers {
+				ctrl.tape6026SetLogging(true)
+			}
 		case "OFF":
 			debugLogging = false
 			cpu.SetDebugLogging(false)
-			dpf.Disk6061SetLogging(false)
-			dskp.Disk6239SetLogging(false)
+			for _, ctrl := range dpfControllers {
+				ctrl.disk6061SetLogging(false)
+			}
+			for _, ctrl := range dskpControllers {
+				ctrl.disk6239SetLogging(false)
+			}
+			for _, ctrl := range mtbControllers {
+				ctrl.tape6026SetLogging(false)
+			}
 		}
 
 	default:
-		tto.PutNLString(" *** Unknown SET subcommand ***")
+		cmdError(" *** Unknown SET subcommand ***")
 	}
 }
 
 // showHelp - Display SCP and Emulator help on the DASHER-compatible console
-// N.B. Ensure this fits on a 24x80 screen
-func showHelp() {
+// N.B. Ensure each page fits on a 24x80 screen
+func showHelp(cmd []string) {
+	if len(cmd) > 1 && cmd[1] == "2" {
+		showHelp2()
+		return
+	}
+	if len(cmd) > 1 && cmd[1] == "3" {
+		showHelp3()
+		return
+	}
 	tto.PutString("\014                          \024SCP-CLI Commands\025" +
 		"                               \034MV/EMG\035\012" +
 		" .                      - Display state of CPU\012" +
-		" B #                    - Boot from device #\012" +
+		" B <dev>                - Boot from device code or name, eg. B DPF, B DPJ0\012" +
 		" CO                     - COntinue CPU Processing\012" +
 		" E A <#> | M [addr] | P - Examine/Modify Acc/Memory/PC\012" +
-		" HE                     - HElp (show this)\012" +
-		" RE                     - REset the system\012" +
+		" HE [2|3]               - HElp (show this, or page 2 or 3)\012" +
+		" RE [IO|CPU|POWER]      - REset I/O, CPU or whole system (default POWER)\012" +
 		" SS                     - Single Step one instruction\012" +
 		" ST <addr>              - STart processing at specified address\012")
 	tto.PutString("\012                          \024Emulator Commands\025\012" +
-		" ATT <dev> <file> [RW]  - ATTach the image file to named device (RO)\012" +
+		" ATT <dev>[:u] <file> [RW|RO] - ATTach image file to device/unit\012" +
 		" BREAK/NOBREAK <addr>   - Set or clear a BREAKpoint\012" +
-		" CHECK                  - CHECK validity of attached TAPE image\012" +
-		" CREATE DPF|DSKP <file> - CREATE an empty/unformatted disk image\012" +
-		" DET <dev>              - DETach any image file from the device\012" +
+		" CHECK [MTB[1][:u]]     - CHECK validity of attached TAPE image\012" +
+		" CREATE DPF|DSKP <file> [TYPE <m>|GEOMETRY <c> <h> <s>|SIZE <n>MB] - CREATE empty disk image\012" +
+		" CREATE MTB <file>      - CREATE a blank tape image\012" +
+		" DET <dev>[:u]          - DETach any image file from the device/unit\012" +
 		" DIS <from> <to>|+<#>   - DISassemble physical memory range or # from PC\012" +
-		" DO <file>              - DO (i.e. run) emulator commands from script <file>\012" +
+		" DO <file> [<args>]     - DO (i.e. run) emulator commands from script <file>\012" +
 		" EXIT                   - EXIT the emulator\012" +
-		" LOAD <file>            - Load ASCII octal file directly into memory\012" +
 		" SET LOGGING ON|OFF     - Turn on or off debug logging (logs dumped end of run)\012" +
-		" SHOW BREAK/DEV/LOGGING - SHOW list of BREAKpoints/DEVices configured\012")
+		" SHOW BREAK/CONFIG/DEV/DISKTYPES/LOGGING/LPT - SHOW settings\012")
+}
+
+// showHelp2 - Display the second page of Emulator help
+func showHelp2() {
+	tto.PutString("\014                       \024Emulator Commands (page 2)\025" +
+		"                         \034MV/EMG\035\012" +
+		" ATT <dsk> <f> OVERLAY <ovl> - ATTach disk with copy-on-write overlay(s)\012" +
+		" ATT <dsk> <f.zst> WRITEBACK - ATTach compressed disk, keeping changes on DET\012" +
+		" ATT MTB[:u] DIR:<dir> [<manifest>] - ATTach host directory as a tape\012" +
+		" ATT MTB[:u] <f> CAPACITY <n>MB - ATTach tape with end-of-tape after <n>MB\012" +
+		" ATT LPT <file> [PAGES] [JOBS [<s>]] - ATTach host file(s) for printer output\012" +
+		" COMMIT|DISCARD <dsk>      - COMMIT or DISCARD changes in disk's top overlay\012" +
+		" DUMP <from> [<to>]        - DUMP physical memory in current radix and ASCII\012" +
+		" DUMPDIFF <dump1> <dump2>  - Compare two dumps or snapshots word by word\012" +
+		" FIND <val> [<from> <to>]  - FIND locations containing val in physical memory\012" +
+		" IMAGE INFO <file>         - Show type, size and allocation of an image file\012" +
+		" LOAD <file> [fmt] [addr]  - LOAD memory from file, fmt: ASCII|RAW|ABS\012" +
+		" LOADPR <file.PR> [START]  - LOAD a program file into memory, optionally START\012" +
+		" MKTAPE <manifest.csv> <tape> - MaKe a SimH TAPE image from a CSV manifest\012" +
+		" SAVE <from> <to> <file> [fmt] - SAVE physical memory range to file\012" +
+		" SNAPSHOT SAVE|LOAD <file> - SAVE or LOAD a snapshot of the whole machine\012" +
+		" TAPE LIST <tape>          - LIST the files on a tape image (not ATTached)\012" +
+		" TAPE EXTRACT <tape> <fileno> <file> - EXTRACT a file from a tape image\012" +
+		" TAPE CONVERT <in> <out> SIMH|E11|AWS|RAW - CONVERT a tape image's format\012")
+}
+
+// showHelp3 - Display the third page of Emulator help
+func showHelp3() {
+	tto.PutString("\014                       \024Emulator Commands (page 3)\025" +
+		"                         \034MV/EMG\035\012" +
+		" ATT PTR <file>            - ATTach a paper tape to the reader, B PTR loads it\012" +
+		" B PROGRAM <f> [fmt] [addr] - Clear memory, LOAD file and set PC to start addr\012" +
+		" ATT PTP <file>            - ATTach host file for paper tape punch output\012" +
+		" POWERFAIL                 - Raise power-fail interrupt and COntinue the CPU\012" +
+		" POWERRESTORE              - Restore power, reset and auto-restart at 0\012" +
+		" SET VAR <name> [<value>]  - SET a variable for DO scripts, used as $<name>\012" +
+		" In DO scripts: IF <cond>/ELSE/ENDIF, :<label>, GOTO <label>, ECHO <text>,\012" +
+		"                ON ERROR ABORT|CONTINUE, $1..$9 are the DO arguments\012")
 }
 
 // Show various emulator states to the user
 func show(cmd []string) {
 	if len(cmd) == 1 {
-		tto.PutNLString(" *** SHOW requires argument ***")
+		cmdError(" *** SHOW requires argument ***")
 		return
 	}
 	switch cmd[1] {
 	case "DEV":
 		tto.PutNLString(bus.GetPrintableDevList())
+		if isConfigured("RTC") {
+			tto.PutNLString(rtc.rtcStatus())
+		}
+		if isConfigured("PIT") {
+			tto.PutNLString(pit.pitStatus())
+		}
+		if isConfigured("PTR") {
+			tto.PutNLString(ptr.ptrStatus())
+		}
+		if isConfigured("PTP") {
+			tto.PutNLString(ptp.ptpStatus())
+		}
+		for _, dev := range machineConfig.Devices {
+			if tmx, ok := tmxControllers[dev.code]; ok {
+				tto.PutString(tmx.tmxStatus())
+			}
+		}
+		tto.PutString(diskMountStatus())
+	case "DISKTYPES":
+		tto.PutString(printableDiskModels())
 	case "BREAK":
 		tto.PutNLString(printableBreakpointList())
+	case "CONFIG":
+		tto.PutString(printableMachineConfig())
+	case "LPT":
+		tto.PutNLString(lpt.lptStatus())
 	case "LOGGING":
 		resp := fmt.Sprintf("Logging is currently turned %s", memory.BoolToOnOff(debugLogging))
 		tto.PutNLString(resp)
 	default:
-		tto.PutNLString(" *** Invalid SHOW type ***")
+		cmdError(" *** Invalid SHOW type ***")
 	}
 }
 
@@ -755,22 +1204,22 @@ func singleStep() {
 		if cpu.Execute(iPtr) {
 			tto.PutString(cpu.PrintableStatus())
 		} else {
-			tto.PutNLString(" *** Error: could not execute instruction")
+			cmdError(" *** Error: could not execute instruction")
 		}
 	} else {
-		tto.PutNLString(" *** Error: could not decode opcode")
+		cmdError(" *** Error: could not decode opcode")
 	}
 }
 
 // start running at user-provided PC
 func start(cmd []string) {
 	if len(cmd) < 2 {
-		tto.PutNLString(" *** ST command requires start address ***")
+		cmdError(" *** ST command requires start address ***")
 		return
 	}
 	newPc, err := strconv.ParseInt(cmd[1], inputRadix, 16)
 	if err != nil || newPc < 0 {
-		tto.PutNLString(" *** Could not parse new PC value ***")
+		cmdError(" *** Could not parse new PC value ***")
 		return
 	}
 	cpu.SetPC(dg.PhysAddrT(newPc))
@@ -787,16 +1236,21 @@ func run() {
 	cpu.PrepToRun()
 
 	startTime := time.Now()
+	stopMonitor := make(chan struct{})
+	go haltMonitor(stopMonitor, cpu.GetInstrCount())
 
-	errDetail, instrCounts := cpu.Run(disassembly, deviceMap, breakpoints, inputRadix, &tto)
+	reason, errDetail, instrCounts := runCPU(disassembly)
 
+	close(stopMonitor)
 	cpu.SetSCPIO(true)
+	recordHalt(reason, errDetail)
 
 	runTime := time.Since(startTime).Seconds()
-	avgMips := float64(cpu.GetInstrCount()/1000000) / runTime
+	avgMips := float64(instrCount()/1000000) / runTime
 
 	// run halted due to either error or console escape
 	log.Println(errDetail)
+	log.Printf("INFO: CPU halt reason: %s\n", lastHalt)
 	tto.PutNLString(errDetail)
 	if debugLogging {
 		logging.DebugPrint(logging.DebugLog, "%s\n", cpu.PrintableStatus())
@@ -807,7 +1261,7 @@ func run() {
 	log.Println(errDetail)
 	tto.PutNLString(errDetail)
 
-	errDetail = fmt.Sprintf(" *** MV/Em executed %d instructions, average MIPS: %.1f ***", cpu.GetInstrCount(), avgMips)
+	errDetail = fmt.Sprintf(" *** MV/Em executed %d instructions, average MIPS: %.1f ***", instrCount(), avgMips)
 	log.Println(errDetail)
 	tto.PutNLString(errDetail)
 
@@ -21,8 +21,860 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/memory"
+)
 
 func TestDummy(t *testing.T) {
 
 }
+
+func TestAbsRoundTrip(t *testing.T) {
+	words := make([]dg.WordT, 40)
+	for ix := range words {
+		words[ix] = dg.WordT(ix * 0101)
+	}
+	data := absEncode(0400, words, 0400)
+	blocks, start, err := absDecode(append(make([]byte, 10), data...))
+	if err != nil {
+		t.Fatalf("absDecode failed: %s", err)
+	}
+	if start != 0400 {
+		t.Errorf("Expected start address 0400, got %#o", start)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("Expected 3 blocks, got %d", len(blocks))
+	}
+	ix := 0
+	for _, blk := range blocks {
+		if blk.origin != dg.PhysAddrT(0400+ix) {
+			t.Errorf("Expected block origin %#o, got %#o", 0400+ix, blk.origin)
+		}
+		for _, w := range blk.data {
+			if w != words[ix] {
+				t.Errorf("Word %d: expected %#o, got %#o", ix, words[ix], w)
+			}
+			ix++
+		}
+	}
+	gap := append(append(data[:38:38], 0, 0), data[38:]...) // nulls after the first block
+	if _, _, err = absDecode(gap); err == nil {
+		t.Error("Expected nulls between blocks to be rejected")
+	}
+	data[7]++ // corrupt the first data word
+	if _, _, err = absDecode(data); err == nil {
+		t.Error("Expected checksum error not detected")
+	}
+}
+
+func TestLoadNovaDiagCSV(t *testing.T) {
+	// the start of NOVA800LT.CSV as loaded by scripts/NOVA800LT.DO - octal address,contents with DOS line endings
+	csv := "000400,060177\r\n000401,020420\r\n000402,004405\r\n\r\n000403,177777\r\n"
+	words, err := parseASCII(strings.NewReader(csv), 0)
+	if err != nil {
+		t.Fatalf("parseASCII failed: %s", err)
+	}
+	expected := []asciiWordT{{0400, 060177}, {0401, 020420}, {0402, 004405}, {0403, 0177777}}
+	if len(words) != len(expected) {
+		t.Fatalf("Expected %d words, got %d", len(expected), len(words))
+	}
+	for ix, w := range words {
+		if w != expected[ix] {
+			t.Errorf("Word %d: expected %#o,%#o got %#o,%#o", ix, expected[ix].addr, expected[ix].val, w.addr, w.val)
+		}
+	}
+	if _, err = parseASCII(strings.NewReader("000400,0200000\n"), 0); err == nil {
+		t.Error("Expected oversized contents to be rejected")
+	}
+}
+
+func TestOverlayChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "BASE.DSKP")
+	lowerOvl := filepath.Join(dir, "lower.ovl")
+	topOvl := filepath.Join(dir, "top.ovl")
+	if err = ioutil.WriteFile(base, make([]byte, 8*diskSectorBytes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sect := make([]byte, diskSectorBytes)
+	lower, err := openOverlayFile(lowerOvl, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sect[0] = 0xAA
+	lower.write(2, sect)
+	lower.close()
+	img, err := openOverlayImage(base, []string{lowerOvl, topOvl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.readSector(2, sect); sect[0] != 0xAA {
+		t.Error("Expected sector 2 from the lower overlay")
+	}
+	sect[0], sect[10] = 0, 0x55
+	img.writeSector(5, sect)
+	sect[10] = 0x56
+	img.writeSector(5, sect)
+	img.close()
+	// the sector is rewritten in place, and the file mode is kept
+	os.Chmod(topOvl, 0640)
+	if fi, _ := os.Stat(topOvl); fi.Size() != int64(len(overlayMagic)+overlayRecordBytes) {
+		t.Errorf("Expected one record in top overlay, file is %d bytes", fi.Size())
+	}
+	// a record left incomplete, as if the emulator died while appending it, is dropped
+	f, _ := os.OpenFile(topOvl, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write(make([]byte, 100))
+	f.Close()
+	if img, err = openOverlayImage(base, []string{lowerOvl, topOvl}); err != nil {
+		t.Fatal(err)
+	}
+	defer img.close()
+	if img.readSector(5, sect); sect[10] != 0x56 {
+		t.Error("Expected the latest sector 5 from the top overlay")
+	}
+	if fi, _ := os.Stat(topOvl); fi.Size() != int64(len(overlayMagic)+overlayRecordBytes) || fi.Mode().Perm() != 0640 {
+		t.Errorf("Expected incomplete record dropped and mode kept, got %d bytes, mode %v", fi.Size(), fi.Mode())
+	}
+	if err = img.discard(); err != nil {
+		t.Fatal(err)
+	}
+	if img.readSector(5, sect); sect[10] != 0 {
+		t.Error("Expected sector 5 from the base after DISCARD")
+	}
+	sect[0] = 0x66
+	img.writeSector(6, sect)
+	if err = img.commit(base); err != nil {
+		t.Fatal(err)
+	}
+	if len(img.top.index) != 0 || len(img.lower[0].index) != 2 {
+		t.Errorf("Expected sector committed into lower overlay, top has %d, lower %d sectors", len(img.top.index), len(img.lower[0].index))
+	}
+	if img.readSector(6, sect); sect[0] != 0x66 {
+		t.Error("Expected committed sector 6 from the lower overlay")
+	}
+	baseData, _ := ioutil.ReadFile(base)
+	if baseData[2*diskSectorBytes] != 0 || baseData[6*diskSectorBytes] != 0 {
+		t.Error("Base image was modified")
+	}
+}
+
+func TestCreateSparseDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	img := filepath.Join(dir, "blank.DSKP")
+	geom, err := parseDiskSize("DSKP", []string{"GEOMETRY", "10", "2", "20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = createDiskImage(img, geom.sizeBytes()); err != nil {
+		t.Fatal(err)
+	}
+	if createDiskImage(img, geom.sizeBytes()) == nil {
+		t.Error("Existing image was overwritten")
+	}
+	fi, err := os.Stat(img)
+	if err != nil || fi.Size() != 10*2*20*diskSectorBytes {
+		t.Fatalf("Image is the wrong size")
+	}
+	if alloc, ok := allocatedBytes(fi); ok && alloc >= fi.Size() {
+		t.Errorf("Expected a sparse image, %d. of %d. bytes allocated", alloc, fi.Size())
+	}
+	if diskTypeBySize(nativeDiskModel("DSKP").sizeBytes()) != "DSKP disk image (model 6239)" {
+		t.Errorf("Native image type not recognised, got %s", diskTypeBySize(nativeDiskModel("DSKP").sizeBytes()))
+	}
+	if _, err = parseDiskSize("DPF", []string{"TYPE", "6239"}); err == nil {
+		t.Error("Expected error for DSKP drive type on DPF")
+	}
+	if _, err = parseDiskSize("DPF", []string{"SIZE", "300MB"}); err == nil {
+		t.Error("Expected error for DPF too large to address")
+	}
+	// a larger image keeps the native heads and sectors, a smaller one is the native drive
+	if geom, _ = imageGeometry("DSKP", 700*1024*1024); geom.heads != 16 || geom.sectors != 75 || geom.sizeBytes() < 700*1024*1024 {
+		t.Errorf("Unexpected geometry for large image: %s", geom.String())
+	}
+	if geom, _ = imageGeometry("DPF", 1024); !geom.native || geom.model != "6061" {
+		t.Errorf("Expected native geometry for small image, got %s", geom.String())
+	}
+}
+
+func TestCompressedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plain := filepath.Join(dir, "disk.DSKP")
+	data := make([]byte, 4*diskSectorBytes)
+	data[diskSectorBytes+3] = 0x42
+	if err = ioutil.WriteFile(plain, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{gzipExt, zstdExt} {
+		if err = compressImage(plain, plain+ext); err != nil {
+			t.Fatal(err)
+		}
+		work, err := copyToWorkFile(plain + ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadFile(work)
+		os.Remove(work)
+		if !bytes.Equal(got, data) {
+			t.Errorf("Decompressed %s image does not match original", ext)
+		}
+	}
+}
+
+func TestUnchangedCompressedImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plain := filepath.Join(dir, "disk.DPF")
+	if err = ioutil.WriteFile(plain, make([]byte, 4*diskSectorBytes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	image := plain + zstdExt
+	if err = compressImage(plain, image); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat(image)
+	mount := diskMountT{baseFile: image, compressed: true, writeBack: true}
+	if mount.workFile, err = copyToWorkFile(image); err != nil {
+		t.Fatal(err)
+	}
+	if mount.plain, err = openFileImage(mount.workFile, false); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, diskSectorBytes)
+	mount.plain.readSector(2, buf)
+	mount.plain.close()
+	if !mount.release() {
+		t.Error("Release failed")
+	}
+	after, _ := os.Stat(image)
+	if !os.SameFile(before, after) {
+		t.Error("Unchanged compressed image was rewritten")
+	}
+	if _, err = os.Stat(mount.workFile); !os.IsNotExist(err) {
+		t.Error("Working copy was not removed")
+	}
+}
+
+func TestZstdFixture(t *testing.T) {
+	// testdata/lines.txt.zst was made by the zstd tool with: zstd -19
+	rc, err := openImage(filepath.Join("testdata", "lines.txt.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Decompression failed: %s", err)
+	}
+	var expected bytes.Buffer
+	for i := 0; i < 3000; i++ {
+		fmt.Fprintf(&expected, "%05d: THE QUICK BROWN FOX JUMPS OVER THE LAZY DOG %d\n", i, i*i%997)
+	}
+	if !bytes.Equal(got, expected.Bytes()) {
+		t.Errorf("Expected %d bytes of text, got %d which differ", expected.Len(), len(got))
+	}
+}
+
+func TestBuildTape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "A"), make([]byte, 5), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "B"), make([]byte, 4), 0644)
+	manifest := filepath.Join(dir, "test.csv")
+	ioutil.WriteFile(manifest, []byte("A,4\nB,4\n"), 0644)
+	tape := filepath.Join(dir, "test.9trk")
+	if _, err = buildTape(manifest, tape); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(tape)
+	// A: 4-byte record, 1-byte record padded, mark; B: 4-byte record, mark; final mark
+	expectedLen := (4 + 4 + 4) + (4 + 2 + 4) + 4 + (4 + 4 + 4) + 4 + 4
+	if len(got) != expectedLen {
+		t.Errorf("Expected tape image of %d bytes, got %d", expectedLen, len(got))
+	}
+	files, err := scanTape(tape, -1, nil)
+	if err != nil || len(files) != 2 || files[0].records != 2 || files[0].bytes != 5 {
+		t.Errorf("Tape scan did not match manifest, got %+v, %v", files, err)
+	}
+	if n, err := extractTapeFile(tape, 1, filepath.Join(dir, "B.out")); err != nil || n != 4 {
+		t.Errorf("Could not extract file 1, got %d bytes, %v", n, err)
+	}
+	// round trip through the other formats
+	prev := tape
+	for _, format := range []string{tapeFmtAWS, tapeFmtE11, tapeFmtRaw, tapeFmtSimH} {
+		next := filepath.Join(dir, "test."+format)
+		if _, err = convertTape(prev, next, format); err != nil {
+			t.Fatalf("Could not convert to %s: %v", format, err)
+		}
+		if detected, _, _ := detectTapeFormat(next); detected != format {
+			t.Errorf("Expected %s format, detected %s", format, detected)
+		}
+		prev = next
+	}
+	if final, _ := ioutil.ReadFile(prev); !bytes.Equal(final, got) {
+		t.Error("Tape changed after conversion round trip")
+	}
+}
+
+func TestTapeFormatSniff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var img bytes.Buffer
+	for rec := 0; rec < 2*tapeSniffRecords; rec++ {
+		writeSimhRecord(&img, make([]byte, 2048), true)
+	}
+	writeSimhMark(&img)
+	tape := filepath.Join(dir, "tail.9trk")
+	// a damaged tail beyond the records sniffed does not matter
+	if err = ioutil.WriteFile(tape, append(img.Bytes(), 1, 2, 3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if format, recognised, err := detectTapeFormat(tape); err != nil || !recognised || format != tapeFmtSimH {
+		t.Errorf("Expected recognised SimH image, got %s %v %v", format, recognised, err)
+	}
+	// a damaged image is still taken to be SimH
+	if err = ioutil.WriteFile(tape, img.Bytes()[:100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if format, recognised, err := detectTapeFormat(tape); err != nil || recognised || format != tapeFmtSimH {
+		t.Errorf("Expected unrecognised image assumed SimH, got %s %v %v", format, recognised, err)
+	}
+}
+
+func TestParseDump(t *testing.T) {
+	hdr := func(recType, recLen int) []byte { return []byte{byte(recType<<2 | recLen>>8), byte(recLen)} }
+	var dump []byte
+	dump = append(dump, hdr(dumpStartType, dumpStartRecBytes)...)
+	dump = append(dump, 0, 16, 0, 1, 0, 2, 0, 3, 0, 19, 0, 10, 0, 120)
+	dump = append(dump, hdr(dumpNameType, 6)...)
+	dump = append(dump, "FRED\000\000"...)
+	dump = append(dump, hdr(dumpDataBlkType, 0)...)
+	dump = append(dump, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 'A', 'B', 'C')
+	dump = append(dump, hdr(dumpEndBlkType, 0)...)
+	dump = append(dump, hdr(dumpEndType, 0)...)
+	if !looksLikeDumpStart(dump) {
+		t.Fatal("Start of dump not recognised")
+	}
+	entries, err := parseDump(bytes.NewReader(dump))
+	if err != nil || len(entries) != 1 || entries[0].name != "FRED" || entries[0].bytes != 3 {
+		t.Errorf("Unexpected dump listing %+v, %v", entries, err)
+	}
+}
+
+func TestDirectoryTape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "B"), []byte("BBBB"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "A"), []byte("AAAA"), 0644)
+	entries, err := dirTapeEntries(dir, "")
+	if err != nil || len(entries) != 2 || filepath.Base(entries[0].fileName) != "A" {
+		t.Fatalf("Unexpected directory tape entries %+v, %v", entries, err)
+	}
+	mount := tapeMountT{dir: dir}
+	if mount.workFile, err = dirToWorkFile(entries); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(mount.workFile)
+	if mount.dirFiles, err = scanTape(mount.workFile, -1, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the guest spaces over the two files and writes a third over the end-of-tape mark
+	f, err := os.OpenFile(mount.workFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tape tape6026T
+	tape.drives[0] = tape6026DriveT{f: f, capacity: tape6026DefaultCapacity}
+	drv := &tape.drives[0]
+	tape.spaceFwd(drv)
+	tape.spaceFwd(drv)
+	tape.writeTape(drv, func(w io.Writer) error { return writeSimhRecord(w, []byte("CCCCCC"), true) })
+	tape.writeTape(drv, writeSimhMark)
+	tape.writeTape(drv, writeSimhMark)
+	f.Close()
+	if _, err = mount.saveDirFiles(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "TAPEFILE002"))
+	if err != nil || string(got) != "CCCCCC" {
+		t.Errorf("New tape file not saved, got %q, %v", got, err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "TAPEFILE000")); err == nil {
+		t.Error("Unchanged tape file was saved")
+	}
+}
+
+func TestLptPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := lptT{fileName: filepath.Join(dir, "out.txt"), pages: true, jobNo: 1, pageNo: 1}
+	for _, ch := range []byte("ONE\012\014TWO\012") {
+		p.print(ch)
+	}
+	p.closeOutput()
+	for page, expected := range []string{"ONE\012", "TWO\012"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("out-p%04d.txt", page+1)))
+		if err != nil || string(got) != expected {
+			t.Errorf("Page %d: expected %q, got %q, %v", page+1, expected, got, err)
+		}
+	}
+}
+
+func TestTmxConfigLines(t *testing.T) {
+	cfg := defaultMachineConfig()
+	cfg.Devices = []configDeviceT{{Type: "TMX", Lines: []string{"localhost:10001", "pty"}}}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("Expected valid TMX config, got %v", err)
+	}
+	cfg.Devices = []configDeviceT{{Type: "TMX"}}
+	if err := cfg.validate(); err == nil {
+		t.Error("Expected TMX with no Lines to be rejected")
+	}
+	cfg.Devices = []configDeviceT{{Type: "LPT", Lines: []string{"pty"}}}
+	if err := cfg.validate(); err == nil {
+		t.Error("Expected Lines on LPT to be rejected")
+	}
+}
+
+func TestMachineConfigDevices(t *testing.T) {
+	cfg := defaultMachineConfig()
+	cfg.Devices = []configDeviceT{
+		{Type: "DPF", Code: "047"},
+		{Type: "DPF", Code: "027", Attach: []configAttachT{{File: "DISK.DPF", RO: true}}},
+		{Type: "MTB", Attach: []configAttachT{{Unit: 7, File: "T.9trk", RW: true}}},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Expected valid config, got %v", err)
+	}
+	if cfg.Devices[0].ctrlr != devDPF1 || cfg.Devices[0].code != 047 ||
+		cfg.Devices[1].ctrlr != devDPF || cfg.Devices[1].code != devDPF || cfg.Devices[2].code != devMTB {
+		t.Errorf("Expected DPF1 at 047, DPF at 027 and MTB at 022, got %+v", cfg.Devices)
+	}
+	bad := []machineConfigT{cfg, cfg, cfg, cfg, cfg}
+	bad[0].MemSizeWords = 100000
+	bad[1].Devices = []configDeviceT{{Type: "DPF"}, {Type: "DPF"}, {Type: "DPF"}}
+	bad[2].Devices = []configDeviceT{{Type: "DPF", Code: "010"}}
+	bad[3].Devices = []configDeviceT{{Type: "MTB", Attach: []configAttachT{{File: "T.9trk", RW: true, RO: true}}}}
+	bad[4].Devices = []configDeviceT{{Type: "LPT", Attach: []configAttachT{{File: "LPT.txt", RO: true}}}}
+	for ix, cfg := range bad {
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected bad config %d to be rejected", ix)
+		}
+	}
+}
+
+func TestTmxScanner(t *testing.T) {
+	p := &tmxT{lines: make([]tmxLineT, 2), svcSlot: -1}
+	p.lines[0].txIdle, p.lines[1].txIdle = true, true
+	if slot := p.nextRequest(); slot != -1 {
+		t.Errorf("Expected no request from disabled lines, got slot %d", slot)
+	}
+	p.curLine = 1
+	p.control(tmxCtlDTR | tmxCtlRxEnable | tmxCtlTxEnable)
+	p.lines[1].input = []byte("A")
+	if slot := p.nextRequest(); slot != 2 {
+		t.Errorf("Expected line 1 receiver (slot 2), got %d", slot)
+	}
+	if datum := p.receive(); datum != 'A' {
+		t.Errorf("Expected received 'A', got %#o", datum)
+	}
+	if slot := p.nextRequest(); slot != 3 {
+		t.Errorf("Expected idle line 1 transmitter (slot 3), got %d", slot)
+	}
+	p.lines[1].output = make(chan byte, 1)
+	p.transmit('B')
+	p.transmit('C')
+	if p.lines[1].txIdle || p.lines[1].txChars != 1 || p.lines[1].txDropped != 1 {
+		t.Errorf("Expected one character queued and one dropped, got %+v", p.lines[1])
+	}
+	if c := <-p.lines[1].output; c != 'B' {
+		t.Errorf("Expected 'B' queued, got %q", c)
+	}
+}
+
+func TestDpfWriteProtect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	imgName := filepath.Join(dir, "RO.DPF")
+	if err := ioutil.WriteFile(imgName, make([]byte, diskSectorBytes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	image, err := openFileImage(imgName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.close()
+	var disk disk6061T
+	disk.sectBuff = make([]byte, disk6061BytesPerSect)
+	disk.drives[1] = disk6061DriveT{image: image, readOnly: true}
+	disk.drive, disk.command, disk.sectCnt = 1, disk6061CmdWrite, -1
+	disk.disk6061DoCommand()
+	if disk.drives[1].driveStatus&disk6061Writefault == 0 ||
+		disk.rwStatus != disk6061Rwdone|disk6061Rwfault || disk.writes != 0 {
+		t.Errorf("Expected write to read-only drive to fault, got drive status %#o, R/W status %#o", disk.drives[1].driveStatus, disk.rwStatus)
+	}
+}
+
+func TestTapeWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	imgName := filepath.Join(dir, "SCRATCH.9trk")
+	if err = createTapeImage(imgName); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(imgName, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var tape tape6026T
+	tape.drives[0] = tape6026DriveT{f: f, fileName: imgName, capacity: 20}
+	drv := &tape.drives[0]
+	writeRec := func(data string) dg.WordT {
+		return tape.writeTape(drv, func(w io.Writer) error { return writeSimhRecord(w, []byte(data), true) })
+	}
+	if _, _, _, err = tape.readRecord(drv); err != io.EOF {
+		t.Errorf("Expected blank tape to read as end of tape, got %v", err)
+	}
+	writeRec("ABCD")
+	tape.writeTape(drv, writeSimhMark)
+	writeRec("EFGH")
+	if tape.status()&(tape6026Sr1EOT|tape6026Sr1Error) != tape6026Sr1EOT|tape6026Sr1Error {
+		t.Errorf("Expected EOT after writing past capacity, got %s", tape6026ReadableSR1(tape.status()))
+	}
+	// back over the last record, then over the tape mark
+	tape.negWordCnt = -1
+	if cond := tape.spaceRev(drv); cond != tape6026Sr1StatusChanged || drv.pos != 16 {
+		t.Errorf("Space reverse over record got %#o at %d.", cond, drv.pos)
+	}
+	tape.negWordCnt = -1
+	if cond := tape.spaceRev(drv); cond&tape6026Sr1EOF == 0 || drv.pos != 12 {
+		t.Errorf("Space reverse over tape mark got %#o at %d.", cond, drv.pos)
+	}
+	// overwriting the mark loses the rest of the tape
+	writeRec("IJ")
+	drv.pos = 0
+	var got []string
+	for {
+		data, mark, _, err := tape.readRecord(drv)
+		if err != nil || mark {
+			break
+		}
+		got = append(got, string(data))
+	}
+	if strings.Join(got, ",") != "ABCD,IJ" {
+		t.Errorf("Expected records ABCD,IJ got %v", got)
+	}
+	drv.readOnly = true
+	if cond := writeRec("XX"); cond != tape6026Sr1Illegal || tape.status()&tape6026Sr1WriteLock == 0 {
+		t.Errorf("Expected write to a write-locked tape to fail, got %#o", cond)
+	}
+}
+
+func TestParseBootDevice(t *testing.T) {
+	tests := []struct {
+		arg    string
+		devNum int
+		unit   int
+	}{
+		{"27", devDPF, 0},
+		{"DPF1", devDPF1, 0},
+		{"MTB:2", devMTB, 2},
+		{"DPJ0", devDSKP, 0},
+		{"DPJ1", devDSKP, 1},
+		{"DPF1:3", devDPF1, 3},
+		{"DPJ10", devDSKP1, 0},
+		{"MTB10", devMTB1, 0},
+	}
+	for _, tt := range tests {
+		du, err := parseBootDevice(tt.arg, 8)
+		if err != nil || du.devNum != tt.devNum || du.unit != tt.unit {
+			t.Errorf("%s: expected device %#o unit %d, got %#o unit %d, %v", tt.arg, tt.devNum, tt.unit, du.devNum, du.unit, err)
+		}
+	}
+	for _, arg := range []string{"DPJ", "DPJ4", "DPF:4", "DPJ20", "XYZ0", "0100"} {
+		if _, err := parseBootDevice(arg, 8); err == nil {
+			t.Errorf("%s: expected an error", arg)
+		}
+	}
+}
+
+func TestScriptSubstitution(t *testing.T) {
+	args := []string{"SETUP.DO", "DEBUG", "tapes/STARTER.9trk"}
+	vars := map[string]string{"DISK": "disks/DISK1.DPF"}
+	tests := []struct{ line, expected string }{
+		{"ATT MTB $2 # the tape", "ATT MTB tapes/STARTER.9trk "},
+		{"ATT DPF $DISK RW", "ATT DPF disks/DISK1.DPF RW"},
+		{"ECHO ${DISK}X $$1 $3.", "ECHO disks/DISK1.DPFX $1 ."},
+		{"# just a comment", ""},
+		{"LOAD prog#1.CSV", "LOAD prog#1.CSV"},
+	}
+	for _, tt := range tests {
+		if got := substituteVars(stripComment(tt.line), args, vars); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.line, tt.expected, got)
+		}
+	}
+	if cond, err := evalCondition([]string{`"$1"`, "EQ", `""`}); err != nil || cond {
+		t.Errorf("Expected false, got %v, %v", cond, err)
+	}
+	if cond, err := evalCondition([]string{`""`, "EQ", `""`}); err != nil || !cond {
+		t.Errorf("Expected true, got %v, %v", cond, err)
+	}
+	if labels, err := scriptLabels([]string{"IF PC EQ 0", "GOTO END", "ENDIF", ":END # done"}); err != nil || labels["END"] != 3 {
+		t.Errorf("Expected label END at 3, got %v, %v", labels, err)
+	}
+	if _, err := scriptLabels([]string{"IF PC EQ 0", ":LOOP", "ENDIF"}); err == nil {
+		t.Error("Expected a label inside an IF to be rejected")
+	}
+	for _, words := range [][]string{{"HALT"}, {"HALT", `""`}} {
+		if _, err := evalCondition(words); err == nil {
+			t.Errorf("%v: expected an empty HALT condition to be rejected", words)
+		}
+	}
+}
+
+func TestClassifyHalt(t *testing.T) {
+	tests := []struct {
+		requested    haltReasonT
+		atBreakpoint bool
+		atHalt       bool
+		expected     haltReasonT
+		exitCode     int
+	}{
+		{haltNone, true, false, haltBreakpoint, 3},
+		{haltNone, false, true, haltInstruction, 4},
+		{haltNone, false, false, haltUnimplemented, 5},
+		{haltConsoleEscape, false, false, haltConsoleEscape, 6},
+		{haltInstrLimit, true, false, haltInstrLimit, 7},
+		{haltWatchdog, false, true, haltWatchdog, 8},
+	}
+	defer func() { lastHalt = haltNone }()
+	for _, tt := range tests {
+		lastHalt = classifyHalt(tt.requested, tt.atBreakpoint, tt.atHalt)
+		if lastHalt != tt.expected || batchExitCode() != tt.exitCode {
+			t.Errorf("%v: expected %s (exit %d), got %s (exit %d)", tt, tt.expected, tt.exitCode, lastHalt, batchExitCode())
+		}
+	}
+}
+
+func TestDeterministicInterrupts(t *testing.T) {
+	type decodedT struct {
+		mnemonic string
+		ix       int
+	}
+	if ix := instrIndex(&decodedT{ix: 42}); ix != 42 {
+		t.Errorf("Expected instruction index 42, got %d", ix)
+	}
+	if ix := instrIndex(42); ix != -1 {
+		t.Errorf("Expected no instruction index for a non-instruction, got %d", ix)
+	}
+	memory.MemInit(MemSizeWords, false)
+	memory.WriteWord(interruptJump, 0100)
+	if handler, err := interruptHandler(0x3000_0000); err != nil || handler != 0x3000_0000|0100 {
+		t.Errorf("Expected handler at 0100 in ring 3, got %#o, %v", handler, err)
+	}
+	// as in mvcpu's Run, the indirect vector is followed through doublewords
+	memory.WriteWord(interruptJump, 0100200)
+	memory.WriteWord(0100200, 0)
+	memory.WriteWord(0100201, 0300)
+	if handler, err := interruptHandler(0); err != nil || handler != 0300 {
+		t.Errorf("Expected indirect handler at 0300, got %#o, %v", handler, err)
+	}
+}
+
+func TestSnapshotControllerState(t *testing.T) {
+	var tape tape6026T
+	tape.command, tape.memAddr, tape.drives[3].pos, tape.drives[3].unloaded = tape6026CmdWrite, 01234, 4096, true
+	st := tape.tape6026State()
+	var tape2 tape6026T
+	tape2.tape6026Restore(st)
+	if tape2.command != tape6026CmdWrite || tape2.memAddr != 01234 || tape2.drives[3].pos != 4096 || !tape2.drives[3].unloaded {
+		t.Errorf("Expected tape registers to be restored, got %+v", tape2.tape6026State())
+	}
+	var disk disk6061T
+	disk.drive, disk.sectCnt, disk.drives[2].cylinder, disk.drives[2].writeDisabled = 2, -3, 0321, true
+	var disk2 disk6061T
+	disk2.disk6061Restore(disk.disk6061State())
+	if disk2.disk6061State() != disk.disk6061State() {
+		t.Errorf("Expected DPF registers to be restored, got %+v", disk2.disk6061State())
+	}
+	img := snapshotImageT{FileName: "/nonexistent/tape", Saved: true}
+	if err := img.verify(); err != nil {
+		t.Errorf("Expected a saved tape not to be checked, got %v", err)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mvemgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := filepath.Join(dir, "DISK.DSKP")
+	ovl := filepath.Join(dir, "disk.ovl")
+	if err = ioutil.WriteFile(image, make([]byte, 4*diskSectorBytes), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ovlFile, err := openOverlayFile(ovl, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ovlFile.close()
+	ovlFile.write(1, make([]byte, diskSectorBytes))
+	img := snapshotImageT{Device: "DSKP", FileName: image, Overlays: []string{ovl}}
+	if img.Checksum, err = fileChecksum(image); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fileChecksum(ovl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.OverlaySums = append(img.OverlaySums, sum)
+	snap := snapshotT{
+		Version:   snapshotVersion,
+		PC:        01234,
+		Ac:        [4]dg.DwordT{1, 2, 3, 037777777777},
+		Carry:     true,
+		ION:       true,
+		Lef:       [8]bool{false, false, false, true},
+		MemSize:   MemSizeWords,
+		Memory:    make([]dg.WordT, MemSizeWords),
+		DevBusy:   map[int]bool{devDSKP: true},
+		DevDone:   map[int]bool{devTTO: true},
+		DevMasked: map[int]bool{devTTI: true, devRTC: true},
+		Images:    []snapshotImageT{img},
+	}
+	snap.Memory[0777] = 0177777
+	snapFile := filepath.Join(dir, "test.snap")
+	if err = snapshotWrite(snapFile, &snap); err != nil {
+		t.Fatal(err)
+	}
+	got, err := snapshotRead(snapFile)
+	if err != nil {
+		t.Fatalf("snapshotRead failed: %s", err)
+	}
+	if got.PC != snap.PC || got.Ac != snap.Ac || got.Carry != snap.Carry || got.ION != snap.ION || got.Lef != snap.Lef {
+		t.Errorf("CPU state did not round-trip: %+v", got)
+	}
+	if got.Memory[0777] != 0177777 || !got.DevBusy[devDSKP] || !got.DevDone[devTTO] || !got.DevMasked[devRTC] {
+		t.Error("Memory or device state did not round-trip")
+	}
+	if err = got.Images[0].verify(); err != nil {
+		t.Errorf("Unchanged image failed verification: %s", err)
+	}
+	if mask := interruptMaskWord(got.DevMasked); mask != 1<<(15-14)|1<<(15-13) {
+		t.Errorf("Expected mask word %#o, got %#o", 1<<(15-14)|1<<(15-13), mask)
+	}
+	if err = ovlFile.write(2, make([]byte, diskSectorBytes)); err != nil {
+		t.Fatal(err)
+	}
+	if err = got.Images[0].verify(); err == nil {
+		t.Error("Changed overlay not detected")
+	}
+}
+
+// makeTestPR builds a 32-bit program file with 4 unshared blocks and 2 shared blocks at block 8
+func makeTestPR() []dg.WordT {
+	words := make([]dg.WordT, 10*prBlockWords)
+	words[ustStart+ustRV+1] = 3
+	words[ustStart+ustTC] = 1
+	words[ustStart+ustBL+1] = 4
+	words[ustStart+ustST+1] = 8
+	words[ustStart+ustSZ+1] = 2
+	words[prStartLoc] = 0x7000 // ring 7
+	words[prStartLoc+1] = 01000
+	words[8*prBlockWords] = 0123456
+	return words
+}
+
+func prBytes(words []dg.WordT) []byte {
+	data := make([]byte, len(words)*2)
+	for ix, w := range words {
+		data[ix*2] = byte(w >> 8)
+		data[ix*2+1] = byte(w)
+	}
+	return data
+}
+
+func TestProgramFile(t *testing.T) {
+	pr, err := prDecode(prBytes(makeTestPR()), MemSizeWords)
+	if err != nil {
+		t.Fatalf("prDecode failed: %s", err)
+	}
+	if len(pr.unshared) != 4*prBlockWords || len(pr.shared) != 2*prBlockWords {
+		t.Errorf("Expected 1024. unshared and 512. shared words, got %d. and %d.", len(pr.unshared), len(pr.shared))
+	}
+	if pr.sharedOrigin != 8*prBlockWords || pr.shared[0] != 0123456 {
+		t.Errorf("Shared area loaded at %#o", pr.sharedOrigin)
+	}
+	if pr.startAddr != 01000 || pr.revision != 3 || pr.stackProvided {
+		t.Errorf("Unexpected start %#o, revision %d. or stack", pr.startAddr, pr.revision)
+	}
+	if pr.stackBase != 4*prBlockWords || pr.stackLimit != 8*prBlockWords-1 {
+		t.Errorf("Unexpected stack %#o-%#o", pr.stackBase, pr.stackLimit)
+	}
+
+	bad := makeTestPR()
+	bad[ustStart+ustTC] = 0
+	if _, err = prDecode(prBytes(bad), MemSizeWords); err == nil {
+		t.Error("Expected invalid task count to be rejected")
+	}
+	bad = makeTestPR()
+	bad[ustStart+ustST+1] = 9
+	if _, err = prDecode(prBytes(bad), MemSizeWords); err == nil {
+		t.Error("Expected shared area beyond the file to be rejected")
+	}
+	bad = makeTestPR()
+	bad[prStartLoc+1] = 0
+	if _, err = prDecode(prBytes(bad), MemSizeWords); err == nil {
+		t.Error("Expected missing start address to be rejected")
+	}
+	if _, err = prDecode(prBytes(makeTestPR()), 8*prBlockWords); err == nil {
+		t.Error("Expected program larger than memory to be rejected")
+	}
+	if _, err = prDecode(prBytes(makeTestPR())[:100], MemSizeWords); err == nil {
+		t.Error("Expected partial block to be rejected")
+	}
+}
@@ -0,0 +1,273 @@
+// overlayImages.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// overlayRecordBytes is the size of each record in an overlay file, a sector number followed by the sector's data
+const overlayRecordBytes = 4 + diskSectorBytes
+
+// overlayFileT is an open copy-on-write overlay file.
+//
+// An overlay file is the overlay magic string followed by records of a big-endian 32-bit sector number and the
+// sector's data.  Each sector appears once: a change to a sector already in the overlay is written over its record
+// and a newly changed sector is appended to the file, so each write by the guest is a single write to the file.
+type overlayFileT struct {
+	f     *os.File
+	name  string
+	index map[uint32]int64 // offset of the data of each sector held in the overlay
+	end   int64            // offset of the end of the last record
+}
+
+// openOverlayFile opens an overlay file, a writable overlay is created if it does not exist.  A record which was
+// left incomplete because the emulator died while appending it is dropped from a writable overlay.
+func openOverlayFile(fileName string, readOnly bool) (*overlayFileT, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(fileName, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ovl := &overlayFileT{f: f, name: fileName, index: map[uint32]int64{}, end: int64(len(overlayMagic))}
+	if err = ovl.load(readOnly); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ovl, nil
+}
+
+// load builds the index of the sectors held in the overlay
+func (ovl *overlayFileT) load(readOnly bool) error {
+	fi, err := ovl.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 && !readOnly {
+		// a new overlay
+		_, err = ovl.f.WriteAt([]byte(overlayMagic), 0)
+		return err
+	}
+	rd := bufio.NewReaderSize(io.NewSectionReader(ovl.f, 0, fi.Size()), 64*overlayRecordBytes)
+	magic := make([]byte, len(overlayMagic))
+	if _, err = io.ReadFull(rd, magic); err != nil || string(magic) != overlayMagic {
+		return fmt.Errorf("%s is not an MV/Em overlay file", ovl.name)
+	}
+	rec := make([]byte, overlayRecordBytes)
+	for ovl.end+overlayRecordBytes <= fi.Size() {
+		if _, err = io.ReadFull(rd, rec); err != nil {
+			return err
+		}
+		ovl.index[binary.BigEndian.Uint32(rec)] = ovl.end + 4
+		ovl.end += overlayRecordBytes
+	}
+	if ovl.end < fi.Size() && !readOnly {
+		return ovl.f.Truncate(ovl.end)
+	}
+	return nil
+}
+
+// read fetches a sector from the overlay, returning false if the overlay does not hold it
+func (ovl *overlayFileT) read(sect uint32, buf []byte) (bool, error) {
+	off, held := ovl.index[sect]
+	if !held {
+		return false, nil
+	}
+	_, err := ovl.f.ReadAt(buf, off)
+	return true, err
+}
+
+// write stores a sector in the overlay
+func (ovl *overlayFileT) write(sect uint32, buf []byte) error {
+	if off, held := ovl.index[sect]; held {
+		_, err := ovl.f.WriteAt(buf, off)
+		return err
+	}
+	rec := make([]byte, overlayRecordBytes)
+	binary.BigEndian.PutUint32(rec, sect)
+	copy(rec[4:], buf)
+	if _, err := ovl.f.WriteAt(rec, ovl.end); err != nil {
+		return err
+	}
+	ovl.index[sect] = ovl.end + 4
+	ovl.end += overlayRecordBytes
+	return nil
+}
+
+// reset empties the overlay
+func (ovl *overlayFileT) reset() error {
+	if err := ovl.f.Truncate(int64(len(overlayMagic))); err != nil {
+		return err
+	}
+	ovl.index = map[uint32]int64{}
+	ovl.end = int64(len(overlayMagic))
+	return nil
+}
+
+// sectors returns the numbers of the sectors held in the overlay in ascending order
+func (ovl *overlayFileT) sectors() []uint32 {
+	sects := make([]uint32, 0, len(ovl.index))
+	for sect := range ovl.index {
+		sects = append(sects, sect)
+	}
+	sort.Slice(sects, func(i, j int) bool { return sects[i] < sects[j] })
+	return sects
+}
+
+func (ovl *overlayFileT) close() error {
+	return ovl.f.Close()
+}
+
+// overlayImageT is a disk image made of a base image with a stack of overlays on top of it.  A sector is read from
+// the highest overlay which holds it, or else from the base image; the guest's writes only ever go to the top overlay,
+// so the base image and any lower overlays are never changed by the guest.
+type overlayImageT struct {
+	overlayImageMu sync.Mutex
+	base           *os.File
+	lower          []*overlayFileT // lowest first
+	top            *overlayFileT
+}
+
+// openOverlayImage opens a base image with its overlays, the last of which receives any changes
+func openOverlayImage(baseName string, overlays []string) (img *overlayImageT, err error) {
+	img = &overlayImageT{}
+	defer func() {
+		if err != nil {
+			img.close()
+		}
+	}()
+	if img.base, err = os.Open(baseName); err != nil {
+		return img, err
+	}
+	for _, ovlName := range overlays[:len(overlays)-1] {
+		ovl, err := openOverlayFile(ovlName, true)
+		if err != nil {
+			return img, err
+		}
+		img.lower = append(img.lower, ovl)
+	}
+	img.top, err = openOverlayFile(overlays[len(overlays)-1], false)
+	return img, err
+}
+
+func (img *overlayImageT) readSector(sect int64, buf []byte) error {
+	img.overlayImageMu.Lock()
+	defer img.overlayImageMu.Unlock()
+	if held, err := img.top.read(uint32(sect), buf); held || err != nil {
+		return err
+	}
+	for l := len(img.lower) - 1; l >= 0; l-- {
+		if held, err := img.lower[l].read(uint32(sect), buf); held || err != nil {
+			return err
+		}
+	}
+	n, err := img.base.ReadAt(buf, sect*diskSectorBytes)
+	if err == io.EOF {
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		err = nil
+	}
+	return err
+}
+
+func (img *overlayImageT) writeSector(sect int64, buf []byte) error {
+	img.overlayImageMu.Lock()
+	defer img.overlayImageMu.Unlock()
+	return img.top.write(uint32(sect), buf)
+}
+
+func (img *overlayImageT) close() (err error) {
+	if img.base != nil {
+		err = img.base.Close()
+	}
+	for _, ovl := range append(img.lower, img.top) {
+		if ovl != nil {
+			if cerr := ovl.close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+// commit merges the changes held in the top overlay into the layer beneath it, ie. the next lower overlay or,
+// if there is none, the named base image itself; the top overlay is then emptied.  If the emulator dies part way
+// through, the changes are still held in the top overlay.
+func (img *overlayImageT) commit(baseName string) error {
+	img.overlayImageMu.Lock()
+	defer img.overlayImageMu.Unlock()
+	buf := make([]byte, diskSectorBytes)
+	if len(img.lower) > 0 {
+		// the lower overlay is only opened for writing while the changes are merged into it
+		l := len(img.lower) - 1
+		into, err := openOverlayFile(img.lower[l].name, false)
+		if err != nil {
+			return err
+		}
+		for _, sect := range img.top.sectors() {
+			if _, err = img.top.read(sect, buf); err == nil {
+				err = into.write(sect, buf)
+			}
+			if err != nil {
+				into.close()
+				return err
+			}
+		}
+		img.lower[l].close()
+		img.lower[l] = into
+	} else {
+		base, err := os.OpenFile(baseName, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		for _, sect := range img.top.sectors() {
+			if _, err = img.top.read(sect, buf); err == nil {
+				_, err = base.WriteAt(buf, int64(sect)*diskSectorBytes)
+			}
+			if err != nil {
+				base.Close()
+				return err
+			}
+		}
+		if err = base.Close(); err != nil {
+			return err
+		}
+	}
+	return img.top.reset()
+}
+
+// discard throws away the changes held in the top overlay
+func (img *overlayImageT) discard() error {
+	img.overlayImageMu.Lock()
+	defer img.overlayImageMu.Unlock()
+	return img.top.reset()
+}
@@ -0,0 +1,253 @@
+// paperTape.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+)
+
+// The paper tape reader (PTR) and punch (PTP) transfer one frame at a time, completing each immediately.
+//
+// The reader's tape is read from a host file ATTached with ATT PTR <file>, NIOS reads the next frame which
+// is then returned by DIA.  At the end of the tape BUSY remains set and DONE is never raised, just as when
+// a real tape runs out.  The punch writes each frame given by DOA (and NIOS) to a host file ATTached with
+// ATT PTP <file>, any existing file is overwritten.
+
+// ptrT is an emulated paper tape reader
+type ptrT struct {
+	sync.Mutex
+	devNum   int
+	bus      *devices.BusT
+	fileName string
+	tape     []byte
+	pos      int
+	frame    byte
+}
+
+// ptpT is an emulated paper tape punch
+type ptpT struct {
+	sync.Mutex
+	devNum   int
+	bus      *devices.BusT
+	fileName string
+	out      *os.File
+	frame    byte
+	frames   uint64 // punched since attached
+}
+
+var (
+	ptr ptrT
+	ptp ptpT
+)
+
+// ptrInit puts the paper tape reader on the bus
+func (p *ptrT) ptrInit(devNum int, bus *devices.BusT) {
+	p.devNum = devNum
+	p.bus = bus
+	bus.SetResetFunc(devNum, p.ptrReset)
+	bus.SetDataInFunc(devNum, p.ptrDataIn)
+	bus.SetDataOutFunc(devNum, p.ptrDataOut)
+}
+
+func (p *ptrT) ptrReset() {
+	p.bus.SetBusy(p.devNum, false)
+	p.bus.SetDone(p.devNum, false)
+}
+
+// ptrAttach loads a tape into the reader, positioned at its start
+func (p *ptrT) ptrAttach(fileName string) error {
+	tape, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	p.fileName, p.tape, p.pos = fileName, tape, 0
+	p.Unlock()
+	p.bus.SetAttached(p.devNum, fileName)
+	return nil
+}
+
+// ptrDetach removes the tape from the reader
+func (p *ptrT) ptrDetach() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName == "" {
+		return fmt.Errorf("no tape is ATTached to PTR")
+	}
+	p.fileName, p.tape, p.pos = "", nil, 0
+	p.bus.SetDetached(p.devNum)
+	return nil
+}
+
+// ptrRemaining returns the unread portion of the tape and moves the reader to the end of it, it is used for booting
+func (p *ptrT) ptrRemaining() []byte {
+	p.Lock()
+	defer p.Unlock()
+	data := p.tape[p.pos:]
+	p.pos = len(p.tape)
+	return data
+}
+
+func (p *ptrT) ptrDataIn(abc byte, flag byte) (datum dg.WordT) {
+	if abc == 'A' {
+		p.Lock()
+		datum = dg.WordT(p.frame)
+		p.Unlock()
+	}
+	p.ptrHandleFlag(flag)
+	return datum
+}
+
+func (p *ptrT) ptrDataOut(datum dg.WordT, abc byte, flag byte) {
+	p.ptrHandleFlag(flag)
+}
+
+func (p *ptrT) ptrHandleFlag(flag byte) {
+	switch flag {
+	case 'S':
+		p.bus.SetBusy(p.devNum, true)
+		p.bus.SetDone(p.devNum, false)
+		p.Lock()
+		if p.pos >= len(p.tape) {
+			p.Unlock()
+			return // out of tape
+		}
+		p.frame = p.tape[p.pos]
+		p.pos++
+		p.Unlock()
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, true)
+		if !p.bus.IsDevMasked(p.devNum) {
+			p.bus.SendInterrupt(p.devNum)
+		}
+	case 'C':
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, false)
+	}
+}
+
+// ptrStatus describes the reader for SHOW DEV
+func (p *ptrT) ptrStatus() string {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName == "" {
+		return "PTR: no tape"
+	}
+	return fmt.Sprintf("PTR: %s, at frame %d. of %d.", p.fileName, p.pos, len(p.tape))
+}
+
+// ptpInit puts the paper tape punch on the bus
+func (p *ptpT) ptpInit(devNum int, bus *devices.BusT) {
+	p.devNum = devNum
+	p.bus = bus
+	bus.SetResetFunc(devNum, p.ptpReset)
+	bus.SetDataInFunc(devNum, p.ptpDataIn)
+	bus.SetDataOutFunc(devNum, p.ptpDataOut)
+}
+
+func (p *ptpT) ptpReset() {
+	p.bus.SetBusy(p.devNum, false)
+	p.bus.SetDone(p.devNum, false)
+}
+
+// ptpAttach directs punched output to a new host file
+func (p *ptpT) ptpAttach(fileName string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName != "" {
+		return fmt.Errorf("PTP already has %s ATTached, DETach it first", p.fileName)
+	}
+	out, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	p.fileName, p.out, p.frames = fileName, out, 0
+	p.bus.SetAttached(p.devNum, fileName)
+	return nil
+}
+
+// ptpDetach closes the punch's output file
+func (p *ptpT) ptpDetach() error {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName == "" {
+		return fmt.Errorf("no file is ATTached to PTP")
+	}
+	err := p.out.Close()
+	p.fileName, p.out = "", nil
+	p.bus.SetDetached(p.devNum)
+	return err
+}
+
+func (p *ptpT) ptpDataOut(datum dg.WordT, abc byte, flag byte) {
+	if abc == 'A' {
+		p.Lock()
+		p.frame = byte(datum)
+		p.Unlock()
+	}
+	p.ptpHandleFlag(flag)
+}
+
+func (p *ptpT) ptpDataIn(abc byte, flag byte) dg.WordT {
+	p.ptpHandleFlag(flag)
+	return 0
+}
+
+func (p *ptpT) ptpHandleFlag(flag byte) {
+	switch flag {
+	case 'S':
+		p.bus.SetBusy(p.devNum, true)
+		p.bus.SetDone(p.devNum, false)
+		p.Lock()
+		if p.out == nil {
+			p.Unlock()
+			return // no tape, the punch never completes
+		}
+		p.out.Write([]byte{p.frame})
+		p.frames++
+		p.Unlock()
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, true)
+		if !p.bus.IsDevMasked(p.devNum) {
+			p.bus.SendInterrupt(p.devNum)
+		}
+	case 'C':
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, false)
+	}
+}
+
+// ptpStatus describes the punch for SHOW DEV
+func (p *ptpT) ptpStatus() string {
+	p.Lock()
+	defer p.Unlock()
+	if p.fileName == "" {
+		return "PTP: no tape"
+	}
+	return fmt.Sprintf("PTP: %s, %d. frames punched", p.fileName, p.frames)
+}
@@ -0,0 +1,207 @@
+// pit.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+)
+
+// The programmable interval timer counts upwards from an initial value loaded by DOA at pitHz.
+// NIOS starts it counting from the initial value, when the count overflows from 0177777 to zero BUSY is
+// cleared, DONE set and an interrupt requested; the timer then stops until it is restarted.
+// DIA reads back the current count, NIOC stops the timer.
+//
+// As with the RTC, the timer runs in host time unless the -deterministic flag is given, when
+// rtcVirtualIPS instructions count as one second.  In host time a one-shot timer is set for the exact
+// interval when the PIT is started, in deterministic mode runDeterministic calls virtualCheck after every instruction
+// and takes the interrupt as mvcpu's Run would.  Run itself has no hook through which it could drive virtualCheck,
+// so an exact PIT needs the deterministic loop.
+const (
+	pitHz         = 10000
+	pitCountRange = 0200000
+	pitNever      = ^uint64(0) // expiresAt when the timer is stopped
+)
+
+// pitT is an emulated programmable interval timer
+type pitT struct {
+	expiresAt uint64 // virtual time at which the count overflows in deterministic mode, accessed atomically
+	sync.Mutex
+	devNum        int
+	bus           *devices.BusT
+	deterministic bool
+	initialCount  dg.WordT
+	running       bool
+	startTime     time.Time // host mode
+	startInstr    uint64    // deterministic mode
+	hostTimer     *time.Timer
+	generation    uint64 // incremented whenever the timer is started, so a stale host timer can be ignored
+	interrupts    uint64
+}
+
+var pit pitT
+
+// pitInit puts the timer on the bus
+func (p *pitT) pitInit(devNum int, bus *devices.BusT, deterministic bool) {
+	p.devNum = devNum
+	p.bus = bus
+	p.deterministic = deterministic
+	atomic.StoreUint64(&p.expiresAt, pitNever)
+	bus.SetResetFunc(devNum, p.pitReset)
+	bus.SetDataOutFunc(devNum, p.pitDataOut)
+	bus.SetDataInFunc(devNum, p.pitDataIn)
+}
+
+func (p *pitT) pitReset() {
+	p.Lock()
+	p.stop()
+	p.initialCount = 0
+	p.interrupts = 0
+	p.Unlock()
+	p.bus.SetBusy(p.devNum, false)
+	p.bus.SetDone(p.devNum, false)
+}
+
+// elapsedTicks returns the number of timer ticks since the timer was started, the caller must hold the lock
+func (p *pitT) elapsedTicks() uint64 {
+	if p.deterministic {
+		return (virtualNow() - p.startInstr) * pitHz / rtcVirtualIPS
+	}
+	return uint64(time.Since(p.startTime).Nanoseconds() * pitHz / int64(time.Second))
+}
+
+// currentCount returns the value of the count register, the caller must hold the lock
+func (p *pitT) currentCount() dg.WordT {
+	if !p.running {
+		return p.initialCount
+	}
+	return dg.WordT((uint64(p.initialCount) + p.elapsedTicks()) % pitCountRange)
+}
+
+// start begins counting from the initial value and arranges for the overflow, the caller must hold the lock
+func (p *pitT) start() {
+	p.stop()
+	p.running = true
+	remaining := pitCountRange - uint64(p.initialCount)
+	if p.deterministic {
+		p.startInstr = virtualNow()
+		atomic.StoreUint64(&p.expiresAt, p.startInstr+remaining*rtcVirtualIPS/pitHz)
+		return
+	}
+	p.startTime = time.Now()
+	p.generation++
+	generation := p.generation
+	p.hostTimer = time.AfterFunc(time.Duration(remaining)*time.Second/pitHz, func() { p.expire(generation) })
+}
+
+// stop halts the count without completing the interval, the caller must hold the lock
+func (p *pitT) stop() {
+	p.running = false
+	atomic.StoreUint64(&p.expiresAt, pitNever)
+	if p.hostTimer != nil {
+		p.hostTimer.Stop()
+		p.hostTimer = nil
+	}
+}
+
+// virtualCheck completes the interval if the virtual time has reached the overflow
+func (p *pitT) virtualCheck(now uint64) {
+	if !p.deterministic || now < atomic.LoadUint64(&p.expiresAt) {
+		return
+	}
+	p.Lock()
+	generation := p.generation
+	p.Unlock()
+	p.expire(generation)
+}
+
+// expire completes the timer's interval when the count overflows, unless the timer has since been
+// stopped or restarted
+func (p *pitT) expire(generation uint64) {
+	p.Lock()
+	expired := p.running && p.generation == generation
+	if expired {
+		p.stop()
+		p.interrupts++
+	}
+	p.Unlock()
+	if expired {
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, true)
+		if !p.bus.IsDevMasked(p.devNum) {
+			p.bus.SendInterrupt(p.devNum)
+		}
+	}
+}
+
+func (p *pitT) pitDataOut(datum dg.WordT, abc byte, flag byte) {
+	if abc == 'A' {
+		p.Lock()
+		p.initialCount = datum
+		p.Unlock()
+	}
+	p.pitHandleFlag(flag)
+}
+
+func (p *pitT) pitDataIn(abc byte, flag byte) (datum dg.WordT) {
+	if abc == 'A' {
+		p.Lock()
+		datum = p.currentCount()
+		p.Unlock()
+	}
+	p.pitHandleFlag(flag)
+	return datum
+}
+
+func (p *pitT) pitHandleFlag(flag byte) {
+	switch flag {
+	case 'S':
+		p.Lock()
+		p.start()
+		p.Unlock()
+		p.bus.SetBusy(p.devNum, true)
+		p.bus.SetDone(p.devNum, false)
+	case 'C':
+		p.Lock()
+		p.initialCount = p.currentCount()
+		p.stop()
+		p.Unlock()
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, false)
+	}
+}
+
+// pitStatus describes the timer for SHOW DEV and the status monitor
+func (p *pitT) pitStatus() string {
+	p.Lock()
+	defer p.Unlock()
+	state := "stopped"
+	if p.running {
+		state = "running"
+	}
+	return fmt.Sprintf("PIT: %s, count %06o, %d. interrupts", state, p.currentCount(), p.interrupts)
+}
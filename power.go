@@ -0,0 +1,125 @@
+// power.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+)
+
+// Resets and power failure.
+//
+// RE IO resets the I/O devices only (as IORST), RE CPU resets just the processor and RE POWER (or plain RE)
+// is a cold start which also clears memory.
+//
+// POWERFAIL raises the power-fail interrupt (device PWRFL, which cannot be masked) and continues the CPU so
+// that the guest's power-fail routine can save its state, it should then HALT.  POWERRESTORE simulates power
+// returning with memory preserved and the auto-restart switch on: the I/O devices and CPU are reset and
+// execution resumes at location 0, where the guest's restart code is expected to be.
+
+// powerFailT is the power monitor, its DONE flag is the power-fail flag
+type powerFailT struct {
+	devNum int
+	bus    *devices.BusT
+	failed bool
+}
+
+var powerFail powerFailT
+
+// pwrflInit puts the power monitor on the bus
+func (p *powerFailT) pwrflInit(devNum int, bus *devices.BusT) {
+	p.devNum = devNum
+	p.bus = bus
+	bus.SetResetFunc(devNum, p.pwrflReset)
+	bus.SetDataInFunc(devNum, p.pwrflDataIn)
+	bus.SetDataOutFunc(devNum, p.pwrflDataOut)
+}
+
+func (p *powerFailT) pwrflReset() {
+	p.bus.SetBusy(p.devNum, false)
+	p.bus.SetDone(p.devNum, p.failed)
+}
+
+func (p *powerFailT) pwrflDataIn(abc byte, flag byte) dg.WordT {
+	p.pwrflHandleFlag(flag)
+	return 0
+}
+
+func (p *powerFailT) pwrflDataOut(datum dg.WordT, abc byte, flag byte) {
+	p.pwrflHandleFlag(flag)
+}
+
+// pwrflHandleFlag lets the guest acknowledge the power-fail interrupt
+func (p *powerFailT) pwrflHandleFlag(flag byte) {
+	if flag == 'C' {
+		p.bus.SetDone(p.devNum, false)
+		p.bus.ClearInterrupt(p.devNum)
+	}
+}
+
+// resetCommand implements RE [IO|CPU|POWER]
+func resetCommand(cmd []string) {
+	kind := "POWER"
+	if len(cmd) > 1 {
+		kind = cmd[1]
+	}
+	switch kind {
+	case "IO":
+		bus.ResetAllIODevices()
+		tto.PutNLString("I/O devices reset")
+	case "CPU":
+		cpu.Reset()
+		tto.PutNLString("CPU reset")
+	case "POWER":
+		reset()
+	default:
+		cmdError(" *** Expecting IO, CPU or POWER after RE ***")
+	}
+}
+
+// powerFailCommand implements POWERFAIL
+func powerFailCommand() {
+	if powerFail.failed {
+		cmdError(" *** Power has already failed, use POWERRESTORE ***")
+		return
+	}
+	powerFail.failed = true
+	bus.SetDone(devPWRFL, true)
+	bus.SendInterrupt(devPWRFL)
+	tto.PutNLString(" *** Power failing - continuing CPU to run the power-fail routine ***")
+	run()
+}
+
+// powerRestoreCommand implements POWERRESTORE
+func powerRestoreCommand() {
+	if !powerFail.failed {
+		cmdError(" *** Power has not failed, use POWERFAIL first ***")
+		return
+	}
+	powerFail.failed = false
+	bus.ClearInterrupt(devPWRFL)
+	bus.ResetAllIODevices()
+	cpu.Reset()
+	tto.PutNLString(" *** Power restored - auto-restarting at location 0 ***")
+	cpu.SetPC(0)
+	run()
+}
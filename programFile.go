@@ -0,0 +1,190 @@
+// programFile.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/memory"
+)
+
+// AOS/VS 32-bit program (.PR) file layout
+//
+// A program file is a sequence of 256-word disk blocks which mirrors the program's logical address space.
+// The unshared (impure) area occupies the first USTBL blocks and is loaded from location 0 of the segment,
+// its page zero holds the 32-bit User Status Table (UST) at location 0400.  The shared (pure) area occupies
+// USTSZ blocks starting at block USTST, and is loaded at the same offset in the segment, ie. USTST*256.
+// Link places the start address in page zero, along with the initial wide stack if the program has one.
+// N.B. Standalone programs run with the ATU off, so the segment bits of all addresses are ignored.
+const (
+	prBlockWords = 256
+	prBlockBytes = prBlockWords * 2
+
+	ustStart = 0400 // location of the UST in page zero
+	ustRV    = 010  // (double) revision of the program
+	ustTC    = 012  // number of tasks, 1 to 32.
+	ustBL    = 013  // (double) number of unshared blocks
+	ustST    = 015  // (double) starting block number of the shared area
+	ustSZ    = 021  // (double) number of shared blocks
+	ustLen   = 025  // words in the UST
+
+	prStartLoc  = 0574      // (double) page-zero location of the start address
+	prSegOffset = 0xfffffff // mask removing the segment bits from an address
+	prMaxTasks  = 32
+
+	// MV wide stack page-zero locations
+	pzWFP = 020 // (double) wide frame pointer
+	pzWSP = 022 // (double) wide stack pointer
+	pzWSL = 024 // (double) wide stack limit
+	pzWSB = 026 // (double) wide stack base
+)
+
+// prImageT is a decoded program file ready for placing in memory
+type prImageT struct {
+	revision      dg.DwordT
+	tasks         int
+	unshared      []dg.WordT
+	shared        []dg.WordT
+	sharedOrigin  dg.PhysAddrT
+	startAddr     dg.PhysAddrT
+	stackBase     dg.PhysAddrT
+	stackLimit    dg.PhysAddrT
+	stackProvided bool
+}
+
+// loadProgramFile implements the LOADPR command
+func loadProgramFile(cmd []string) {
+	if len(cmd) < 2 {
+		cmdError(" *** LOADPR command requires <file.PR> argument ***")
+		return
+	}
+	autoStart := len(cmd) > 2 && cmd[2] == "START"
+	data, err := ioutil.ReadFile(cmd[1])
+	if err != nil {
+		cmdError(fmt.Sprintf(" *** Could not read program file: %s ***", err.Error()))
+		return
+	}
+	pr, err := prDecode(data, MemSizeWords)
+	if err != nil {
+		cmdError(fmt.Sprintf(" *** Invalid program file: %s ***", err.Error()))
+		return
+	}
+	for addr, w := range pr.unshared {
+		memory.WriteWord(dg.PhysAddrT(addr), w)
+	}
+	for ix, w := range pr.shared {
+		memory.WriteWord(pr.sharedOrigin+dg.PhysAddrT(ix), w)
+	}
+	if !pr.stackProvided {
+		writeDword(pzWSB, dg.DwordT(pr.stackBase))
+		writeDword(pzWFP, dg.DwordT(pr.stackBase))
+		writeDword(pzWSP, dg.DwordT(pr.stackBase))
+		writeDword(pzWSL, dg.DwordT(pr.stackLimit))
+	}
+	cpu.SetPC(pr.startAddr)
+	tto.PutNLString(fmt.Sprintf("Loaded %d. unshared and %d. shared words, shared area at "+fmtRadixVerb()+", program revision %d.%d.",
+		len(pr.unshared), len(pr.shared), pr.sharedOrigin, pr.revision>>16, pr.revision&0xffff))
+	tto.PutNLString(fmt.Sprintf("PC set to "+fmtRadixVerb()+", stack at "+fmtRadixVerb(),
+		pr.startAddr, dg.PhysAddrT(readDword(pzWSP)&prSegOffset)))
+	if autoStart {
+		run()
+	}
+}
+
+// prDecode validates a program file image, splits it into its unshared and shared areas and works out
+// the start address and stack.  Everything must fit in memWords words.
+func prDecode(data []byte, memWords int) (pr prImageT, err error) {
+	if len(data) == 0 || len(data)%prBlockBytes != 0 {
+		return pr, fmt.Errorf("file length %d. is not a whole number of blocks", len(data))
+	}
+	nBlocks := len(data) / prBlockBytes
+	words := make([]dg.WordT, len(data)/2)
+	for ix := range words {
+		words[ix] = dg.WordT(binary.BigEndian.Uint16(data[ix*2:]))
+	}
+	if len(words) < ustStart+ustLen {
+		return pr, fmt.Errorf("file too short to contain a UST")
+	}
+	pr.revision = wordsToDword(words, ustStart+ustRV)
+	pr.tasks = int(words[ustStart+ustTC])
+	if pr.tasks < 1 || pr.tasks > prMaxTasks {
+		return pr, fmt.Errorf("UST task count %d. is invalid, this may be a 16-bit program", pr.tasks)
+	}
+	unsharedBlocks := int(wordsToDword(words, ustStart+ustBL))
+	sharedStart := int(wordsToDword(words, ustStart+ustST))
+	sharedBlocks := int(wordsToDword(words, ustStart+ustSZ))
+	if unsharedBlocks == 0 || unsharedBlocks > nBlocks {
+		return pr, fmt.Errorf("UST claims %d. unshared blocks, file only has %d.", unsharedBlocks, nBlocks)
+	}
+	if sharedBlocks > 0 && (sharedStart < unsharedBlocks || sharedStart+sharedBlocks > nBlocks) {
+		return pr, fmt.Errorf("UST shared area (blocks %d. to %d.) is outside the file or overlaps the unshared area",
+			sharedStart, sharedStart+sharedBlocks-1)
+	}
+	pr.unshared = words[:unsharedBlocks*prBlockWords]
+	pr.sharedOrigin = dg.PhysAddrT(sharedStart * prBlockWords)
+	top := len(pr.unshared)
+	if sharedBlocks > 0 {
+		pr.shared = words[sharedStart*prBlockWords : (sharedStart+sharedBlocks)*prBlockWords]
+		top = (sharedStart + sharedBlocks) * prBlockWords
+	}
+	if top > memWords {
+		return pr, fmt.Errorf("program needs %d. words of memory, only %d. available", top, memWords)
+	}
+	pr.startAddr = dg.PhysAddrT(wordsToDword(words, prStartLoc) & prSegOffset)
+	if pr.startAddr == 0 || int(pr.startAddr) >= top {
+		return pr, fmt.Errorf("start address %#o in location %#o is not within the program", pr.startAddr, prStartLoc)
+	}
+	wsb := wordsToDword(words, pzWSB) & prSegOffset
+	wsl := wordsToDword(words, pzWSL) & prSegOffset
+	wsp := wordsToDword(words, pzWSP) & prSegOffset
+	pr.stackProvided = wsb != 0
+	if pr.stackProvided && (wsp < wsb || wsp > wsl || int(wsl) >= memWords) {
+		return pr, fmt.Errorf("wide stack base %#o, pointer %#o, limit %#o are inconsistent", wsb, wsp, wsl)
+	}
+	// otherwise give it the space after the unshared area
+	pr.stackBase = dg.PhysAddrT(len(pr.unshared))
+	if sharedBlocks > 0 {
+		pr.stackLimit = pr.sharedOrigin - 1
+	} else {
+		pr.stackLimit = dg.PhysAddrT(memWords - 1)
+	}
+	if !pr.stackProvided && pr.stackLimit <= pr.stackBase {
+		return pr, fmt.Errorf("no room for a stack between the unshared and shared areas")
+	}
+	return pr, nil
+}
+
+func wordsToDword(words []dg.WordT, ix int) dg.DwordT {
+	return dg.DwordT(words[ix])<<16 | dg.DwordT(words[ix+1])
+}
+
+func readDword(addr dg.PhysAddrT) dg.DwordT {
+	return dg.DwordT(memory.ReadWord(addr))<<16 | dg.DwordT(memory.ReadWord(addr+1))
+}
+
+func writeDword(addr dg.PhysAddrT, dw dg.DwordT) {
+	memory.WriteWord(addr, dg.WordT(dw>>16))
+	memory.WriteWord(addr+1, dg.WordT(dw))
+}
@@ -0,0 +1,190 @@
+// rtc.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+)
+
+// The real-time clock interrupts at one of four frequencies selected by the low two bits of DOA:
+// the AC line frequency, 10, 100 or 1000 Hz.  NIOS starts the clock, when it next ticks BUSY is cleared
+// and DONE set, and an interrupt is requested - the program must NIOS again to receive another tick.
+//
+// Normally the clock is driven by host time.  In deterministic mode (the -deterministic flag) it is instead
+// driven by the count of instructions executed, rtcVirtualIPS instructions being taken as one second, and
+// runDeterministic calls virtualCheck after every instruction.
+//
+// rtcVirtualIPS is the number of instructions per virtual second in deterministic mode
+const rtcVirtualIPS = 1000000
+
+// rtcT is an emulated real-time clock
+type rtcT struct {
+	nextTick uint64 // virtual time of the next tick in deterministic mode, accessed atomically
+	sync.Mutex
+	devNum        int
+	bus           *devices.BusT
+	deterministic bool
+	frequencies   [4]int
+	freqSel       int
+	ticks         uint64 // delivered since reset
+	missed        uint64 // ticks when the previous one had not been acknowledged
+	freqChange    chan bool
+}
+
+var rtc rtcT
+
+// rtcInit puts the clock on the bus and starts its timer
+func (c *rtcT) rtcInit(devNum int, bus *devices.BusT, lineFrequency int, deterministic bool) {
+	c.devNum = devNum
+	c.bus = bus
+	c.deterministic = deterministic
+	c.frequencies = [4]int{lineFrequency, 10, 100, 1000}
+	c.freqChange = make(chan bool, 1)
+	bus.SetResetFunc(devNum, c.rtcReset)
+	bus.SetDataOutFunc(devNum, c.rtcDataOut)
+	bus.SetDataInFunc(devNum, c.rtcDataIn)
+	if deterministic {
+		c.restartVirtual()
+	} else {
+		go c.hostTimer()
+	}
+}
+
+func (c *rtcT) rtcReset() {
+	c.Lock()
+	c.freqSel = 0
+	c.ticks, c.missed = 0, 0
+	c.Unlock()
+	c.bus.SetBusy(c.devNum, false)
+	c.bus.SetDone(c.devNum, false)
+	c.signalFreqChange()
+}
+
+// signalFreqChange restarts the clock's interval at the current frequency
+func (c *rtcT) signalFreqChange() {
+	if c.deterministic {
+		c.restartVirtual()
+		return
+	}
+	select {
+	case c.freqChange <- true:
+	default: // a change is already pending
+	}
+}
+
+// frequency returns the currently selected tick rate in Hz
+func (c *rtcT) frequency() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.frequencies[c.freqSel]
+}
+
+// hostTimer ticks the clock in real time
+func (c *rtcT) hostTimer() {
+	ticker := time.NewTicker(time.Second / time.Duration(c.frequency()))
+	for {
+		select {
+		case <-ticker.C:
+			c.tick()
+		case <-c.freqChange:
+			ticker.Stop()
+			ticker = time.NewTicker(time.Second / time.Duration(c.frequency()))
+		}
+	}
+}
+
+// restartVirtual starts a new interval of rtcVirtualIPS/frequency instructions from the current virtual time
+func (c *rtcT) restartVirtual() {
+	atomic.StoreUint64(&c.nextTick, virtualNow()+uint64(rtcVirtualIPS/c.frequency()))
+}
+
+// virtualCheck ticks the clock if the virtual time has reached the end of its interval
+func (c *rtcT) virtualCheck(now uint64) {
+	if !c.deterministic || now < atomic.LoadUint64(&c.nextTick) {
+		return
+	}
+	atomic.StoreUint64(&c.nextTick, now+uint64(rtcVirtualIPS/c.frequency()))
+	c.tick()
+}
+
+// tick completes the clock's current interval if it has been started
+func (c *rtcT) tick() {
+	if !c.bus.GetBusy(c.devNum) {
+		if c.bus.GetDone(c.devNum) {
+			c.Lock()
+			c.missed++
+			c.Unlock()
+		}
+		return
+	}
+	c.Lock()
+	c.ticks++
+	c.Unlock()
+	c.bus.SetBusy(c.devNum, false)
+	c.bus.SetDone(c.devNum, true)
+	if !c.bus.IsDevMasked(c.devNum) {
+		c.bus.SendInterrupt(c.devNum)
+	}
+}
+
+func (c *rtcT) rtcDataOut(datum dg.WordT, abc byte, flag byte) {
+	if abc == 'A' {
+		c.Lock()
+		c.freqSel = int(datum & 3)
+		c.Unlock()
+		c.signalFreqChange()
+	}
+	c.rtcHandleFlag(flag)
+}
+
+func (c *rtcT) rtcDataIn(abc byte, flag byte) (datum dg.WordT) {
+	c.rtcHandleFlag(flag)
+	return 0
+}
+
+func (c *rtcT) rtcHandleFlag(flag byte) {
+	switch flag {
+	case 'S':
+		c.bus.SetBusy(c.devNum, true)
+		c.bus.SetDone(c.devNum, false)
+	case 'C':
+		c.bus.SetBusy(c.devNum, false)
+		c.bus.SetDone(c.devNum, false)
+	}
+}
+
+// rtcStatus describes the clock for SHOW DEV
+func (c *rtcT) rtcStatus() string {
+	c.Lock()
+	defer c.Unlock()
+	mode := "host time"
+	if c.deterministic {
+		mode = fmt.Sprintf("virtual time, %d. instructions/second", rtcVirtualIPS)
+	}
+	return fmt.Sprintf("RTC: %d. Hz (%s), %d. ticks delivered, %d. missed", c.frequencies[c.freqSel], mode, c.ticks, c.missed)
+}
@@ -0,0 +1,337 @@
+// script.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/logging"
+	"github.com/SMerrony/dgemug/memory"
+)
+
+// DO scripts are emulator commands, one per line, plus these script statements...
+//
+//	DO <file> [<args>...]      - run another script, $0 is its name, $1 to $9 the arguments
+//	SET VAR <name> [<value>]   - set a variable, used as $<name> or ${<name>}
+//	IF <condition> / ELSE / ENDIF
+//	:<label> and GOTO <label>   - labels may not be inside IF blocks
+//	ON ERROR ABORT|CONTINUE    - whether to stop the script when a command fails (default CONTINUE)
+//	ECHO [<text>]
+//
+// Blank lines are ignored and # begins a comment, at the start of a line or after a space.
+// A condition is one of...
+//
+//	AC0..AC3|PC <op> <value>   - compare a register, values are in the current input radix
+//	MEM <addr> <op> <value>    - compare a memory word
+//	HALT <reason>|<text>       - true if the CPU last halted for the reason (see haltReasonNames), or with a message
+//	                             containing the text
+//	<string> EQ|NE <string>    - compare strings, which may be "quoted" so that they can be empty
+//
+// where <op> is EQ, NE, LT, LE, GT or GE.
+const maxScriptDepth = 8
+
+var (
+	// cmdFailed is set by cmdError so that a script can tell if the previous command failed
+	cmdFailed bool
+	// scriptVars holds the variables created by SET VAR
+	scriptVars = map[string]string{}
+	// scriptDepth is the current nesting of DO scripts
+	scriptDepth int
+	// lastHaltReason is why the CPU last stopped running
+	lastHaltReason string
+)
+
+// cmdError reports a failed command
+func cmdError(msg string) {
+	cmdFailed = true
+	tto.PutNLString(msg)
+}
+
+// ifStateT tracks one level of IF/ELSE/ENDIF
+type ifStateT struct {
+	parentActive bool // were we executing when the IF was reached?
+	condition    bool
+	inElse       bool
+}
+
+func (ifs ifStateT) active() bool {
+	return ifs.parentActive && ifs.condition != ifs.inElse
+}
+
+// doScript implements the DO command
+func doScript(cmd []string) {
+	if len(cmd) < 2 {
+		cmdError(" *** DO command required <scriptfile> ***")
+		return
+	}
+	if scriptDepth >= maxScriptDepth {
+		cmdError(fmt.Sprintf(" *** DO scripts may only be nested %d. deep ***", maxScriptDepth))
+		return
+	}
+	lines, err := readScript(cmd[1])
+	if err != nil {
+		cmdError(" *** Could not open MV/Em command script ***")
+		if debugLogging {
+			logging.DebugPrint(logging.DebugLog, "WARN: Could not open MV/Em command script <%s>\n", cmd[1])
+		}
+		return
+	}
+	scriptDepth++
+	defer func() { scriptDepth-- }()
+	runScript(cmd[1], lines, cmd[1:])
+}
+
+func readScript(fileName string) (lines []string, err error) {
+	scriptFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer scriptFile.Close()
+	scanner := bufio.NewScanner(scriptFile)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// runScript executes the lines of a script, args[0] being the script name.
+// If ON ERROR ABORT is in effect and a command fails the script stops and cmdFailed is left set.
+func runScript(name string, lines []string, args []string) {
+	labels, err := scriptLabels(lines)
+	if err != nil {
+		cmdError(fmt.Sprintf(" *** DO script %s %s ***", name, err.Error()))
+		return
+	}
+	var ifStack []ifStateT
+	abortOnError := false
+	for ix := 0; ix < len(lines); ix++ {
+		stmt := strings.TrimSpace(substituteVars(stripComment(lines[ix]), args, scriptVars))
+		if stmt == "" || strings.HasPrefix(stmt, ":") {
+			continue
+		}
+		words := strings.Fields(stmt)
+		active := len(ifStack) == 0 || ifStack[len(ifStack)-1].active()
+		cmdFailed = false
+		switch words[0] {
+		case "IF":
+			ifs := ifStateT{parentActive: active}
+			if active {
+				cond, err := evalCondition(words[1:])
+				if err != nil {
+					cmdError(" *** IF - " + err.Error() + " ***")
+				}
+				ifs.condition = cond
+			}
+			ifStack = append(ifStack, ifs)
+		case "ELSE", "ENDIF":
+			if len(ifStack) == 0 {
+				cmdError(" *** " + words[0] + " without IF ***")
+				break
+			}
+			if words[0] == "ELSE" {
+				ifStack[len(ifStack)-1].inElse = true
+			} else {
+				ifStack = ifStack[:len(ifStack)-1]
+			}
+		default:
+			if !active {
+				continue
+			}
+			switch words[0] {
+			case "GOTO":
+				target, found := labels[strings.Join(words[1:], " ")]
+				if !found {
+					cmdError(" *** GOTO unknown label ***")
+					break
+				}
+				ix = target
+				ifStack = nil // GOTO leaves any IF blocks
+			case "ON":
+				switch strings.Join(words[1:], " ") {
+				case "ERROR ABORT":
+					abortOnError = true
+				case "ERROR CONTINUE":
+					abortOnError = false
+				default:
+					cmdError(" *** Expecting ON ERROR ABORT|CONTINUE ***")
+				}
+			case "ECHO":
+				tto.PutNLString(strings.TrimSpace(strings.TrimPrefix(stmt, "ECHO")))
+			default:
+				tto.PutNLString(stmt)
+				doCommand(stmt)
+			}
+		}
+		if cmdFailed && abortOnError {
+			tto.PutNLString(fmt.Sprintf(" *** DO script %s aborted at line %d. ***", name, ix+1))
+			return
+		}
+	}
+	if len(ifStack) > 0 {
+		cmdError(fmt.Sprintf(" *** DO script %s ended inside an IF ***", name))
+		return
+	}
+	cmdFailed = false
+}
+
+// scriptLabels finds the labels in a script.  As GOTO leaves any IF blocks a label must not be inside one.
+func scriptLabels(lines []string) (labels map[string]int, err error) {
+	labels = map[string]int{}
+	depth := 0
+	for ix, line := range lines {
+		stmt := strings.TrimSpace(stripComment(line))
+		switch {
+		case strings.HasPrefix(stmt, ":"):
+			if depth > 0 {
+				return nil, fmt.Errorf("has label %s inside an IF at line %d.", strings.TrimSpace(stmt[1:]), ix+1)
+			}
+			labels[strings.TrimSpace(stmt[1:])] = ix
+		case stmt == "IF" || strings.HasPrefix(stmt, "IF "):
+			depth++
+		case stmt == "ENDIF" && depth > 0:
+			depth--
+		}
+	}
+	return labels, nil
+}
+
+// stripComment removes any comment from a script line
+func stripComment(line string) string {
+	for ix := 0; ix < len(line); ix++ {
+		if line[ix] == '#' && (ix == 0 || line[ix-1] == ' ' || line[ix-1] == '\t') {
+			return line[:ix]
+		}
+	}
+	return line
+}
+
+// substituteVars replaces $0 to $9 with the script arguments, and $name or ${name} with script variables,
+// $$ gives a single $.  Undefined arguments and variables are replaced by nothing.
+func substituteVars(line string, args []string, vars map[string]string) string {
+	var res strings.Builder
+	for ix := 0; ix < len(line); ix++ {
+		if line[ix] != '$' || ix+1 == len(line) {
+			res.WriteByte(line[ix])
+			continue
+		}
+		ix++
+		switch c := line[ix]; {
+		case c == '$':
+			res.WriteByte('$')
+		case c >= '0' && c <= '9':
+			if n := int(c - '0'); n < len(args) {
+				res.WriteString(args[n])
+			}
+		case c == '{':
+			end := strings.IndexByte(line[ix:], '}')
+			if end == -1 {
+				res.WriteString(line[ix-1:])
+				return res.String()
+			}
+			res.WriteString(vars[line[ix+1:ix+end]])
+			ix += end
+		default:
+			end := ix
+			for end < len(line) && isVarNameChar(line[end]) {
+				end++
+			}
+			if end == ix {
+				res.WriteByte('$')
+				ix--
+				continue
+			}
+			res.WriteString(vars[line[ix:end]])
+			ix = end - 1
+		}
+	}
+	return res.String()
+}
+
+func isVarNameChar(c byte) bool {
+	return c == '_' || (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+// evalCondition evaluates the condition of an IF statement
+func evalCondition(words []string) (bool, error) {
+	if len(words) > 0 && words[0] == "HALT" {
+		text := strings.Trim(strings.Join(words[1:], " "), `"`)
+		if strings.TrimSpace(text) == "" {
+			return false, fmt.Errorf("HALT requires a reason or some text to match")
+		}
+		if text == lastHalt.String() {
+			return true, nil
+		}
+		return strings.Contains(strings.ToUpper(lastHaltReason), strings.ToUpper(text)), nil
+	}
+	if len(words) == 4 && words[0] == "MEM" {
+		addr, err := strconv.ParseInt(words[1], inputRadix, 32)
+		if err != nil || addr < 0 || addr >= int64(MemSizeWords) {
+			return false, fmt.Errorf("invalid MEM address <%s>", words[1])
+		}
+		return compareNumber(int64(memory.ReadWord(dg.PhysAddrT(addr))), words[2], words[3])
+	}
+	if len(words) != 3 {
+		return false, fmt.Errorf("expecting <left> <op> <right>")
+	}
+	switch words[0] {
+	case "AC0", "AC1", "AC2", "AC3":
+		return compareNumber(int64(cpu.GetAc(int(words[0][2]-'0'))), words[1], words[2])
+	case "PC":
+		return compareNumber(int64(cpu.GetPC()), words[1], words[2])
+	}
+	left, right := strings.Trim(words[0], `"`), strings.Trim(words[2], `"`)
+	switch words[1] {
+	case "EQ":
+		return left == right, nil
+	case "NE":
+		return left != right, nil
+	}
+	return false, fmt.Errorf("only EQ and NE may be used to compare strings")
+}
+
+// compareNumber compares a value with a number given in the current input radix
+func compareNumber(val int64, op string, numStr string) (bool, error) {
+	num, err := strconv.ParseInt(numStr, inputRadix, 64)
+	if err != nil {
+		return false, fmt.Errorf("could not parse <%s>", numStr)
+	}
+	switch op {
+	case "EQ":
+		return val == num, nil
+	case "NE":
+		return val != num, nil
+	case "LT":
+		return val < num, nil
+	case "LE":
+		return val <= num, nil
+	case "GT":
+		return val > num, nil
+	case "GE":
+		return val >= num, nil
+	}
+	return false, fmt.Errorf("unknown comparison <%s>", op)
+}
@@ -0,0 +1,239 @@
+// simhTape.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SimH tape images consist of records each preceded and followed by a 4-byte little-endian length,
+// the data being padded to an even length.  E11 images are identical except that there is no padding.  A zero length header is a tape mark, two consecutive tape
+// marks indicate the logical end of the tape.
+const (
+	simhTapeMark = 0
+	// simhEndOfMedium marks the physical end of the recorded part of the tape
+	simhEndOfMedium = 0xFFFFFFFF
+	// simhGap is an erase gap, it has no trailing length
+	simhGap = 0xFFFFFFFE
+	// simhErrorFlag is set in the length of a record which was read with an error
+	simhErrorFlag = 0x80000000
+	// simhMaxRecordBytes is the largest record we will write, DG tape drives could not handle more
+	simhMaxRecordBytes = 65535
+)
+
+// tapeManifestEntryT is one file to be written to tape, in records of the given size
+type tapeManifestEntryT struct {
+	fileName  string
+	blockSize int
+}
+
+// readTapeManifest reads a CSV manifest of FILENAME,blocksize pairs.
+// File names are relative to baseDir, or if that is empty to the directory containing the manifest.
+func readTapeManifest(manifestName, baseDir string) (entries []tapeManifestEntryT, err error) {
+	f, err := os.Open(manifestName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if baseDir == "" {
+		baseDir = filepath.Dir(manifestName)
+	}
+	for line, rec := range records {
+		blockSize, err := strconv.Atoi(strings.TrimSpace(rec[1]))
+		if err != nil || blockSize <= 0 || blockSize > simhMaxRecordBytes {
+			return nil, fmt.Errorf("invalid block size <%s> for %s in entry %d", rec[1], rec[0], line+1)
+		}
+		fileName := strings.TrimSpace(rec[0])
+		if !filepath.IsAbs(fileName) {
+			fileName = filepath.Join(baseDir, fileName)
+		}
+		entries = append(entries, tapeManifestEntryT{fileName: fileName, blockSize: blockSize})
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("manifest %s lists no files", manifestName)
+	}
+	return entries, nil
+}
+
+// buildTape writes a SimH tape image containing each file in the manifest followed by a tape mark,
+// with a final extra tape mark to mark the end of the tape.  The image is only created if all the
+// files can be read.
+func buildTape(manifestName, tapeName string) (files int, err error) {
+	entries, err := readTapeManifest(manifestName, "")
+	if err != nil {
+		return 0, err
+	}
+	return writeTapeImage(entries, tapeName)
+}
+
+// writeTapeImage writes a SimH tape image containing each of the entries
+func writeTapeImage(entries []tapeManifestEntryT, tapeName string) (files int, err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(tapeName), filepath.Base(tapeName)+"-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name()) // harmless once renamed
+	w := bufio.NewWriter(tmp)
+	for _, entry := range entries {
+		if err = writeTapeFile(w, entry); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	if err = writeSimhMark(w); err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), os.Rename(tmp.Name(), tapeName)
+}
+
+// writeTapeFile copies a host file to tape in records of the entry's block size, the last record
+// may be short, and writes a tape mark after it
+func writeTapeFile(w io.Writer, entry tapeManifestEntryT) error {
+	f, err := os.Open(entry.fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, entry.blockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if werr := writeSimhRecord(w, buf[:n], true); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writeSimhMark(w)
+}
+
+// writeSimhRecord writes one data record in SimH format, or E11 format if padded is not set
+func writeSimhRecord(w io.Writer, data []byte, padded bool) error {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(data)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if padded && len(data)&1 == 1 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+// writeSimhMark writes a tape mark
+func writeSimhMark(w io.Writer) error {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], simhTapeMark)
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+// makeTape implements the MKTAPE command
+func makeTape(cmd []string) {
+	if len(cmd) != 3 {
+		cmdError(" *** MKTAPE command requires <manifest.csv> <tapefile> arguments ***")
+		return
+	}
+	files, err := buildTape(cmd[1], cmd[2])
+	if err != nil {
+		cmdError(" *** Could not build tape - " + err.Error() + " ***")
+		return
+	}
+	tto.PutNLString(fmt.Sprintf(" *** Tape image %s built with %d. files ***", cmd[2], files))
+}
+
+// readSimhRecord reads the next record from a SimH tape image, or an E11 image if padded is not set.
+// A tape mark is returned as a nil record with mark set.  io.EOF is returned at the end of the image
+// or the end of medium.
+func readSimhRecord(r io.Reader, padded bool) (data []byte, mark bool, bad bool, err error) {
+	var hdr [4]byte
+	for {
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("truncated record header")
+			}
+			return nil, false, false, err
+		}
+		switch hdrLen := binary.LittleEndian.Uint32(hdr[:]); hdrLen {
+		case simhTapeMark:
+			return nil, true, false, nil
+		case simhEndOfMedium:
+			return nil, false, false, io.EOF
+		case simhGap:
+			continue
+		default:
+			bad = hdrLen&simhErrorFlag != 0
+			recLen := hdrLen &^ simhErrorFlag
+			if recLen > simhMaxRecordBytes {
+				return nil, false, false, fmt.Errorf("implausible record length %d", recLen)
+			}
+			data = make([]byte, recLen)
+			if padded {
+				data = make([]byte, recLen+recLen&1)
+			}
+			var trailer [4]byte
+			if _, err = io.ReadFull(r, data); err == nil {
+				_, err = io.ReadFull(r, trailer[:])
+			}
+			if err != nil {
+				return nil, false, false, fmt.Errorf("truncated record of %d bytes", recLen)
+			}
+			if trailer != hdr {
+				return nil, false, false, fmt.Errorf("record trailer does not match header")
+			}
+			return data[:recLen], false, bad, nil
+		}
+	}
+}
@@ -0,0 +1,567 @@
+// snapshot.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/memory"
+	"github.com/SMerrony/dgemug/mvcpu"
+)
+
+// snapshotVersion must be incremented whenever snapshotT changes incompatibly
+const snapshotVersion = 3
+
+// snapshot machine instructions, executed at the SCP to read and set CPU state which mvcpu has no accessors for,
+// N.B. the MOVs do not change AC0
+const (
+	opMovSzc0  = 0101012 // MOV# 0,0,SZC - skip if Carry is zero
+	opMovZ0    = 0101020 // MOVZ 0,0 - clear Carry
+	opMovO0    = 0101040 // MOVO 0,0 - set Carry
+	opSkpbnCPU = 0063477 // SKPBN CPU - skip if Interrupts are ON
+	opInten    = 0060177 // INTEN
+	opIntds    = 0060277 // INTDS
+)
+
+const (
+	// bmcdchRegs is the number of BMC/DCH map and I/O channel registers
+	bmcdchRegs = 010000
+	// bmcdchDefReg is the I/O channel definition register, some of whose bits are flipped by writing a one to them
+	bmcdchDefReg  = 06000
+	bmcdchDefFlip = 1<<(15-3) | 1<<(15-4) | 1<<(15-7) | 1<<(15-8) | 1<<(15-14)
+)
+
+// snapshotControllers returns the configured devices whose registers are captured in a snapshot,
+// a snapshot cannot be taken while any of them is busy
+func snapshotControllers() (codes []int) {
+	for _, dev := range machineConfig.Devices {
+		switch dev.Type {
+		case "MTB", "DPF", "DSKP":
+			codes = append(codes, dev.code)
+		}
+	}
+	return codes
+}
+
+// snapshotT holds the state of the machine.
+//
+// Carry and ION are read and set by executing instructions at the SCP.
+// The I/O mode of each segment can be read but mvcpu provides no way to set it, so a snapshot taken
+// with any segment in another I/O mode than after a reset cannot be LOADed.
+// N.B. Only the interrupt mask bits of the devices on the bus are captured, and on LOAD any device
+// with Done set is taken to be requesting an interrupt.
+type snapshotT struct {
+	Version    int
+	AppVersion string
+	PC         dg.PhysAddrT
+	Ac         [4]dg.DwordT
+	Carry      bool
+	ION        bool
+	ATU        bool
+	Lef        [8]bool
+	IO         [8]bool
+	OVK        bool
+	OVR        bool
+	IRQ        bool
+	BmcDch     []dg.WordT // the BMC and DCH maps and I/O channel registers
+	MemSize    int
+	Memory     []dg.WordT
+	DevBusy    map[int]bool
+	DevDone    map[int]bool
+	DevMasked  map[int]bool
+	Images     []snapshotImageT
+	// the disk and tape controllers' registers, by device code
+	Dpf  map[int]disk6061StateT
+	Dskp map[int]disk6239StateT
+	Mtb  map[int]tape6026StateT
+	// human-readable state, for post-mortem dumps
+	CPUStatus string
+	DevList   string
+}
+
+// snapshotImageT records an attached image file so it can be verified and reattached on restore.
+// The guest may change a writable tape, or the top overlay of a disk, after the snapshot is taken,
+// so their contents are saved instead of being verified.
+type snapshotImageT struct {
+	Device   string
+	FileName string
+	ReadOnly bool
+	Overlays []string
+	// TapeCapacity is the capacity of a tape in MB
+	TapeCapacity int64
+	Checksum     [sha256.Size]byte
+	// OverlaySums holds the checksum of each overlay file
+	OverlaySums [][sha256.Size]byte
+	// Saved is set if Contents holds the tape or top overlay
+	Saved    bool
+	Contents []byte
+}
+
+// snapshot implements the SNAPSHOT SAVE|LOAD command
+func snapshot(cmd []string) {
+	if len(cmd) < 3 {
+		cmdError(" *** SNAPSHOT command requires SAVE|LOAD <file> arguments ***")
+		return
+	}
+	switch cmd[1] {
+	case "SAVE":
+		tto.PutNLString("Saving machine snapshot, please wait...")
+		if err := snapshotSave(cmd[2]); err != nil {
+			cmdError(fmt.Sprintf(" *** Could not SAVE snapshot: %s ***", err.Error()))
+			return
+		}
+		tto.PutNLString("Snapshot saved")
+	case "LOAD":
+		tto.PutNLString("Restoring machine snapshot, please wait...")
+		if err := snapshotLoad(cmd[2]); err != nil {
+			cmdError(fmt.Sprintf(" *** Could not LOAD snapshot: %s ***", err.Error()))
+			return
+		}
+		tto.PutNLString("Snapshot restored - use CO to resume")
+	default:
+		cmdError(" *** Expecting SAVE or LOAD for SNAPSHOT command ***")
+	}
+}
+
+func snapshotSave(fileName string) error {
+	snap, err := snapshotCapture(true)
+	if err != nil {
+		return err
+	}
+	return snapshotWrite(fileName, &snap)
+}
+
+func snapshotLoad(fileName string) error {
+	snap, err := snapshotRead(fileName)
+	if err != nil {
+		return err
+	}
+	// check all the images before we disturb anything
+	for _, img := range snap.Images {
+		if err = img.verify(); err != nil {
+			return err
+		}
+	}
+
+	for dev := range attachedImages {
+		detach([]string{"DET", dev})
+	}
+	reset()
+	for _, img := range snap.Images {
+		if img.Saved && len(img.Overlays) > 0 {
+			if err = ioutil.WriteFile(img.Overlays[len(img.Overlays)-1], img.Contents, 0644); err != nil {
+				snapshotAbandon()
+				return err
+			}
+		}
+		cmd := []string{"ATT", img.Device, img.FileName}
+		if img.ReadOnly {
+			cmd = append(cmd, "RO")
+		}
+		if img.TapeCapacity > 0 {
+			cmd = append(cmd, "CAPACITY", fmt.Sprintf("%dMB", img.TapeCapacity))
+		}
+		for _, ovl := range img.Overlays {
+			cmd = append(cmd, "OVERLAY", ovl)
+		}
+		if !attach(cmd) {
+			snapshotAbandon()
+			return fmt.Errorf("could not reATTach %s to %s", img.FileName, img.Device)
+		}
+		if mount, isTape := tapeMounts[img.Device]; isTape && img.Saved {
+			// the drive reads the working file as it goes, so it may be rewritten under it
+			if err = ioutil.WriteFile(mount.workFile, img.Contents, 0644); err != nil {
+				snapshotAbandon()
+				return err
+			}
+		}
+	}
+	snapshotRestore(&snap)
+	if err = restoreCPUState(&snap); err != nil {
+		snapshotAbandon()
+		return err
+	}
+	restoreControllers(&snap)
+	for devNum := range deviceMap {
+		bus.SetBusy(devNum, snap.DevBusy[devNum])
+		bus.SetDone(devNum, snap.DevDone[devNum])
+		if snap.IRQ && snap.DevDone[devNum] {
+			bus.SendInterrupt(devNum)
+		}
+	}
+	bus.SetIRQ(snap.IRQ)
+	return nil
+}
+
+// snapshotAbandon leaves the machine reset with nothing attached after a failed LOAD
+func snapshotAbandon() {
+	for dev := range attachedImages {
+		detach([]string{"DET", dev})
+	}
+	reset()
+}
+
+// verify checks that an image and its overlays are unchanged since the snapshot was taken,
+// any saved tape or top overlay is not checked as it will be rewritten
+func (img *snapshotImageT) verify() error {
+	if img.Saved && len(img.Overlays) == 0 {
+		return nil
+	}
+	sum, err := fileChecksum(img.FileName)
+	if err != nil {
+		return err
+	}
+	if sum != img.Checksum {
+		return fmt.Errorf("image %s for %s has changed since the snapshot was taken", img.FileName, img.Device)
+	}
+	if len(img.OverlaySums) != len(img.Overlays) {
+		return fmt.Errorf("overlay checksums missing for %s", img.Device)
+	}
+	for i, ovl := range img.Overlays {
+		if img.Saved && i == len(img.Overlays)-1 {
+			break
+		}
+		if sum, err = fileChecksum(ovl); err != nil {
+			return err
+		}
+		if sum != img.OverlaySums[i] {
+			return fmt.Errorf("overlay %s for %s has changed since the snapshot was taken", ovl, img.Device)
+		}
+	}
+	return nil
+}
+
+// snapshotCapture gathers the current machine state.
+// Only a snapshot to be LOADed (forLoad) includes the controllers' registers and the attached images' checksums
+// and writable contents, it fails if a controller is busy or a disk is ATTached RW without an overlay.
+func snapshotCapture(forLoad bool) (snap snapshotT, err error) {
+	if forLoad {
+		for _, devNum := range snapshotControllers() {
+			if bus.GetBusy(devNum) {
+				return snap, fmt.Errorf("%s is busy, its state cannot be captured", deviceMap[devNum].DgMnemonic)
+			}
+		}
+		for dev, mount := range diskMounts {
+			if len(mount.overlays) == 0 && !mount.readOnly {
+				return snap, fmt.Errorf("%s is ATTached RW, ATTach it RO or with an OVERLAY to take snapshots", dev)
+			}
+		}
+	}
+	snap = snapshotT{
+		Version:    snapshotVersion,
+		AppVersion: appVersion,
+		PC:         cpu.GetPC(),
+		MemSize:    MemSizeWords,
+		Memory:     make([]dg.WordT, MemSizeWords),
+		BmcDch:     make([]dg.WordT, bmcdchRegs),
+		DevBusy:    make(map[int]bool),
+		DevDone:    make(map[int]bool),
+		DevMasked:  make(map[int]bool),
+		ATU:        cpu.GetAtu(),
+		OVK:        cpu.GetOVK(),
+		OVR:        cpu.GetOVR(),
+		IRQ:        bus.GetIRQ(),
+		CPUStatus:  cpu.PrintableStatus(),
+		DevList:    bus.GetPrintableDevList(),
+	}
+	for ac := 0; ac < 4; ac++ {
+		snap.Ac[ac] = cpu.GetAc(ac)
+	}
+	for seg := 0; seg < 8; seg++ {
+		snap.Lef[seg] = cpu.GetLef(seg)
+		snap.IO[seg] = cpu.GetIO(seg)
+	}
+	if err = captureCPUFlags(&snap); err != nil {
+		return snap, err
+	}
+	for addr := range snap.Memory {
+		snap.Memory[addr] = memory.ReadWord(dg.PhysAddrT(addr))
+	}
+	for reg := range snap.BmcDch {
+		snap.BmcDch[reg] = memory.BmcdchReadReg(reg)
+	}
+	for devNum := range deviceMap {
+		snap.DevBusy[devNum] = bus.GetBusy(devNum)
+		snap.DevDone[devNum] = bus.GetDone(devNum)
+		snap.DevMasked[devNum] = bus.IsDevMasked(devNum)
+	}
+	if forLoad {
+		if err = captureControllers(&snap); err != nil {
+			return snap, err
+		}
+	}
+	devNames := make([]string, 0, len(attachedImages))
+	for dev := range attachedImages {
+		devNames = append(devNames, dev)
+	}
+	sort.Strings(devNames)
+	for _, dev := range devNames {
+		img := snapshotImageT{Device: dev, FileName: attachedImages[dev]}
+		saveFile := ""
+		if mount, isDisk := diskMounts[dev]; isDisk {
+			img.ReadOnly = mount.readOnly
+			img.Overlays = mount.overlays
+			if len(mount.overlays) > 0 {
+				saveFile = mount.overlays[len(mount.overlays)-1]
+			}
+		}
+		if mount, isTape := tapeMounts[dev]; isTape {
+			img.ReadOnly = mount.readOnly
+			img.TapeCapacity = mount.capacity / (1024 * 1024)
+			if !mount.readOnly {
+				saveFile = mount.workFile
+			}
+		}
+		if forLoad {
+			if saveFile != "" {
+				if img.Contents, err = ioutil.ReadFile(saveFile); err != nil {
+					return snap, err
+				}
+				img.Saved = true
+			}
+			if img.Checksum, err = fileChecksum(img.FileName); err != nil {
+				return snap, err
+			}
+			for _, ovl := range img.Overlays {
+				sum, err := fileChecksum(ovl)
+				if err != nil {
+					return snap, err
+				}
+				img.OverlaySums = append(img.OverlaySums, sum)
+			}
+		}
+		snap.Images = append(snap.Images, img)
+	}
+	return snap, nil
+}
+
+// captureControllers saves the registers of the disk and tape controllers
+func captureControllers(snap *snapshotT) (err error) {
+	snap.Dpf = make(map[int]disk6061StateT)
+	snap.Dskp = make(map[int]disk6239StateT)
+	snap.Mtb = make(map[int]tape6026StateT)
+	for devNum, disk := range dpfControllers {
+		snap.Dpf[devNum] = disk.disk6061State()
+	}
+	for devNum, disk := range dskpControllers {
+		if snap.Dskp[devNum], err = disk.disk6239State(); err != nil {
+			return fmt.Errorf("%s is busy, %s", deviceMap[devNum].DgMnemonic, err.Error())
+		}
+	}
+	for devNum, tape := range mtbControllers {
+		snap.Mtb[devNum] = tape.tape6026State()
+	}
+	return nil
+}
+
+// restoreControllers puts back the registers of the disk and tape controllers, the images must be reattached first
+func restoreControllers(snap *snapshotT) {
+	for devNum, st := range snap.Dpf {
+		if disk, present := dpfControllers[devNum]; present {
+			disk.disk6061Restore(st)
+		}
+	}
+	for devNum, st := range snap.Dskp {
+		if disk, present := dskpControllers[devNum]; present {
+			disk.disk6239Restore(st)
+		}
+	}
+	for devNum, st := range snap.Mtb {
+		if tape, present := mtbControllers[devNum]; present {
+			tape.tape6026Restore(st)
+		}
+	}
+}
+
+// snapshotRestore puts the saved memory and CPU registers back into the machine
+func snapshotRestore(snap *snapshotT) {
+	for addr, w := range snap.Memory {
+		memory.WriteWord(dg.PhysAddrT(addr), w)
+	}
+	for ac := 0; ac < 4; ac++ {
+		cpu.SetAc(ac, snap.Ac[ac])
+	}
+	cpu.SetPC(snap.PC)
+}
+
+// captureCPUFlags reads Carry and ION by executing skip instructions
+func captureCPUFlags(snap *snapshotT) error {
+	zeroCarry, err := execSCPOp(opMovSzc0)
+	if err != nil {
+		return err
+	}
+	snap.Carry = !zeroCarry
+	snap.ION, err = execSCPOp(opSkpbnCPU)
+	return err
+}
+
+// restoreCPUState sets the CPU modes and flags, the interrupt mask and the BMC/DCH registers.
+// The I/O mode of a segment cannot be set, so it must be as it was when the snapshot was taken.
+func restoreCPUState(snap *snapshotT) error {
+	for seg := 0; seg < 8; seg++ {
+		if cpu.GetIO(seg) != snap.IO[seg] {
+			return fmt.Errorf("the I/O mode of segment %d. cannot be restored", seg)
+		}
+	}
+	pc := cpu.GetPC()
+	for seg := 0; seg < 8; seg++ {
+		// SetLef sets the mode of the PC's segment
+		cpu.SetPC(dg.PhysAddrT(seg) << 28)
+		cpu.SetLef(snap.Lef[seg])
+	}
+	cpu.SetPC(pc)
+	cpu.SetOVK(snap.OVK)
+	cpu.SetOVR(snap.OVR)
+	ops := []dg.WordT{opMovZ0, opIntds}
+	if snap.Carry {
+		ops[0] = opMovO0
+	}
+	if snap.ION {
+		ops[1] = opInten
+	}
+	for _, op := range ops {
+		if _, err := execSCPOp(op); err != nil {
+			return err
+		}
+	}
+	cpu.SetATU(snap.ATU)
+	bus.SetIrqMask(interruptMaskWord(snap.DevMasked))
+	if len(snap.BmcDch) == bmcdchRegs {
+		for reg, w := range snap.BmcDch {
+			if reg == bmcdchDefReg {
+				// write ones to the flipping bits which differ
+				w = w&^bmcdchDefFlip | (w^memory.BmcdchReadReg(reg))&bmcdchDefFlip
+			}
+			memory.BmcdchWriteReg(reg, w)
+		}
+	}
+	return nil
+}
+
+// interruptMaskWord builds the interrupt mask word which masks the given devices
+func interruptMaskWord(masked map[int]bool) (mask dg.WordT) {
+	for devNum, isMasked := range masked {
+		if dev, present := deviceMap[devNum]; present && isMasked && dev.PMB <= 15 {
+			mask |= 1 << (15 - dev.PMB)
+		}
+	}
+	return mask
+}
+
+// execSCPOp executes a single I/O or ALU instruction without disturbing the PC and reports whether it skipped
+func execSCPOp(op dg.WordT) (skipped bool, err error) {
+	pc := cpu.GetPC()
+	iPtr, ok := mvcpu.InstructionDecode(op, pc, false, true, cpu.GetAtu(), false, deviceMap)
+	if !ok {
+		return false, fmt.Errorf("could not decode opcode %#o", op)
+	}
+	if !cpu.Execute(iPtr) {
+		return false, fmt.Errorf("could not execute opcode %#o", op)
+	}
+	skipped = cpu.GetPC() == pc+2
+	cpu.SetPC(pc)
+	return skipped, nil
+}
+
+func snapshotWrite(fileName string, snap *snapshotT) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	if err = gob.NewEncoder(zw).Encode(snap); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func snapshotRead(fileName string) (snap snapshotT, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return snap, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return snap, err
+	}
+	if err = gob.NewDecoder(zr).Decode(&snap); err != nil {
+		return snap, err
+	}
+	if snap.Version != snapshotVersion {
+		return snap, fmt.Errorf("snapshot version %d. is not supported by this build", snap.Version)
+	}
+	if snap.MemSize != MemSizeWords || len(snap.Memory) != snap.MemSize {
+		return snap, fmt.Errorf("snapshot memory size %d. does not match this machine", snap.MemSize)
+	}
+	return snap, nil
+}
+
+// fileChecksum returns the SHA-256 sum of the given file's contents.
+// For a directory tape the sum covers the names and contents of all the files in the directory.
+func fileChecksum(fileName string) (sum [sha256.Size]byte, err error) {
+	fileName = strings.TrimPrefix(fileName, dirTapePrefix)
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return sum, err
+	}
+	h := sha256.New()
+	if fi.IsDir() {
+		infos, err := ioutil.ReadDir(fileName) // sorted by name
+		if err != nil {
+			return sum, err
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				io.WriteString(h, info.Name())
+				if err = hashFile(h, filepath.Join(fileName, info.Name())); err != nil {
+					return sum, err
+				}
+			}
+		}
+	} else if err = hashFile(h, fileName); err != nil {
+		return sum, err
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+func hashFile(w io.Writer, fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
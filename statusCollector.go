@@ -25,10 +25,8 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"time"
 
-	"github.com/SMerrony/dgemug/devices"
 	"github.com/SMerrony/dgemug/dg"
 	"github.com/SMerrony/dgemug/memory"
 	"github.com/SMerrony/dgemug/mvcpu"
@@ -39,9 +37,14 @@ const (
 	statCPUrow        = 3
 	statCPUrow2       = 5
 	statDPFrow        = 7
+	statDPF1row       = 8
 	statDSKProw       = 9
+	statDSKP1row      = 10
 	statMTrow         = 11
 	statMTrow2        = 12
+	statMT1row        = 14
+	statMT1row2       = 15
+	statTimersRow     = 17
 	statInternalsRow  = 20
 	statInternalsRow2 = 21
 )
@@ -58,26 +61,26 @@ const (
 func statusCollector(
 	statusAddr string,
 	cpuChan chan mvcpu.CPUStatT,
-	dpfChan chan devices.Disk6061StatT,
-	dskpChan chan devices.Disk6239StatT,
-	mtbChan chan devices.MtStatT) {
+	dpfChan, dpf1Chan chan disk6061StatT,
+	dskpChan, dskp1Chan chan disk6239StatT,
+	mtbChan, mtb1Chan chan tape6026StatT) {
 
 	var (
-		cpuStats                               mvcpu.CPUStatT
-		lastIcount, iCount                     uint64
-		ips, dpfIops, dskpIops                 float64
-		lastCPUtime, lastDpfTime, lastDskpTime time.Time
-		thisDpfIOcnt, lastDpfIOcnt             uint64
-		thisDskpIOcnt, lastDskpIOcnt           uint64
-		dpfStats                               devices.Disk6061StatT
-		dskpStats                              devices.Disk6239StatT
-		mtStats                                devices.MtStatT
+		cpuStats           mvcpu.CPUStatT
+		lastIcount, iCount uint64
+		ips                float64
+		lastCPUtime        time.Time
+		dpfStats           disk6061StatT
+		dskpStats          disk6239StatT
+		mtStats            tape6026StatT
+		// IOPS counters for DPF, DPF1, DSKP and DSKP1
+		dpfIops, dpf1Iops, dskpIops, dskp1Iops iopsCounterT
 	)
 
 	l, err := net.Listen("tcp", statusAddr)
 	if err != nil {
 		log.Println("ERROR: Could not listen on stats port: ", err.Error())
-		os.Exit(1)
+		emergencyExit(1)
 	}
 	defer l.Close()
 
@@ -86,7 +89,7 @@ func statusCollector(
 		conn, err := l.Accept()
 		if err != nil {
 			log.Println("ERROR: Could not accept on stats port: ", err.Error())
-			os.Exit(1)
+			emergencyExit(1)
 		}
 
 		statusSendString(conn, fmt.Sprintf("%c                             %c%s Status%c\012", dg.DasherERASEPAGE, dg.DasherUNDERLINE, appName, dg.DasherNORMAL))
@@ -120,47 +123,90 @@ func statusCollector(
 					cpuStats.HostCPUCount,
 					cpuStats.GoroutineCount,
 					cpuStats.HeapSizeMB))
+				statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, statTimersRow, dg.DasherERASEEOL))
+				statusSendString(conn, statusTimers())
 
 			case dpfStats = <-dpfChan:
-				thisDpfIOcnt = dpfStats.Writes + dpfStats.Reads
-				dpfIops = float64(thisDpfIOcnt-lastDpfIOcnt) / time.Since(lastDpfTime).Seconds()
-				lastDpfIOcnt = thisDpfIOcnt
-				lastDpfTime = time.Now()
-				statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, statDPFrow, dg.DasherERASEEOL))
-				statusSendString(conn, fmt.Sprintf("DPF  (DPF0) - Attached: %c  IOPS: %.f CYL: %04d.  HD: %02d.  SECT: %03d.",
-					memory.BoolToYN(dpfStats.ImageAttached),
-					dpfIops,
-					dpfStats.Cylinder,
-					dpfStats.Head,
-					dpfStats.Sector))
+				statusSendDpf(conn, statDPFrow, "DPF  (DPF0)", &dpfStats, &dpfIops)
+			case dpfStats = <-dpf1Chan:
+				statusSendDpf(conn, statDPF1row, "DPF1 (DPF10)", &dpfStats, &dpf1Iops)
 
 			case dskpStats = <-dskpChan:
-				thisDskpIOcnt = dskpStats.Writes + dskpStats.Reads
-				dskpIops = float64(thisDskpIOcnt-lastDskpIOcnt) / time.Since(lastDskpTime).Seconds()
-				lastDskpIOcnt = thisDskpIOcnt
-				lastDskpTime = time.Now()
-				statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, statDSKProw, dg.DasherERASEEOL))
-				statusSendString(conn, fmt.Sprintf("DSKP (DPJ0) - Attached: %c  IOPS: %.f  SECNUM: %08d.",
-					memory.BoolToYN(dskpStats.ImageAttached),
-					dskpIops,
-					//dskpStats.cylinder,
-					//dskpStats.head,
-					//dskpStats.sector,
-					dskpStats.SectorNo))
+				statusSendDskp(conn, statDSKProw, "DSKP (DPJ0)", &dskpStats, &dskpIops)
+			case dskpStats = <-dskp1Chan:
+				statusSendDskp(conn, statDSKP1row, "DSKP1(DPJ10)", &dskpStats, &dskp1Iops)
 
 			case mtStats = <-mtbChan:
-				statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, statMTrow, dg.DasherERASEEOL))
-				statusSendString(conn, fmt.Sprintf("MTA  (MTC0) - Attached: %c  Mem Addr: %06o  Curr Cmd: %d",
-					memory.BoolToYN(mtStats.ImageAttached[0]),
-					mtStats.MemAddrReg,
-					mtStats.CurrentCmd))
-				statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, statMTrow2, dg.DasherERASEEOL))
-				statusSendString(conn, fmt.Sprintf("              Image file: %s", mtStats.FileName[0]))
+				statusSendMt(conn, statMTrow, statMTrow2, "MTA  (MTC0)", &mtStats)
+			case mtStats = <-mtb1Chan:
+				statusSendMt(conn, statMT1row, statMT1row2, "MTA1 (MTC10)", &mtStats)
 			}
 		}
 	}
 }
 
+// iopsCounterT holds the state needed to calculate a disk's I/O operations per second between updates
+type iopsCounterT struct {
+	lastIOcnt uint64
+	lastTime  time.Time
+}
+
+func (ic *iopsCounterT) update(ioCnt uint64) (iops float64) {
+	iops = float64(ioCnt-ic.lastIOcnt) / time.Since(ic.lastTime).Seconds()
+	ic.lastIOcnt = ioCnt
+	ic.lastTime = time.Now()
+	return iops
+}
+
+func statusSendDpf(conn net.Conn, row byte, name string, stats *disk6061StatT, ic *iopsCounterT) {
+	iops := ic.update(stats.writes + stats.reads)
+	statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, row, dg.DasherERASEEOL))
+	statusSendString(conn, fmt.Sprintf("%s - Attached: %d  IOPS: %.f DRV: %d  CYL: %04d.  HD: %02d.  SECT: %03d.",
+		name,
+		stats.attached,
+		iops,
+		stats.drive,
+		stats.cylinder,
+		stats.head,
+		stats.sector))
+}
+
+func statusSendDskp(conn net.Conn, row byte, name string, stats *disk6239StatT, ic *iopsCounterT) {
+	iops := ic.update(stats.writes + stats.reads)
+	statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, row, dg.DasherERASEEOL))
+	statusSendString(conn, fmt.Sprintf("%s - Attached: %d  IOPS: %.f  UNIT: %d  SECNUM: %08d.",
+		name,
+		stats.attached,
+		iops,
+		stats.unitNo,
+		stats.sectorNo))
+}
+
+func statusSendMt(conn net.Conn, row, row2 byte, name string, stats *tape6026StatT) {
+	statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, row, dg.DasherERASEEOL))
+	statusSendString(conn, fmt.Sprintf("%s - Attached: %d  UNIT: %d  Mem Addr: %06o  Curr Cmd: %s",
+		name,
+		stats.attached,
+		stats.unit,
+		stats.memAddr,
+		tape6026CmdDecode[stats.command]))
+	statusSendString(conn, fmt.Sprintf("%c%c%c%c", dg.DasherWRITEWINDOWADDR, 0, row2, dg.DasherERASEEOL))
+	statusSendString(conn, fmt.Sprintf("              Image file: %s  POS: %d.  Reads: %d.  Writes: %d.",
+		stats.fileName, stats.position, stats.reads, stats.writes))
+}
+
 func statusSendString(con net.Conn, s string) {
 	con.Write([]byte(s))
 }
+
+// statusTimers summarises the RTC and PIT on one line
+func statusTimers() string {
+	var res string
+	if isConfigured("RTC") {
+		res += rtc.rtcStatus() + "  "
+	}
+	if isConfigured("PIT") {
+		res += pit.pitStatus()
+	}
+	return res
+}
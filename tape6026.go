@@ -0,0 +1,716 @@
+// tape6026.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Here we are emulating the type 6026 magnetic tape controller (MTB) with up to eight drives attached.
+// The controller is derived from dgemug's read-only magtape6026 emulation, each drive now keeps its own
+// position in its SimH image and the guest may write records and tape marks, erase and space in either direction.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+	"github.com/SMerrony/dgemug/logging"
+	"github.com/SMerrony/dgemug/memory"
+	"github.com/SMerrony/simhtape/pkg/simhtape"
+)
+
+const (
+	// tape6026Drives is the number of drives a controller can address, the unit field of DOA is 3 bits
+	tape6026Drives = 8
+	// tape6026MaxRecordWords is the longest record the controller will write
+	tape6026MaxRecordWords = 16384
+	// tape6026DefaultCapacity is roughly what a 2400ft reel holds at 1600 bpi, allowing for the inter-record gaps
+	tape6026DefaultCapacity = 40 * 1024 * 1024
+	// tape6026RunoutBytes may still be written after passing the end-of-tape marker, then the tape runs out
+	tape6026RunoutBytes = 1024 * 1024
+)
+
+const (
+	tape6026CmdMask = 0x00b8
+
+	tape6026CmdReadBits        = 0x0000
+	tape6026CmdRewindBits      = 0x0008
+	tape6026CmdCtrlModeBits    = 0x0010
+	tape6026CmdSpaceFwdBits    = 0x0018
+	tape6026CmdSpaceRevBits    = 0x0020
+	tape6026CmdWriteBits       = 0x0028
+	tape6026CmdWriteEOFBits    = 0x0030
+	tape6026CmdEraseBits       = 0x0038
+	tape6026CmdReadNonStopBits = 0x0080
+	tape6026CmdUnloadBits      = 0x0088
+	tape6026CmdDriveModeBits   = 0x0090
+)
+
+const (
+	tape6026CmdRead = iota
+	tape6026CmdRewind
+	tape6026CmdCtrlMode
+	tape6026CmdSpaceFwd
+	tape6026CmdSpaceRev
+	tape6026CmdWrite
+	tape6026CmdWriteEOF
+	tape6026CmdErase
+	tape6026CmdReadNonStop
+	tape6026CmdUnload
+	tape6026CmdDriveMode
+	tape6026CmdIllegal
+)
+
+var tape6026CmdBits = [...]dg.WordT{tape6026CmdReadBits, tape6026CmdRewindBits, tape6026CmdCtrlModeBits,
+	tape6026CmdSpaceFwdBits, tape6026CmdSpaceRevBits, tape6026CmdWriteBits, tape6026CmdWriteEOFBits,
+	tape6026CmdEraseBits, tape6026CmdReadNonStopBits, tape6026CmdUnloadBits, tape6026CmdDriveModeBits}
+
+var tape6026CmdDecode = [...]string{"READ", "REWIND", "CONTROLLER MODE", "SPACE FORWARD", "SPACE REVERSE",
+	"WRITE", "WRITE EOF", "ERASE", "READ NON-STOP", "UNLOAD", "DRIVE MODE", "ILLEGAL"}
+
+const (
+	// status register 1
+	tape6026Sr1Error         = 1 << 15
+	tape6026Sr1DataLate      = 1 << 14
+	tape6026Sr1Rewinding     = 1 << 13
+	tape6026Sr1Illegal       = 1 << 12
+	tape6026Sr1HiDensity     = 1 << 11
+	tape6026Sr1DataError     = 1 << 10
+	tape6026Sr1EOT           = 1 << 9
+	tape6026Sr1EOF           = 1 << 8
+	tape6026Sr1BOT           = 1 << 7
+	tape6026Sr19Track        = 1 << 6
+	tape6026Sr1BadTape       = 1 << 5
+	tape6026Sr1Reserved      = 1 << 4
+	tape6026Sr1StatusChanged = 1 << 3
+	tape6026Sr1WriteLock     = 1 << 2
+	tape6026Sr1OddChar       = 1 << 1
+	tape6026Sr1UnitReady     = 1
+
+	// tape6026Sr1Errors are the conditions which also set the Error bit
+	tape6026Sr1Errors = tape6026Sr1DataLate | tape6026Sr1Illegal | tape6026Sr1DataError | tape6026Sr1EOT |
+		tape6026Sr1EOF | tape6026Sr1BOT | tape6026Sr1BadTape
+
+	tape6026Sr1Readable = "ELRIHDEFB9TrSWOR"
+
+	// status register 2
+	tape6026Sr2PEMode = 1
+)
+
+// tape6026StatsPeriodMs is the number of milliseconds between sending status updates
+const tape6026StatsPeriodMs = 333
+
+// tape6026DriveT holds the state of one tape drive
+type tape6026DriveT struct {
+	f        *os.File // the SimH image, nil if no image is attached
+	fileName string
+	readOnly bool  // the tape has no write ring
+	capacity int64 // the position of the end-of-tape marker
+	pos      int64 // the offset of the next record in the image
+	unloaded bool  // the tape has been unloaded by the guest
+	reads    uint64
+	writes   uint64
+}
+
+// tape6026T holds the current state of a Type 6026 Magnetic Tape controller
+type tape6026T struct {
+	// MV/Em internals...
+	tape6026Mu   sync.Mutex
+	bus          *devices.BusT
+	devNum       int
+	logID        int
+	drives       [tape6026Drives]tape6026DriveT
+	debugLogging bool
+	// DG data...
+	command    int
+	unit       int
+	memAddr    dg.PhysAddrT // self-incrementing
+	negWordCnt int16
+	conditions dg.WordT // the status register 1 bits set by the last command
+	statusReg2 dg.WordT
+}
+
+// tape6026StatT holds the data reported to the status collector
+type tape6026StatT struct {
+	attached      int // the number of drives with images attached
+	unit          int
+	fileName      string
+	position      int64
+	memAddr       dg.PhysAddrT
+	command       int
+	reads, writes uint64
+}
+
+// tape6026Init must be called to initialise the emulated tape controller
+func (tape *tape6026T) tape6026Init(dev int, bus *devices.BusT, statsChann chan tape6026StatT, logID int, logging bool) {
+	tape.tape6026Mu.Lock()
+	defer tape.tape6026Mu.Unlock()
+	tape.devNum = dev
+	tape.bus = bus
+	tape.logID = logID
+	tape.debugLogging = logging
+
+	go tape.tape6026StatsSender(statsChann)
+
+	bus.SetResetFunc(tape.devNum, tape.tape6026Reset)
+	bus.SetDataInFunc(tape.devNum, tape.tape6026In)
+	bus.SetDataOutFunc(tape.devNum, tape.tape6026Out)
+	for d := range tape.drives {
+		tape.drives[d] = tape6026DriveT{}
+	}
+	tape.conditions = 0
+	tape.statusReg2 = tape6026Sr2PEMode
+}
+
+// tape6026Attach loads a SimH tape image onto a drive, the controller closes the image when it is detached.
+// A read-only tape is write-locked; writing past capacity bytes reaches the end-of-tape marker.
+func (tape *tape6026T) tape6026Attach(unit int, imgName string, readOnly bool, capacity int64) error {
+	tape.tape6026Mu.Lock()
+	defer tape.tape6026Mu.Unlock()
+	if tape.drives[unit].f != nil {
+		return fmt.Errorf("unit %d. already has an image attached", unit)
+	}
+	mode := os.O_RDWR
+	if readOnly {
+		mode = os.O_RDONLY
+	}
+	f, err := os.OpenFile(imgName, mode, 0)
+	if err != nil {
+		return err
+	}
+	tape.drives[unit] = tape6026DriveT{f: f, fileName: imgName, readOnly: readOnly, capacity: capacity}
+	if unit == tape.unit {
+		tape.conditions = tape6026Sr1StatusChanged
+	}
+	logging.DebugPrint(tape.logID, "tape6026Attach attached unit #%d to image <%s>\n", unit, imgName)
+	tape.bus.SetAttached(tape.devNum, imgName)
+	return nil
+}
+
+// tape6026Detach closes a drive's image, the caller must ensure the controller is not busy
+func (tape *tape6026T) tape6026Detach(unit int) error {
+	tape.tape6026Mu.Lock()
+	defer tape.tape6026Mu.Unlock()
+	f := tape.drives[unit].f
+	if f == nil {
+		return fmt.Errorf("no image is attached to unit %d.", unit)
+	}
+	tape.drives[unit] = tape6026DriveT{}
+	if unit == tape.unit {
+		tape.conditions = tape6026Sr1StatusChanged
+	}
+	if tape.attachedDrives() == 0 {
+		tape.bus.SetDetached(tape.devNum)
+	}
+	return f.Close()
+}
+
+// attachedDrives returns the number of drives with images - MUST BE LOCKED BY CALLER
+func (tape *tape6026T) attachedDrives() (n int) {
+	for d := range tape.drives {
+		if tape.drives[d].f != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// tape6026SetLogging sets the controller's internal debug logging flag as specified
+func (tape *tape6026T) tape6026SetLogging(log bool) {
+	tape.tape6026Mu.Lock()
+	tape.debugLogging = log
+	tape.tape6026Mu.Unlock()
+}
+
+// tape6026ScanImage scans the image attached to a drive to ensure it makes sense
+// (This is just a pass-through to the equivalent function in simhtape)
+func (tape *tape6026T) tape6026ScanImage(unit int) string {
+	tape.tape6026Mu.Lock()
+	imageName := tape.drives[unit].fileName
+	tape.tape6026Mu.Unlock()
+	if imageName == "" {
+		return "WARNING: No image attached"
+	}
+	return simhtape.ScanImage(imageName, false)
+}
+
+func (tape *tape6026T) tape6026StatsSender(sChan chan tape6026StatT) {
+	var stats tape6026StatT
+	for {
+		tape.tape6026Mu.Lock()
+		drv := &tape.drives[tape.unit]
+		stats.attached = tape.attachedDrives()
+		stats.unit = tape.unit
+		stats.fileName = drv.fileName
+		stats.position = drv.pos
+		stats.memAddr = tape.memAddr
+		stats.command = tape.command
+		stats.reads = drv.reads
+		stats.writes = drv.writes
+		tape.tape6026Mu.Unlock()
+		select {
+		case sChan <- stats:
+		default:
+		}
+		time.Sleep(time.Millisecond * tape6026StatsPeriodMs)
+	}
+}
+
+// tape6026Reset rewinds all the tapes and resets the controller
+func (tape *tape6026T) tape6026Reset() {
+	tape.tape6026Mu.Lock()
+	for d := range tape.drives {
+		tape.drives[d].pos = 0
+	}
+	tape.conditions = tape6026Sr1StatusChanged
+	tape.statusReg2 = tape6026Sr2PEMode
+	tape.memAddr = 0
+	tape.negWordCnt = 0
+	tape.command = tape6026CmdRead
+	tape.unit = 0
+	tape.tape6026Mu.Unlock()
+	logging.DebugPrint(tape.logID, "tape6026 Reset via call to tape6026Reset()\n")
+}
+
+// tape6026StateT holds the registers of the controller and the positions of its drives for a snapshot
+type tape6026StateT struct {
+	Command    int
+	Unit       int
+	MemAddr    dg.PhysAddrT
+	NegWordCnt int16
+	Conditions dg.WordT
+	StatusReg2 dg.WordT
+	Pos        [tape6026Drives]int64
+	Unloaded   [tape6026Drives]bool
+}
+
+// tape6026State returns the controller's registers
+func (tape *tape6026T) tape6026State() (st tape6026StateT) {
+	tape.tape6026Mu.Lock()
+	defer tape.tape6026Mu.Unlock()
+	st = tape6026StateT{Command: tape.command, Unit: tape.unit, MemAddr: tape.memAddr, NegWordCnt: tape.negWordCnt,
+		Conditions: tape.conditions, StatusReg2: tape.statusReg2}
+	for d := range tape.drives {
+		st.Pos[d] = tape.drives[d].pos
+		st.Unloaded[d] = tape.drives[d].unloaded
+	}
+	return st
+}
+
+// tape6026Restore sets the controller's registers, the images must already be attached
+func (tape *tape6026T) tape6026Restore(st tape6026StateT) {
+	tape.tape6026Mu.Lock()
+	defer tape.tape6026Mu.Unlock()
+	tape.command, tape.unit, tape.memAddr, tape.negWordCnt = st.Command, st.Unit, st.MemAddr, st.NegWordCnt
+	tape.conditions, tape.statusReg2 = st.Conditions, st.StatusReg2
+	for d := range tape.drives {
+		tape.drives[d].pos = st.Pos[d]
+		tape.drives[d].unloaded = st.Unloaded[d]
+	}
+}
+
+// tape6026LoadTBoot - This function fakes the ROM/SCP boot-from-tape routine.
+// Rather than copying a ROM and executing that, we simply mimic its basic actions...
+// Load the first file on the given unit's tape into memory from location 0, then rewind it.
+func (tape *tape6026T) tape6026LoadTBoot(unit int) {
+	logging.DebugPrint(tape.logID, "tape6026LoadTBoot() called for unit #%d\n", unit)
+	tape.tape6026Mu.Lock()
+	defer tape.tape6026Mu.Unlock()
+	drv := &tape.drives[unit]
+	drv.pos = 0
+	var memix dg.PhysAddrT
+	for {
+		data, mark, _, err := tape.readRecord(drv)
+		if err != nil {
+			logging.DebugPrint(logging.DebugLog, "WARNING: tape6026LoadTBoot could not read boot file - %s\n", err.Error())
+			break
+		}
+		if mark {
+			break
+		}
+		for wdix := 0; wdix+1 < len(data); wdix += 2 {
+			memory.WriteWord(memix, dg.WordT(data[wdix])<<8|dg.WordT(data[wdix+1]))
+			memix++
+		}
+	}
+	drv.pos = 0
+	logging.DebugPrint(tape.logID, "... tape6026LoadTBoot completed having loaded %d. words\n", memix)
+}
+
+// status returns status register 1 for the selected drive - MUST BE LOCKED BY CALLER
+func (tape *tape6026T) status() dg.WordT {
+	drv := &tape.drives[tape.unit]
+	sr1 := dg.WordT(tape6026Sr1HiDensity|tape6026Sr19Track) | tape.conditions
+	if drv.f != nil {
+		if !drv.unloaded {
+			sr1 |= tape6026Sr1UnitReady
+		}
+		if drv.readOnly {
+			sr1 |= tape6026Sr1WriteLock
+		}
+		if drv.pos == 0 {
+			sr1 |= tape6026Sr1BOT
+		}
+		if drv.pos >= drv.capacity {
+			sr1 |= tape6026Sr1EOT
+		}
+	}
+	if sr1&tape6026Sr1Errors != 0 {
+		sr1 |= tape6026Sr1Error
+	}
+	return sr1
+}
+
+// tape6026In implements the DIA/B/C I/O instructions for this device
+func (tape *tape6026T) tape6026In(abc byte, flag byte) (data dg.WordT) {
+	tape.tape6026Mu.Lock()
+	switch abc {
+	case 'A': // Read status register 1 - see p.IV-18 of Peripherals guide
+		data = tape.status()
+		if tape.debugLogging {
+			logging.DebugPrint(tape.logID, "DIA - Read SR1 - returning: %#o = %s\n", data, tape6026ReadableSR1(data))
+		}
+	case 'B': // Read memory addr register - see p.IV-19 of Peripherals guide
+		data = dg.WordT(tape.memAddr)
+		if tape.debugLogging {
+			logging.DebugPrint(tape.logID, "DIB - Read MA - returning: %#o\n", data)
+		}
+	case 'C': // Read status register 2 - see p.IV-18 of Peripherals guide
+		data = tape.statusReg2
+		if tape.debugLogging {
+			logging.DebugPrint(tape.logID, "DIC - Read SR2 - returning: %#o\n", data)
+		}
+	}
+	tape.tape6026Mu.Unlock()
+	tape.tape6026HandleFlag(flag)
+	return data
+}
+
+// tape6026Out implements the DOA/B/C instructions for this device
+func (tape *tape6026T) tape6026Out(datum dg.WordT, abc byte, flag byte) {
+	tape.tape6026Mu.Lock()
+	switch abc {
+	case 'A': // Specify Command and Drive - p.IV-17
+		tape.command = tape6026CmdIllegal
+		for c, bits := range tape6026CmdBits {
+			if datum&tape6026CmdMask == bits {
+				tape.command = c
+				break
+			}
+		}
+		if unit := int(datum & 0x07); unit != tape.unit {
+			tape.unit = unit
+			tape.conditions = tape6026Sr1StatusChanged
+		}
+		if tape.debugLogging {
+			logging.DebugPrint(tape.logID, "DOA - Specify Command and Drive - command: %s, unit: %d\n",
+				tape6026CmdDecode[tape.command], tape.unit)
+		}
+	case 'B':
+		tape.memAddr = dg.PhysAddrT(datum)
+		if tape.debugLogging {
+			logging.DebugPrint(tape.logID, "DOB - MA set to %#o\n", tape.memAddr)
+		}
+	case 'C':
+		tape.negWordCnt = int16(datum)
+		if tape.debugLogging {
+			logging.DebugPrint(tape.logID, "DOC - Set (neg) Word Count to %#o (%d.)\n", datum, tape.negWordCnt)
+		}
+	case 'N': // special handling for NIOx...
+		if tape.debugLogging {
+			logging.DebugPrint(tape.logID, "NIO - Flag is %c\n", flag)
+		}
+	}
+	tape.tape6026Mu.Unlock()
+	tape.tape6026HandleFlag(flag)
+}
+
+// tape6026HandleFlag actions the flag/pulse to the controller
+func (tape *tape6026T) tape6026HandleFlag(f byte) {
+	switch f {
+	case 'S':
+		tape.tape6026Mu.Lock()
+		rewinding := tape.command == tape6026CmdRewind
+		tape.tape6026Mu.Unlock()
+		if !rewinding {
+			tape.bus.SetBusy(tape.devNum, true)
+		}
+		tape.bus.SetDone(tape.devNum, false)
+		tape.tape6026DoCommand()
+		tape.bus.SetBusy(tape.devNum, false)
+		tape.bus.SetDone(tape.devNum, true)
+	case 'C':
+		tape.bus.SetBusy(tape.devNum, false)
+		tape.bus.SetDone(tape.devNum, false)
+	case 'P':
+		// 'Reserved'
+		logging.DebugPrint(tape.logID, "WARNING: Received 'P' flag - which is reserved\n")
+	}
+}
+
+// tape6026DoCommand performs the command given by the last DOA on the selected drive
+func (tape *tape6026T) tape6026DoCommand() {
+	tape.tape6026Mu.Lock()
+	defer tape.tape6026Mu.Unlock()
+	drv := &tape.drives[tape.unit]
+	if tape.debugLogging {
+		logging.DebugPrint(tape.logID, "*%s* command ---- Unit: %d ---- Word Count: %d Location: %#o Position: %d.\n",
+			tape6026CmdDecode[tape.command], tape.unit, tape.negWordCnt, tape.memAddr, drv.pos)
+	}
+	if tape.command == tape6026CmdIllegal {
+		tape.conditions = tape6026Sr1Illegal
+		return
+	}
+	if drv.f == nil || drv.unloaded {
+		// no tape is loaded
+		tape.conditions = tape6026Sr1Illegal
+		return
+	}
+	switch tape.command {
+	case tape6026CmdRead, tape6026CmdReadNonStop:
+		tape.conditions = tape.readToMemory(drv)
+
+	case tape6026CmdRewind:
+		drv.pos = 0
+		tape.conditions = tape6026Sr1StatusChanged
+
+	case tape6026CmdCtrlMode, tape6026CmdDriveMode:
+		tape.conditions = 0
+
+	case tape6026CmdSpaceFwd:
+		tape.conditions = tape.spaceFwd(drv)
+
+	case tape6026CmdSpaceRev:
+		tape.conditions = tape.spaceRev(drv)
+
+	case tape6026CmdWrite:
+		words := -int(tape.negWordCnt)
+		if words <= 0 || words > tape6026MaxRecordWords {
+			tape.conditions = tape6026Sr1Illegal
+			return
+		}
+		data := make([]byte, words*2)
+		for w := 0; w < words; w++ {
+			wd := memory.ReadWordDchChan(&tape.memAddr)
+			data[w*2] = byte(wd >> 8)
+			data[w*2+1] = byte(wd)
+		}
+		tape.negWordCnt = 0
+		tape.conditions = tape.writeTape(drv, func(w io.Writer) error { return writeSimhRecord(w, data, true) })
+		if tape.conditions&tape6026Sr1Errors == 0 {
+			drv.writes++
+		}
+
+	case tape6026CmdWriteEOF:
+		tape.conditions = tape.writeTape(drv, writeSimhMark)
+		if tape.conditions&tape6026Sr1Errors == 0 {
+			tape.conditions |= tape6026Sr1EOF
+		}
+
+	case tape6026CmdErase:
+		// the tape is blank from here on
+		tape.conditions = tape.writeTape(drv, func(io.Writer) error { return nil })
+
+	case tape6026CmdUnload:
+		drv.pos = 0
+		drv.unloaded = true
+		tape.conditions = tape6026Sr1StatusChanged
+	}
+}
+
+// positionReaderT reads from an image and keeps track of the position on the tape
+type positionReaderT struct {
+	f   *os.File
+	pos *int64
+}
+
+func (pr *positionReaderT) Read(buf []byte) (n int, err error) {
+	n, err = pr.f.ReadAt(buf, *pr.pos)
+	*pr.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// readRecord reads the next record, or tape mark, from a drive.  io.EOF is returned at the end of the recorded
+// part of the tape, the tape is then left where it was.  A read beyond the end of a short image is a blank tape.
+func (tape *tape6026T) readRecord(drv *tape6026DriveT) (data []byte, mark bool, bad bool, err error) {
+	start := drv.pos
+	data, mark, bad, err = readSimhRecord(&positionReaderT{f: drv.f, pos: &drv.pos}, true)
+	if err != nil {
+		drv.pos = start
+	}
+	return data, mark, bad, err
+}
+
+// readToMemory reads the next record into memory via the data channel, returning the resulting conditions.
+// If the record is longer than the word count the rest of it is skipped.
+func (tape *tape6026T) readToMemory(drv *tape6026DriveT) dg.WordT {
+	data, mark, bad, err := tape.readRecord(drv)
+	switch {
+	case err == io.EOF:
+		return tape6026Sr1BadTape // blank tape beyond the recorded data
+	case err != nil:
+		logging.DebugPrint(tape.logID, "ERROR: Could not read tape - %s\n", err.Error())
+		return tape6026Sr1DataError
+	case mark:
+		return tape6026Sr1EOF
+	}
+	drv.reads++
+	for b := 0; b < len(data) && tape.negWordCnt != 0; b += 2 {
+		wd := dg.WordT(data[b]) << 8
+		if b+1 < len(data) {
+			wd |= dg.WordT(data[b+1])
+		}
+		memory.WriteWordDchChan(&tape.memAddr, wd)
+		tape.negWordCnt++
+	}
+	conditions := dg.WordT(tape6026Sr1StatusChanged)
+	if len(data)&1 == 1 {
+		conditions |= tape6026Sr1OddChar
+	}
+	if bad {
+		conditions |= tape6026Sr1DataError
+	}
+	return conditions
+}
+
+// spaceFwd spaces forward over the number of records in the word count, stopping after a tape mark, or if the
+// word count is zero over a whole file.
+// N.B. As in dgemug, MA is then set to the word count, or -1 after spacing a file, which INSTL depends upon.
+func (tape *tape6026T) spaceFwd(drv *tape6026DriveT) dg.WordT {
+	wholeFile := tape.negWordCnt == 0
+	count := tape.negWordCnt
+	conditions := dg.WordT(tape6026Sr1StatusChanged)
+	for {
+		_, mark, _, err := tape.readRecord(drv)
+		if err != nil {
+			conditions = tape6026Sr1EOT | tape6026Sr1StatusChanged
+			if !wholeFile {
+				conditions = tape6026Sr1BadTape | tape6026Sr1StatusChanged
+			}
+			break
+		}
+		if mark {
+			conditions = tape6026Sr1EOF
+			if !wholeFile {
+				conditions |= tape6026Sr1StatusChanged
+			}
+			break
+		}
+		if !wholeFile {
+			if count++; count == 0 {
+				break
+			}
+		}
+	}
+	tape.memAddr = dg.PhysAddrT(tape.negWordCnt)
+	if wholeFile {
+		tape.memAddr = 0xffffffff
+	}
+	return conditions
+}
+
+// spaceRev spaces backwards over the number of records in the word count, or if the word count is zero over
+// a whole file; it stops before a tape mark, having passed over it, or at the beginning of the tape
+func (tape *tape6026T) spaceRev(drv *tape6026DriveT) dg.WordT {
+	wholeFile := tape.negWordCnt == 0
+	count := tape.negWordCnt
+	var trailer [4]byte
+	for drv.pos > 0 {
+		if _, err := drv.f.ReadAt(trailer[:], drv.pos-4); err != nil {
+			logging.DebugPrint(tape.logID, "ERROR: Could not space tape backwards - %s\n", err.Error())
+			return tape6026Sr1DataError
+		}
+		recLen := int64(trailer[0]) | int64(trailer[1])<<8 | int64(trailer[2])<<16 | int64(trailer[3])<<24
+		switch recLen {
+		case simhTapeMark:
+			drv.pos -= 4
+			tape.memAddr = dg.PhysAddrT(tape.negWordCnt)
+			return tape6026Sr1EOF | tape6026Sr1StatusChanged
+		case simhGap:
+			drv.pos -= 4
+			continue
+		}
+		recLen &^= simhErrorFlag
+		if drv.pos -= 8 + recLen + recLen&1; drv.pos < 0 {
+			drv.pos = 0
+			return tape6026Sr1DataError
+		}
+		if !wholeFile {
+			if count++; count == 0 {
+				break
+			}
+		}
+	}
+	tape.memAddr = dg.PhysAddrT(tape.negWordCnt)
+	return tape6026Sr1StatusChanged
+}
+
+// writeTape writes a record or tape mark at the drive's position, anything beyond it on the tape is lost.
+// Writing is possible past the end-of-tape marker until the tape runs out.
+func (tape *tape6026T) writeTape(drv *tape6026DriveT, write func(io.Writer) error) dg.WordT {
+	if drv.readOnly {
+		return tape6026Sr1Illegal
+	}
+	var buf bytes.Buffer
+	if err := write(&buf); err != nil {
+		return tape6026Sr1DataError
+	}
+	if drv.pos+int64(buf.Len()) > drv.capacity+tape6026RunoutBytes {
+		return tape6026Sr1BadTape
+	}
+	_, err := drv.f.WriteAt(buf.Bytes(), drv.pos)
+	if err == nil {
+		err = drv.f.Truncate(drv.pos + int64(buf.Len()))
+	}
+	if err != nil {
+		logging.DebugPrint(tape.logID, "ERROR: Could not write tape - %s\n", err.Error())
+		return tape6026Sr1DataError
+	}
+	drv.pos += int64(buf.Len())
+	return tape6026Sr1StatusChanged
+}
+
+// tape6026ReadableSR1 shows the bits set in status register 1 for debugging
+func tape6026ReadableSR1(sr1 dg.WordT) string {
+	res := []byte(tape6026Sr1Readable)
+	for b := 0; b < 16; b++ {
+		if sr1&(1<<(15-uint(b))) == 0 {
+			res[b] = '-'
+		}
+	}
+	return string(res)
+}
+
+// createTapeImage creates a blank tape image, an existing file is never overwritten.
+// A blank tape is simply an empty SimH image.
+func createTapeImage(fileName string) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,379 @@
+// tapeFormats.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The tape controller only understands SimH images, other container formats are converted to a SimH
+// working copy when they are ATTached.
+//
+// AWSTAPE images consist of blocks each preceded by a 6-byte header: the block length and the previous block's
+// length (both 16-bit little-endian) and two flag bytes.  Records longer than a block are split over several.
+//
+// RAW "images" are host directories holding one file per tape file and a manifest.csv listing them with their
+// block sizes, as used by MKTAPE.
+const (
+	tapeFmtSimH = "SIMH"
+	tapeFmtE11  = "E11"
+	tapeFmtAWS  = "AWS"
+	tapeFmtRaw  = "RAW"
+
+	awsHeaderBytes  = 6
+	awsNewRecord    = 0x80
+	awsTapeMark     = 0x40
+	awsEndOfRecord  = 0x20
+	awsMaxBlockData = 0xFFFF
+
+	// tapeSniffBytes and tapeSniffRecords limit how much of an image is read to detect its format
+	tapeSniffBytes   = 1024 * 1024
+	tapeSniffRecords = 16
+
+	// rawManifest is the manifest written to, and expected in, a RAW directory
+	rawManifest = "manifest.csv"
+)
+
+// tapeReaderT reads records from a tape image in any of the container formats
+type tapeReaderT struct {
+	rc     io.ReadCloser
+	r      *bufio.Reader
+	format string
+}
+
+// openTape opens a tape image for reading, detecting its format
+func openTape(imageName string) (*tapeReaderT, error) {
+	format, _, err := detectTapeFormat(imageName)
+	if err != nil {
+		return nil, err
+	}
+	if format == tapeFmtRaw {
+		return nil, fmt.Errorf("%s is a directory, not a tape image", imageName)
+	}
+	rc, err := openImage(imageName)
+	if err != nil {
+		return nil, err
+	}
+	return &tapeReaderT{rc: rc, r: bufio.NewReader(rc), format: format}, nil
+}
+
+func (tr *tapeReaderT) close() error {
+	return tr.rc.Close()
+}
+
+// readRecord returns the next record, a tape mark as a nil record with mark set, or io.EOF at the end of the image
+func (tr *tapeReaderT) readRecord() (data []byte, mark bool, bad bool, err error) {
+	switch tr.format {
+	case tapeFmtAWS:
+		data, mark, err = readAwsRecord(tr.r)
+		return data, mark, false, err
+	case tapeFmtE11:
+		return readSimhRecord(tr.r, false)
+	}
+	return readSimhRecord(tr.r, true)
+}
+
+// detectTapeFormat works out the container format of a tape image from its first few records.  SimH and E11
+// images differ only in the padding of odd-length records, so an image which is valid as both is treated as SimH.
+// If the format is not recognised SimH is assumed, as the controller would, and recognised is false.
+func detectTapeFormat(imageName string) (format string, recognised bool, err error) {
+	fi, err := os.Stat(imageName)
+	if err != nil {
+		return "", false, err
+	}
+	if fi.IsDir() {
+		return tapeFmtRaw, true, nil
+	}
+	rc, err := openImage(imageName)
+	if err != nil {
+		return "", false, err
+	}
+	head := make([]byte, tapeSniffBytes)
+	n, err := io.ReadFull(rc, head)
+	rc.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", false, err
+	}
+	if looksLikeAws(head[:n]) {
+		return tapeFmtAWS, true, nil
+	}
+	for _, format := range []string{tapeFmtSimH, tapeFmtE11} {
+		if validTapeHead(head[:n], n == len(head), format) {
+			return format, true, nil
+		}
+	}
+	return tapeFmtSimH, false, nil
+}
+
+// looksLikeAws returns true if the image begins with two consistent AWSTAPE block headers
+func looksLikeAws(head []byte) bool {
+	if len(head) < awsHeaderBytes || binary.LittleEndian.Uint16(head[2:]) != 0 || !validAwsFlags(head[4:6]) {
+		return false
+	}
+	curLen := int(binary.LittleEndian.Uint16(head))
+	next := awsHeaderBytes + curLen
+	if len(head) < next+awsHeaderBytes {
+		return len(head) == next // a single block
+	}
+	return int(binary.LittleEndian.Uint16(head[next+2:])) == curLen && validAwsFlags(head[next+4:next+6])
+}
+
+func validAwsFlags(flags []byte) bool {
+	return flags[0] != 0 && flags[0]&^(awsNewRecord|awsTapeMark|awsEndOfRecord) == 0 && flags[1] == 0
+}
+
+// validTapeHead returns true if the first few records at the start of an image can be read in the given format.
+// If the head is only part of the image a record running off its end is allowed.
+func validTapeHead(head []byte, partial bool, format string) bool {
+	r := bytes.NewReader(head)
+	tr := tapeReaderT{r: bufio.NewReader(r), format: format}
+	for recs := 0; recs < tapeSniffRecords; recs++ {
+		if _, _, _, err := tr.readRecord(); err != nil {
+			return err == io.EOF || (partial && r.Len() == 0 && tr.r.Buffered() == 0)
+		}
+	}
+	return true
+}
+
+// readAwsRecord reads the next record from an AWSTAPE image, joining the blocks of a long record
+func readAwsRecord(r io.Reader) (data []byte, mark bool, err error) {
+	var hdr [awsHeaderBytes]byte
+	for {
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("truncated block header")
+			}
+			return nil, false, err
+		}
+		if hdr[4]&awsTapeMark != 0 {
+			return nil, true, nil
+		}
+		block := make([]byte, binary.LittleEndian.Uint16(hdr[:]))
+		if _, err = io.ReadFull(r, block); err != nil {
+			return nil, false, fmt.Errorf("truncated block of %d bytes", len(block))
+		}
+		data = append(data, block...)
+		if hdr[4]&awsEndOfRecord != 0 {
+			return data, false, nil
+		}
+	}
+}
+
+// tapeWriterT writes records to a tape image in SimH, E11 or AWSTAPE format
+type tapeWriterT struct {
+	w       io.Writer
+	format  string
+	prevLen int // AWSTAPE only
+}
+
+func (tw *tapeWriterT) writeRecord(data []byte) error {
+	switch tw.format {
+	case tapeFmtAWS:
+		flags := byte(awsNewRecord)
+		for {
+			block := data
+			if len(block) > awsMaxBlockData {
+				block = block[:awsMaxBlockData]
+			}
+			data = data[len(block):]
+			if len(data) == 0 {
+				flags |= awsEndOfRecord
+			}
+			if err := tw.writeAwsHeader(len(block), flags); err != nil {
+				return err
+			}
+			if _, err := tw.w.Write(block); err != nil {
+				return err
+			}
+			if len(data) == 0 {
+				return nil
+			}
+			flags = 0
+		}
+	case tapeFmtE11:
+		return writeSimhRecord(tw.w, data, false)
+	}
+	return writeSimhRecord(tw.w, data, true)
+}
+
+func (tw *tapeWriterT) writeMark() error {
+	if tw.format == tapeFmtAWS {
+		return tw.writeAwsHeader(0, awsTapeMark)
+	}
+	return writeSimhMark(tw.w)
+}
+
+func (tw *tapeWriterT) writeAwsHeader(curLen int, flags byte) error {
+	var hdr [awsHeaderBytes]byte
+	binary.LittleEndian.PutUint16(hdr[:], uint16(curLen))
+	binary.LittleEndian.PutUint16(hdr[2:], uint16(tw.prevLen))
+	hdr[4] = flags
+	tw.prevLen = curLen
+	_, err := tw.w.Write(hdr[:])
+	return err
+}
+
+// convertTape copies a tape image to a new image, or RAW directory, in the given format.
+// Copying stops at the logical end of tape, which is always written as two tape marks.
+func convertTape(inName, outName, format string) (files int, err error) {
+	inFormat, _, err := detectTapeFormat(inName)
+	if err != nil {
+		return 0, err
+	}
+	if inFormat == tapeFmtRaw {
+		// build a SimH image from the manifest and convert that
+		tmp, err := ioutil.TempFile("", "mvemg-raw-")
+		if err != nil {
+			return 0, err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		entries, err := dirTapeEntries(inName, "")
+		if err != nil {
+			return 0, err
+		}
+		if _, err = writeTapeImage(entries, tmp.Name()); err != nil {
+			return 0, err
+		}
+		inName = tmp.Name()
+	}
+	tr, err := openTape(inName)
+	if err != nil {
+		return 0, err
+	}
+	defer tr.close()
+	if format == tapeFmtRaw {
+		return writeRawTape(tr, outName)
+	}
+	out, err := ioutil.TempFile(filepath.Dir(outName), filepath.Base(outName)+"-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(out.Name()) // harmless once renamed
+	bw := bufio.NewWriter(out)
+	tw := tapeWriterT{w: bw, format: format}
+	inFile := false
+	for err == nil {
+		rec, mark, _, rerr := tr.readRecord()
+		switch {
+		case rerr == io.EOF || (mark && !inFile):
+			if inFile {
+				files++
+				err = tw.writeMark()
+			}
+			if err == nil {
+				err = tw.writeMark()
+			}
+			if err == nil {
+				err = bw.Flush()
+			}
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return 0, err
+			}
+			return files, os.Rename(out.Name(), outName)
+		case rerr != nil:
+			err = rerr
+		case mark:
+			files++
+			inFile = false
+			err = tw.writeMark()
+		default:
+			inFile = true
+			err = tw.writeRecord(rec)
+		}
+	}
+	out.Close()
+	return 0, err
+}
+
+// writeRawTape writes each file on a tape to a host file in a new directory, with a manifest giving
+// the block size of each so that the tape can be rebuilt with MKTAPE
+func writeRawTape(tr *tapeReaderT, dirName string) (files int, err error) {
+	if err = os.Mkdir(dirName, 0755); err != nil {
+		return 0, err
+	}
+	var manifest strings.Builder
+	var out *os.File
+	blockSize := 0
+	endFile := func() error {
+		fmt.Fprintf(&manifest, "%s,%d\n", filepath.Base(out.Name()), blockSize)
+		files++
+		blockSize = 0
+		err := out.Close()
+		out = nil
+		return err
+	}
+	for {
+		rec, mark, _, rerr := tr.readRecord()
+		switch {
+		case rerr == io.EOF || (mark && out == nil):
+			if out != nil {
+				if err = endFile(); err != nil {
+					return files, err
+				}
+			}
+			return files, ioutil.WriteFile(filepath.Join(dirName, rawManifest), []byte(manifest.String()), 0644)
+		case rerr != nil:
+			if out != nil {
+				out.Close()
+			}
+			return files, rerr
+		case mark:
+			if err = endFile(); err != nil {
+				return files, err
+			}
+		default:
+			if out == nil {
+				if out, err = os.Create(filepath.Join(dirName, fmt.Sprintf("FILE%03d", files))); err != nil {
+					return files, err
+				}
+			}
+			if len(rec) > blockSize {
+				blockSize = len(rec)
+			}
+			if _, err = out.Write(rec); err != nil {
+				out.Close()
+				return files, err
+			}
+		}
+	}
+}
+
+// parseTapeFormat checks a format name given by the user
+func parseTapeFormat(name string) (string, error) {
+	switch name {
+	case tapeFmtSimH, tapeFmtE11, tapeFmtAWS, tapeFmtRaw:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown tape format <%s>, expecting SIMH, E11, AWS or RAW", name)
+}
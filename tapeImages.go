@@ -0,0 +1,273 @@
+// tapeImages.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// dirTapePrefix introduces a host directory to be ATTached as a tape
+	dirTapePrefix = "DIR:"
+	// dirTapeBlockSize is used for the files in a directory tape which has no manifest
+	dirTapeBlockSize = 2048
+)
+
+// tapeMountT records the image attached to a tape unit.
+//
+// A SimH image is attached to the controller directly, and may be written by the guest unless it is ATTached RO.
+// Compressed images, and those in other formats, are attached via a temporary SimH working copy which is discarded
+// on DETach, so they are always write-locked.
+//
+// A host directory may be presented as a tape, a SimH working copy is built from the files in it and, unless it
+// is ATTached RO, any files the guest writes are copied back into the directory on DETach.
+type tapeMountT struct {
+	du       devUnitT
+	file     string          // the image named in the ATT command
+	workFile string          // the file actually attached to the controller
+	dir      string          // the host directory for a directory tape
+	dirFiles []tapeFileInfoT // the files on a directory tape as attached
+	readOnly bool            // the tape is write-locked
+	capacity int64           // the position of the end-of-tape marker
+}
+
+// tapeMounts holds the currently attached tape images, keyed by device/unit name
+var tapeMounts = map[string]*tapeMountT{}
+
+// attachTape attaches a tape image to an MTB unit, write-locked if readOnly is set.
+// The manifest is only used if the image is a host directory.
+func attachTape(du devUnitT, imageName, manifestName string, readOnly bool, capacity int64) bool {
+	if _, attached := tapeMounts[du.String()]; attached {
+		cmdError(" *** Unit already has an image ATTached, DETach it first ***")
+		return false
+	}
+	if strings.HasPrefix(imageName, dirTapePrefix) {
+		return attachTapeDir(du, imageName, manifestName, readOnly, capacity)
+	}
+	format, recognised, err := detectTapeFormat(imageName)
+	if err != nil {
+		cmdError(" *** " + err.Error() + " ***")
+		return false
+	}
+	if !recognised {
+		tto.PutNLString(" *** Warning: " + imageName + " does not look like a SimH, E11 or AWSTAPE image, ATTaching it as SimH ***")
+	}
+	mount := tapeMountT{du: du, file: imageName, workFile: imageName, readOnly: readOnly, capacity: capacity}
+	if format != tapeFmtSimH {
+		if mount.workFile, err = convertToWorkFile(imageName); err != nil {
+			log.Printf("ERROR: Could not convert %s: %s\n", imageName, err.Error())
+			return false
+		}
+		tto.PutNLString("Converted " + format + " format tape image for ATTachment")
+	} else if isCompressed(imageName) {
+		if mount.workFile, err = copyToWorkFile(imageName); err != nil {
+			log.Printf("ERROR: Could not decompress %s: %s\n", imageName, err.Error())
+			return false
+		}
+	}
+	if mount.workFile != imageName && !readOnly {
+		tto.PutNLString(" *** Converted and compressed tapes are write-locked, " + imageName + " is ATTached RO ***")
+		mount.readOnly = true
+	}
+	if !mount.controllerAttach() {
+		mount.discardWorkFile()
+		return false
+	}
+	tapeMounts[du.String()] = &mount
+	return true
+}
+
+// controllerAttach loads the mount's working file onto its drive
+func (mount *tapeMountT) controllerAttach() bool {
+	err := mtbControllers[mount.du.devNum].tape6026Attach(mount.du.unit, mount.workFile, mount.readOnly, mount.capacity)
+	if err != nil {
+		cmdError(" *** " + err.Error() + " ***")
+		return false
+	}
+	return true
+}
+
+// detachTape detaches the image from a tape unit
+func detachTape(du devUnitT) bool {
+	mount, attached := tapeMounts[du.String()]
+	if !attached {
+		cmdError(" *** No image is ATTached to that unit ***")
+		return false
+	}
+	if bus.GetBusy(du.devNum) {
+		cmdError(" *** Controller is busy - transfer in progress, try again ***")
+		return false
+	}
+	if err := mtbControllers[du.devNum].tape6026Detach(du.unit); err != nil {
+		log.Printf("ERROR: Could not close image of %s: %s\n", du.String(), err.Error())
+		return false
+	}
+	if mount.dir != "" && !mount.readOnly {
+		saved, err := mount.saveDirFiles()
+		if err != nil {
+			log.Printf("ERROR: Could not save tape files to %s, tape kept in %s: %s\n", mount.dir, mount.workFile, err.Error())
+			delete(tapeMounts, du.String())
+			return false
+		}
+		for _, hostFile := range saved {
+			tto.PutNLString("Tape file written to " + hostFile)
+		}
+	}
+	mount.discardWorkFile()
+	delete(tapeMounts, du.String())
+	return true
+}
+
+// detachAllTapes is called when the emulator exits so that working copies are not left behind
+func detachAllTapes() {
+	for _, mount := range tapeMounts {
+		detachTape(mount.du)
+	}
+}
+
+// discardWorkFile removes the working copy of a compressed, converted or directory tape
+func (mount *tapeMountT) discardWorkFile() {
+	if mount.workFile != mount.file {
+		os.Remove(mount.workFile)
+	}
+}
+
+// convertToWorkFile converts a tape image to a new temporary SimH image, returning its name
+func convertToWorkFile(imageName string) (workName string, err error) {
+	tmp, err := ioutil.TempFile("", "mvemg-"+filepath.Base(imageName)+"-")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	if _, err = convertTape(imageName, tmp.Name(), tapeFmtSimH); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// attachTapeDir attaches a host directory as a tape.  The files on the tape are those listed in the
+// manifest, or in manifest.csv in the directory; if there is neither every file in the directory is used,
+// in name order, with the default block size.
+func attachTapeDir(du devUnitT, imageName, manifestName string, readOnly bool, capacity int64) bool {
+	dir := strings.TrimPrefix(imageName, dirTapePrefix)
+	entries, err := dirTapeEntries(dir, manifestName)
+	if err == nil {
+		mount := tapeMountT{du: du, file: imageName, dir: dir, readOnly: readOnly, capacity: capacity}
+		if mount.workFile, err = dirToWorkFile(entries); err == nil {
+			if mount.dirFiles, err = scanTape(mount.workFile, -1, nil); err == nil {
+				if !mount.controllerAttach() {
+					mount.discardWorkFile()
+					return false
+				}
+				tapeMounts[du.String()] = &mount
+				tto.PutNLString(fmt.Sprintf("Directory tape built with %d. files", len(entries)))
+				return true
+			}
+			mount.discardWorkFile()
+		}
+	}
+	cmdError(" *** Could not build tape from directory - " + err.Error() + " ***")
+	return false
+}
+
+// dirTapeEntries lists the files to be presented on a directory tape
+func dirTapeEntries(dir, manifestName string) ([]tapeManifestEntryT, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if manifestName == "" {
+		manifestName = filepath.Join(dir, rawManifest)
+		if _, err = os.Stat(manifestName); os.IsNotExist(err) {
+			manifestName = ""
+		}
+	}
+	if manifestName != "" {
+		return readTapeManifest(manifestName, dir)
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []tapeManifestEntryT
+	for _, info := range infos {
+		if info.Mode().IsRegular() {
+			entries = append(entries, tapeManifestEntryT{fileName: filepath.Join(dir, info.Name()), blockSize: dirTapeBlockSize})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].fileName < entries[j].fileName })
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no files in %s", dir)
+	}
+	return entries, nil
+}
+
+// dirToWorkFile builds a temporary SimH tape from the entries, returning its name
+func dirToWorkFile(entries []tapeManifestEntryT) (workName string, err error) {
+	tmp, err := ioutil.TempFile("", "mvemg-dirtape-")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	if _, err = writeTapeImage(entries, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// saveDirFiles copies each file on a directory tape which differs from when it was attached into the
+// directory as a new file named TAPEFILEnnn, the existing files are never changed.
+// The names of the new files are returned.
+func (mount *tapeMountT) saveDirFiles() (saved []string, err error) {
+	files, err := scanTape(mount.workFile, -1, nil)
+	if err != nil {
+		return nil, err
+	}
+	for fileNo, info := range files {
+		if fileNo < len(mount.dirFiles) && info.crc == mount.dirFiles[fileNo].crc && info.bytes == mount.dirFiles[fileNo].bytes {
+			continue
+		}
+		hostFile := filepath.Join(mount.dir, fmt.Sprintf("TAPEFILE%03d", fileNo))
+		for n := 1; ; n++ {
+			if _, err = os.Stat(hostFile); os.IsNotExist(err) {
+				break
+			}
+			hostFile = filepath.Join(mount.dir, fmt.Sprintf("TAPEFILE%03d.%d", fileNo, n))
+		}
+		if _, err = extractTapeFile(mount.workFile, fileNo, hostFile); err != nil {
+			return saved, err
+		}
+		saved = append(saved, hostFile)
+	}
+	return saved, nil
+}
@@ -0,0 +1,283 @@
+// tapeTools.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tapeFileInfoT summarises one file on a tape image, ie. the records between tape marks
+type tapeFileInfoT struct {
+	records    int
+	badRecords int
+	bytes      int64
+	minBlock   int
+	maxBlock   int
+	crc        uint32
+	dumpDate   string // set if the file is in AOS/VS DUMP format
+	dump       []dumpEntryT
+	dumpErr    error
+}
+
+// scanTape reads a tape image without attaching it, summarising each file.  If extractFile is not
+// negative, the data of that file is copied to w and scanning stops after it.
+// The logical end of tape is two consecutive tape marks, or the end of the image.
+func scanTape(imageName string, extractFile int, w io.Writer) (files []tapeFileInfoT, err error) {
+	tr, err := openTape(imageName)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.close()
+	var (
+		cur      tapeFileInfoT
+		dumpPipe *io.PipeWriter
+		dumpDone chan bool
+	)
+	endFile := func() {
+		if dumpPipe != nil {
+			dumpPipe.Close()
+			<-dumpDone
+			dumpPipe = nil
+		}
+		files = append(files, cur)
+		cur = tapeFileInfoT{}
+	}
+	for {
+		rec, mark, bad, rerr := tr.readRecord()
+		if rerr == io.EOF || (mark && cur.records == 0) {
+			if cur.records > 0 {
+				endFile()
+			}
+			return files, nil
+		}
+		if rerr != nil {
+			if dumpPipe != nil {
+				dumpPipe.Close()
+				<-dumpDone
+			}
+			return files, fmt.Errorf("file %d. record %d.: %s", len(files), cur.records, rerr.Error())
+		}
+		if mark {
+			endFile()
+			if extractFile == len(files)-1 {
+				return files, nil
+			}
+			continue
+		}
+		if cur.records == 0 {
+			cur.minBlock = len(rec)
+			if looksLikeDumpStart(rec) {
+				cur.dumpDate = dumpDate(rec)
+				pr, pw := io.Pipe()
+				dumpPipe, dumpDone = pw, make(chan bool)
+				go func(info *tapeFileInfoT) {
+					info.dump, info.dumpErr = parseDump(pr)
+					dumpDone <- true
+				}(&cur)
+			}
+		}
+		cur.records++
+		if bad {
+			cur.badRecords++
+		}
+		cur.bytes += int64(len(rec))
+		if len(rec) < cur.minBlock {
+			cur.minBlock = len(rec)
+		}
+		if len(rec) > cur.maxBlock {
+			cur.maxBlock = len(rec)
+		}
+		cur.crc = crc32.Update(cur.crc, crc32.IEEETable, rec)
+		if dumpPipe != nil {
+			dumpPipe.Write(rec)
+		}
+		if extractFile == len(files) {
+			if _, err = w.Write(rec); err != nil {
+				return files, err
+			}
+		}
+	}
+}
+
+// tapeListing describes the contents of a tape image
+func tapeListing(imageName string) (string, error) {
+	format, _, err := detectTapeFormat(imageName)
+	if err != nil {
+		return "", err
+	}
+	files, err := scanTape(imageName, -1, nil)
+	if len(files) == 0 && err != nil {
+		return "", err
+	}
+	var res strings.Builder
+	fmt.Fprintf(&res, "%s format tape image\012", format)
+	res.WriteString("File  Records  Block Size      Bytes    CRC-32\012")
+	for fileNo, info := range files {
+		blockSize := fmt.Sprintf("%d.", info.maxBlock)
+		if info.minBlock != info.maxBlock {
+			blockSize = fmt.Sprintf("%d.-%d.", info.minBlock, info.maxBlock)
+		}
+		fmt.Fprintf(&res, "%3d.  %6d.  %-12s %10d.  %08X", fileNo, info.records, blockSize, info.bytes, info.crc)
+		if info.badRecords > 0 {
+			fmt.Fprintf(&res, "  %d. bad record(s)", info.badRecords)
+		}
+		res.WriteString("\012")
+		if info.dumpDate != "" {
+			fmt.Fprintf(&res, "      AOS/VS DUMP format, dumped %s, %d. entries\012", info.dumpDate, len(info.dump))
+			for _, entry := range info.dump {
+				if entry.link != "" {
+					fmt.Fprintf(&res, "        %-32s -> %s\012", entry.name, entry.link)
+				} else {
+					fmt.Fprintf(&res, "        %-32s %10d.\012", entry.name, entry.bytes)
+				}
+			}
+			if info.dumpErr != nil {
+				fmt.Fprintf(&res, "      *** DUMP listing incomplete: %s ***\012", info.dumpErr.Error())
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(&res, " *** Tape image error at %s ***\012", err.Error())
+	}
+	return res.String(), nil
+}
+
+// extractTapeFile copies the data of one file (numbered from 0) on a tape image to a host file
+func extractTapeFile(imageName string, fileNo int, hostFile string) (bytes int64, err error) {
+	out, err := os.Create(hostFile)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(out)
+	files, err := scanTape(imageName, fileNo, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && len(files) <= fileNo {
+		err = fmt.Errorf("tape has only %d. file(s)", len(files))
+	}
+	if err != nil {
+		os.Remove(hostFile)
+		return 0, err
+	}
+	return files[fileNo].bytes, nil
+}
+
+// tapeCommand implements the TAPE LIST and TAPE EXTRACT commands
+func tapeCommand(cmd []string) {
+	switch {
+	case len(cmd) == 3 && cmd[1] == "LIST":
+		listing, err := tapeListing(cmd[2])
+		if err != nil {
+			cmdError(" *** Could not read tape image - " + err.Error() + " ***")
+			return
+		}
+		tto.PutString(listing)
+	case len(cmd) == 5 && cmd[1] == "EXTRACT":
+		fileNo, err := strconv.Atoi(strings.TrimSuffix(cmd[3], "."))
+		if err != nil || fileNo < 0 {
+			cmdError(" *** TAPE EXTRACT could not parse <fileno> argument ***")
+			return
+		}
+		bytes, err := extractTapeFile(cmd[2], fileNo, cmd[4])
+		if err != nil {
+			cmdError(" *** Could not extract file - " + err.Error() + " ***")
+			return
+		}
+		tto.PutNLString(fmt.Sprintf(" *** %d. bytes extracted to %s ***", bytes, cmd[4]))
+	case len(cmd) == 5 && cmd[1] == "CONVERT":
+		format, err := parseTapeFormat(cmd[4])
+		if err != nil {
+			cmdError(" *** " + err.Error() + " ***")
+			return
+		}
+		files, err := convertTape(cmd[2], cmd[3], format)
+		if err != nil {
+			cmdError(" *** Could not convert tape - " + err.Error() + " ***")
+			return
+		}
+		tto.PutNLString(fmt.Sprintf(" *** %d. files written to %s in %s format ***", files, cmd[3], format))
+	default:
+		cmdError(" *** Expecting TAPE LIST <image>, TAPE EXTRACT <image> <fileno> <hostfile> or TAPE CONVERT <in> <out> <format> ***")
+	}
+}
+
+// tapeSubcommand implements 'mvemg tape ...' from the host command line
+func tapeSubcommand(args []string) int {
+	usage := "Usage: mvemg tape build <manifest.csv> <tapefile>\n" +
+		"       mvemg tape list <tapefile>\n" +
+		"       mvemg tape extract <tapefile> <fileno> <hostfile>\n" +
+		"       mvemg tape convert <in> <out> SIMH|E11|AWS|RAW"
+	switch {
+	case len(args) == 3 && args[0] == "build":
+		files, err := buildTape(args[1], args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Could not build tape: %s\n", err.Error())
+			return 1
+		}
+		fmt.Printf("Tape image %s built with %d files\n", args[2], files)
+	case len(args) == 2 && args[0] == "list":
+		listing, err := tapeListing(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Could not read tape image: %s\n", err.Error())
+			return 1
+		}
+		fmt.Print(listing)
+	case len(args) == 4 && args[0] == "extract":
+		fileNo, err := strconv.Atoi(args[2])
+		if err != nil || fileNo < 0 {
+			fmt.Fprintln(os.Stderr, usage)
+			return 2
+		}
+		bytes, err := extractTapeFile(args[1], fileNo, args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Could not extract file: %s\n", err.Error())
+			return 1
+		}
+		fmt.Printf("%d bytes extracted to %s\n", bytes, args[3])
+	case len(args) == 4 && args[0] == "convert":
+		format, err := parseTapeFormat(strings.ToUpper(args[3]))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err.Error())
+			return 2
+		}
+		files, err := convertTape(args[1], args[2], format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Could not convert tape: %s\n", err.Error())
+			return 1
+		}
+		fmt.Printf("%d files written to %s in %s format\n", files, args[2], format)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	return 0
+}
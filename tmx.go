@@ -0,0 +1,452 @@
+// tmx.go
+
+// Copyright (C) 2020  Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/SMerrony/dgemug/devices"
+	"github.com/SMerrony/dgemug/dg"
+)
+
+// The terminal multiplexors (TMX, TMX1 and TMX2) are a device of MV/Em's own which connects each guest terminal
+// line to its own host TCP port, or to a host pseudo-terminal, so that several users may log in at once with
+// DASHER emulators.  The lines are given in the machine configuration, eg. "Lines": [ "localhost:10001", "pty" ]
+//
+// N.B. The TMX is NOT compatible with DG's IAC, ISC or ALM controllers, and guest software needs a driver written
+// for it; its defaults are merely the IAC and ISC device codes.  Each line has a receiver and a transmitter
+// section; NIOS starts the scanner, which stops on the next section (in rotation) requesting service, clears BUSY,
+// sets DONE and interrupts.  A receiver requests service when it holds a character or its modem status has
+// changed, an enabled transmitter when it is idle.
+//
+//	DIA - return the section being serviced: tmxSvcValid + the line number in bits 9-14 + bit 15 set for the transmitter
+//	DOA - select the line in bits 10-15 for DIB, DOB, DIC and DOC
+//	DIB - receive: the next character in bits 8-15, or tmxRxModem if the modem status changed, + tmxRxCarrier
+//	DOB - transmit the character in bits 8-15, the transmitter requests service again once it has been sent
+//	DIC - return the line's modem status: tmxModemCarrier and tmxModemDTR
+//	DOC - set the line's control: tmxCtlDTR, tmxCtlTxEnable and tmxCtlRxEnable; dropping DTR hangs up the line
+//	NIOC - stop the scanner
+//
+// Output to each line is queued and written by the line's own goroutine, so a slow or stalled connection never
+// holds up the CPU; characters sent while the queue is full are discarded and counted.
+const (
+	tmxSvcValid     = 0100000
+	tmxSvcTransmit  = 1
+	tmxRxModem      = 0100000
+	tmxRxCarrier    = 040000
+	tmxModemCarrier = 1
+	tmxModemDTR     = 2
+	tmxCtlDTR       = 1
+	tmxCtlTxEnable  = 2
+	tmxCtlRxEnable  = 4
+	tmxLineMask     = 077
+	tmxMaxLines     = 64
+	// tmxInputBuffSize is the number of characters buffered per line, any more are discarded
+	tmxInputBuffSize = 1024
+	// tmxOutputBuffSize is the number of characters which may be queued for output on a line
+	tmxOutputBuffSize = 1024
+	// tmxPtyLine is given in place of a network address to connect a line to a host pseudo-terminal
+	tmxPtyLine = "pty"
+)
+
+// tmxLineT is one terminal line
+type tmxLineT struct {
+	addr         string // host address, or tmxPtyLine
+	ptyName      string
+	conn         io.ReadWriteCloser
+	output       chan byte // characters queued for the line's writer, nil when disconnected
+	input        []byte
+	carrier      bool
+	modemChanged bool
+	dtr          bool
+	rxEnabled    bool
+	txEnabled    bool
+	txIdle       bool // the transmitter has no character in progress
+	rxChars      uint64
+	txChars      uint64
+	txDropped    uint64
+}
+
+// tmxT is an emulated asynchronous terminal controller
+type tmxT struct {
+	sync.Mutex
+	devNum   int
+	bus      *devices.BusT
+	lines    []tmxLineT
+	curLine  int
+	svcSlot  int // the section being serviced, line*2 + 1 for a transmitter, or -1
+	scanning bool
+}
+
+// tmxControllers holds the configured terminal controllers by device code
+var tmxControllers = map[int]*tmxT{}
+
+// tmxInit puts a terminal controller on the bus and starts listening on its lines
+func tmxInit(devNum int, bus *devices.BusT, lineAddrs []string) *tmxT {
+	p := &tmxT{devNum: devNum, bus: bus, lines: make([]tmxLineT, len(lineAddrs)), svcSlot: -1}
+	bus.SetResetFunc(devNum, p.tmxReset)
+	bus.SetDataInFunc(devNum, p.tmxDataIn)
+	bus.SetDataOutFunc(devNum, p.tmxDataOut)
+	for ix, addr := range lineAddrs {
+		p.lines[ix].addr = addr
+		p.lines[ix].txIdle = true
+		if addr == tmxPtyLine {
+			p.openPtyLine(ix)
+		} else {
+			go p.lineListener(ix)
+		}
+	}
+	tmxControllers[devNum] = p
+	return p
+}
+
+// tmxReset stops the scanner and disables every line, connections are kept
+func (p *tmxT) tmxReset() {
+	p.Lock()
+	p.curLine = 0
+	p.svcSlot = -1
+	p.scanning = false
+	for ix := range p.lines {
+		l := &p.lines[ix]
+		l.input = nil
+		l.modemChanged = false
+		l.dtr, l.rxEnabled, l.txEnabled = false, false, false
+	}
+	p.Unlock()
+	p.bus.SetBusy(p.devNum, false)
+	p.bus.SetDone(p.devNum, false)
+}
+
+// openPtyLine connects a line to a new host pseudo-terminal, which is 'connected' until the host side is closed
+func (p *tmxT) openPtyLine(line int) {
+	f, name, err := openPty()
+	if err != nil {
+		log.Printf("ERROR: Could not open a pty for %s line %d: %s\n", deviceMap[p.devNum].DgMnemonic, line, err.Error())
+		return
+	}
+	log.Printf("INFO: %s line %d is connected to %s\n", deviceMap[p.devNum].DgMnemonic, line, name)
+	p.Lock()
+	p.lines[line].ptyName = name
+	p.Unlock()
+	p.connected(line, f)
+}
+
+// lineListener accepts connections for a TCP line, one at a time
+func (p *tmxT) lineListener(line int) {
+	l, err := net.Listen("tcp", p.lines[line].addr)
+	if err != nil {
+		log.Printf("ERROR: Could not listen on %s for %s line %d: %s\n", p.lines[line].addr,
+			deviceMap[p.devNum].DgMnemonic, line, err.Error())
+		return
+	}
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("ERROR: Could not accept on %s: %s\n", p.lines[line].addr, err.Error())
+			return
+		}
+		p.Lock()
+		busy := p.lines[line].conn != nil
+		p.Unlock()
+		if busy {
+			conn.Write([]byte("\012 *** Line in use ***\012"))
+			conn.Close()
+			continue
+		}
+		p.connected(line, conn)
+	}
+}
+
+// connected raises carrier on a line and starts reading from and writing to it
+func (p *tmxT) connected(line int, conn io.ReadWriteCloser) {
+	output := make(chan byte, tmxOutputBuffSize)
+	p.Lock()
+	l := &p.lines[line]
+	l.conn = conn
+	l.output = output
+	l.carrier = true
+	l.modemChanged = true
+	l.input = nil
+	p.Unlock()
+	p.scan()
+	go p.lineReader(line, conn)
+	go p.lineWriter(line, conn, output)
+}
+
+// lineReader buffers input from a connected line until it is disconnected
+func (p *tmxT) lineReader(line int, conn io.ReadWriteCloser) {
+	b := make([]byte, 80)
+	for {
+		n, err := conn.Read(b)
+		if n > 0 {
+			p.Lock()
+			l := &p.lines[line]
+			room := tmxInputBuffSize - len(l.input)
+			if n > room {
+				n = room
+			}
+			l.input = append(l.input, b[:n]...)
+			l.rxChars += uint64(n)
+			p.Unlock()
+			p.scan()
+		}
+		if err != nil {
+			break
+		}
+	}
+	p.hangUp(line, conn)
+}
+
+// lineWriter sends the characters queued for a line until it is disconnected, the transmitter becomes
+// idle again once each one has been written
+func (p *tmxT) lineWriter(line int, conn io.ReadWriteCloser, output <-chan byte) {
+	for c := range output {
+		_, err := conn.Write([]byte{c})
+		p.Lock()
+		l := &p.lines[line]
+		if l.conn == conn {
+			l.txIdle = true
+		}
+		p.Unlock()
+		if err != nil {
+			p.hangUp(line, conn)
+			return
+		}
+		p.scan()
+	}
+}
+
+// hangUp drops carrier on a line, conn must be the line's current connection.  A pty line is given a new pty.
+func (p *tmxT) hangUp(line int, conn io.ReadWriteCloser) {
+	p.Lock()
+	l := &p.lines[line]
+	if l.conn != conn || conn == nil {
+		p.Unlock()
+		return
+	}
+	conn.Close()
+	close(l.output)
+	l.conn = nil
+	l.output = nil
+	l.carrier = false
+	l.modemChanged = true
+	l.txIdle = true
+	reopen := l.addr == tmxPtyLine
+	p.Unlock()
+	p.scan()
+	if reopen {
+		// a pty cannot be reconnected once closed, so the line gets a new one
+		p.openPtyLine(line)
+	}
+}
+
+// requesting returns true if the section in slot (line*2 + 1 for a transmitter) needs service; the caller must hold the lock
+func (p *tmxT) requesting(slot int) bool {
+	l := &p.lines[slot/2]
+	if slot&tmxSvcTransmit != 0 {
+		return l.txEnabled && l.txIdle
+	}
+	return l.modemChanged || (l.rxEnabled && len(l.input) > 0)
+}
+
+// nextRequest returns the next section needing service after the last one serviced, or -1; the caller must hold the lock
+func (p *tmxT) nextRequest() int {
+	slots := len(p.lines) * 2
+	for i := 1; i <= slots; i++ {
+		slot := (p.svcSlot + i + slots) % slots
+		if p.requesting(slot) {
+			return slot
+		}
+	}
+	return -1
+}
+
+// scan stops the scanner on the next section needing service, if it is running, and interrupts
+func (p *tmxT) scan() {
+	p.Lock()
+	found := false
+	if p.scanning {
+		if slot := p.nextRequest(); slot >= 0 {
+			p.svcSlot = slot
+			p.curLine = slot / 2
+			p.scanning = false
+			found = true
+		}
+	}
+	p.Unlock()
+	if found {
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, true)
+		if !p.bus.IsDevMasked(p.devNum) {
+			p.bus.SendInterrupt(p.devNum)
+		}
+	}
+}
+
+// receive returns the DIB word for the current line; the caller must hold the lock
+func (p *tmxT) receive() (datum dg.WordT) {
+	if p.curLine >= len(p.lines) {
+		return 0
+	}
+	l := &p.lines[p.curLine]
+	if l.carrier {
+		datum |= tmxRxCarrier
+	}
+	switch {
+	case l.modemChanged:
+		l.modemChanged = false
+		datum |= tmxRxModem
+	case len(l.input) > 0:
+		datum |= dg.WordT(l.input[0])
+		l.input = l.input[1:]
+	}
+	return datum
+}
+
+// transmit queues a character on the current line; the caller must hold the lock
+func (p *tmxT) transmit(c byte) {
+	if p.curLine >= len(p.lines) {
+		return
+	}
+	l := &p.lines[p.curLine]
+	if !l.txEnabled {
+		return
+	}
+	if l.output == nil { // nobody is connected, the character is sent nowhere
+		l.txIdle = true
+		return
+	}
+	select {
+	case l.output <- c:
+		l.txIdle = false
+		l.txChars++
+	default:
+		l.txDropped++
+	}
+}
+
+// control sets the current line's control bits, returning the connection to hang up if DTR was dropped;
+// the caller must hold the lock
+func (p *tmxT) control(datum dg.WordT) (hangUp io.ReadWriteCloser) {
+	if p.curLine >= len(p.lines) {
+		return nil
+	}
+	l := &p.lines[p.curLine]
+	dtr := datum&tmxCtlDTR != 0
+	if l.dtr && !dtr && l.addr != tmxPtyLine {
+		hangUp = l.conn
+	}
+	l.dtr = dtr
+	l.txEnabled = datum&tmxCtlTxEnable != 0
+	l.rxEnabled = datum&tmxCtlRxEnable != 0
+	return hangUp
+}
+
+func (p *tmxT) tmxDataOut(datum dg.WordT, abc byte, flag byte) {
+	switch abc {
+	case 'A':
+		p.Lock()
+		p.curLine = int(datum & tmxLineMask)
+		p.Unlock()
+	case 'B':
+		p.Lock()
+		p.transmit(byte(datum))
+		p.Unlock()
+	case 'C':
+		p.Lock()
+		line := p.curLine
+		conn := p.control(datum)
+		p.Unlock()
+		p.hangUp(line, conn)
+	}
+	p.tmxHandleFlag(flag)
+}
+
+func (p *tmxT) tmxDataIn(abc byte, flag byte) (datum dg.WordT) {
+	p.Lock()
+	switch abc {
+	case 'A':
+		if p.svcSlot >= 0 && p.requesting(p.svcSlot) {
+			p.curLine = p.svcSlot / 2
+			datum = tmxSvcValid | dg.WordT(p.svcSlot)
+		}
+	case 'B':
+		datum = p.receive()
+	case 'C':
+		if p.curLine < len(p.lines) {
+			l := &p.lines[p.curLine]
+			if l.carrier {
+				datum |= tmxModemCarrier
+			}
+			if l.dtr {
+				datum |= tmxModemDTR
+			}
+		}
+	}
+	p.Unlock()
+	p.tmxHandleFlag(flag)
+	return datum
+}
+
+func (p *tmxT) tmxHandleFlag(flag byte) {
+	switch flag {
+	case 'S':
+		p.Lock()
+		p.scanning = true
+		p.Unlock()
+		p.bus.SetBusy(p.devNum, true)
+		p.bus.SetDone(p.devNum, false)
+		p.scan()
+	case 'C':
+		p.Lock()
+		p.scanning = false
+		p.Unlock()
+		p.bus.SetBusy(p.devNum, false)
+		p.bus.SetDone(p.devNum, false)
+	}
+}
+
+// tmxStatus describes the controller's lines for SHOW DEV
+func (p *tmxT) tmxStatus() string {
+	p.Lock()
+	defer p.Unlock()
+	var res strings.Builder
+	for ix, l := range p.lines {
+		state := "waiting"
+		if l.carrier {
+			state = "connected"
+		}
+		where := l.addr
+		if l.ptyName != "" {
+			where = l.ptyName
+		}
+		fmt.Fprintf(&res, "%s line %d. on %s: %s, %d. chars in, %d. out, %d. dropped\012", deviceMap[p.devNum].DgMnemonic,
+			ix, where, state, l.rxChars, l.txChars, l.txDropped)
+	}
+	return res.String()
+}